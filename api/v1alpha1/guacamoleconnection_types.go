@@ -0,0 +1,129 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ConditionReady is True once the Guacamole connection is published and the guest answers on its port.
+	ConditionReady = "Ready"
+	// ConditionDegraded is True while publishing the connection keeps failing, e.g. because Guacamole is down.
+	ConditionDegraded = "Degraded"
+)
+
+// GuacamoleConnectionSpec defines the desired state of GuacamoleConnection.
+type GuacamoleConnectionSpec struct {
+	// VirtualMachineName is the name of the KubeVirt VirtualMachine, in the same namespace,
+	// this connection belongs to.
+	VirtualMachineName string `json:"virtualMachineName"`
+}
+
+// GuacamoleInstanceConnection is the connection published to one Guacamole instance.
+type GuacamoleInstanceConnection struct {
+	// Instance is the name of the GuacamoleInstance, or "default" for the instance configured by flags.
+	Instance string `json:"instance"`
+
+	// ConnectionIdentifier is the identifier the instance assigned to the connection.
+	ConnectionIdentifier string `json:"connectionIdentifier"`
+
+	// SharingProfiles lists the sharing profile variants set up for the connection.
+	// +optional
+	SharingProfiles []string `json:"sharingProfiles,omitempty"`
+
+	// ObserverGroups lists the user groups granted the connection's sharing profiles.
+	// +optional
+	ObserverGroups []string `json:"observerGroups,omitempty"`
+}
+
+// GuacamoleConnectionStatus defines the observed state of GuacamoleConnection.
+type GuacamoleConnectionStatus struct {
+	// Instances lists the Guacamole instances the connection is published to.
+	// +listType=map
+	// +listMapKey=instance
+	// +optional
+	Instances []GuacamoleInstanceConnection `json:"instances,omitempty"`
+
+	// Protocol is the remote-desktop protocol of the connection (rdp, vnc or ssh).
+	// +optional
+	Protocol string `json:"protocol,omitempty"`
+
+	// Hostname is the address guacd connects to.
+	// +optional
+	Hostname string `json:"hostname,omitempty"`
+
+	// Published is true once the connection was first published for the VM.
+	// +optional
+	Published bool `json:"published,omitempty"`
+
+	// ObservedVMStatus is the printable status of the VM the connection was last synced for.
+	// +optional
+	ObservedVMStatus string `json:"observedVMStatus,omitempty"`
+
+	// ConfigRevision is the revision of the operator configuration the connection was last
+	// published with, empty when it was published with the flags.
+	// +optional
+	ConfigRevision string `json:"configRevision,omitempty"`
+
+	// ConnectionHash is a hash of the connection and the per-VM settings it was last published with.
+	// +optional
+	ConnectionHash string `json:"connectionHash,omitempty"`
+
+	// Port is the guest port guacd connects to.
+	// +optional
+	Port string `json:"port,omitempty"`
+
+	// Conditions describe the state of the connection.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=guacconn
+// +kubebuilder:printcolumn:name="VM",type=string,JSONPath=`.spec.virtualMachineName`
+// +kubebuilder:printcolumn:name="Protocol",type=string,JSONPath=`.status.protocol`
+// +kubebuilder:printcolumn:name="Hostname",type=string,JSONPath=`.status.hostname`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].reason`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// GuacamoleConnection is the Schema for the guacamoleconnections API.
+// The operator keeps one per managed KubeVirt VirtualMachine to report the state of its Guacamole connection.
+type GuacamoleConnection struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GuacamoleConnectionSpec   `json:"spec,omitempty"`
+	Status GuacamoleConnectionStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GuacamoleConnectionList contains a list of GuacamoleConnection.
+type GuacamoleConnectionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GuacamoleConnection `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GuacamoleConnection{}, &GuacamoleConnectionList{})
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SecretReference points at a Secret in a given namespace.
+type SecretReference struct {
+	// Name of the Secret.
+	Name string `json:"name"`
+
+	// Namespace of the Secret.
+	Namespace string `json:"namespace"`
+}
+
+// GuacamoleInstanceTLS configures how the operator verifies the instance's certificate and authenticates to it.
+type GuacamoleInstanceTLS struct {
+	// InsecureSkipVerify disables certificate verification. Only meant for testing.
+	// +optional
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+
+	// CASecretRef points at a Secret whose "ca.crt" key holds the PEM CA bundle the instance's
+	// certificate is verified against, instead of the system roots.
+	// +optional
+	CASecretRef *SecretReference `json:"caSecretRef,omitempty"`
+
+	// ClientCertSecretRef points at a kubernetes.io/tls Secret whose "tls.crt" and "tls.key" keys hold
+	// the client certificate presented to instances that require mutual TLS.
+	// +optional
+	ClientCertSecretRef *SecretReference `json:"clientCertSecretRef,omitempty"`
+}
+
+// GuacamoleInstanceAuth configures how the operator logs in to the instance.
+type GuacamoleInstanceAuth struct {
+	// Mode is "password" to log in with the username and password of the credentials Secret, "json" to log
+	// in with a payload encrypted with the "json-secret-key" of the credentials Secret (Guacamole's JSON auth
+	// extension), or "header" to send the username in an HTTP header (Guacamole's header auth extension).
+	// +kubebuilder:validation:Enum=password;json;header
+	// +kubebuilder:default=password
+	// +optional
+	Mode string `json:"mode,omitempty"`
+
+	// Header carrying the username in header mode. Defaults to REMOTE_USER.
+	// +optional
+	Header string `json:"header,omitempty"`
+}
+
+// GuacdSelector selects the guacd pods an instance opens its connections from.
+type GuacdSelector struct {
+	// Namespace guacd runs in.
+	Namespace string `json:"namespace"`
+
+	// PodLabels select the guacd pods in the namespace. Defaults to the operator's --guacd-pod-labels.
+	// +optional
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+}
+
+// GuacamoleInstanceSpec defines the desired state of GuacamoleInstance.
+type GuacamoleInstanceSpec struct {
+	// URL is the base URL of Guacamole (e.g., https://guacamole.example.com/guacamole).
+	// +kubebuilder:validation:Pattern=`^https?://`
+	URL string `json:"url"`
+
+	// CredentialsSecretRef points at a Secret whose "username" and "password" keys hold the
+	// credentials of a Guacamole user allowed to manage connections. An optional "link-secret-key"
+	// signs the connection links issued for the instance.
+	CredentialsSecretRef SecretReference `json:"credentialsSecretRef"`
+
+	// Auth selects how the operator logs in. Defaults to the username and password.
+	// +optional
+	Auth *GuacamoleInstanceAuth `json:"auth,omitempty"`
+
+	// DataSource is the Guacamole data source connections are written to (e.g., postgresql).
+	// When empty, the data source returned at login is used.
+	// +optional
+	DataSource string `json:"dataSource,omitempty"`
+
+	// TLS configures certificate verification and client certificates for https URLs.
+	// +optional
+	TLS *GuacamoleInstanceTLS `json:"tls,omitempty"`
+
+	// Default selects the instance for VMs whose namespace and VM carry no guacamole-instances annotation.
+	// +optional
+	Default bool `json:"default,omitempty"`
+
+	// Guacd selects the guacd pods of the instance, which the NetworkPolicy of each VM published to it lets
+	// reach the remote-desktop port. Defaults to the operator's --guacd-namespace and --guacd-pod-labels.
+	// +optional
+	Guacd *GuacdSelector `json:"guacd,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster,shortName=guacinst
+// +kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.spec.url`
+// +kubebuilder:printcolumn:name="Data Source",type=string,JSONPath=`.spec.dataSource`
+// +kubebuilder:printcolumn:name="Default",type=boolean,JSONPath=`.spec.default`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// GuacamoleInstance is the Schema for the guacamoleinstances API.
+// It describes a Guacamole deployment the operator can publish VM connections to.
+type GuacamoleInstance struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec GuacamoleInstanceSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// GuacamoleInstanceList contains a list of GuacamoleInstance.
+type GuacamoleInstanceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GuacamoleInstance `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GuacamoleInstance{}, &GuacamoleInstanceList{})
+}
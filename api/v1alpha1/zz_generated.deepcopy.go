@@ -21,9 +21,304 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacamoleConnection) DeepCopyInto(out *GuacamoleConnection) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacamoleConnection.
+func (in *GuacamoleConnection) DeepCopy() *GuacamoleConnection {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacamoleConnection)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *GuacamoleConnection) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacamoleConnectionList) DeepCopyInto(out *GuacamoleConnectionList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]GuacamoleConnection, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacamoleConnectionList.
+func (in *GuacamoleConnectionList) DeepCopy() *GuacamoleConnectionList {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacamoleConnectionList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *GuacamoleConnectionList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacamoleConnectionSpec) DeepCopyInto(out *GuacamoleConnectionSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacamoleConnectionSpec.
+func (in *GuacamoleConnectionSpec) DeepCopy() *GuacamoleConnectionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacamoleConnectionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacamoleConnectionStatus) DeepCopyInto(out *GuacamoleConnectionStatus) {
+	*out = *in
+	if in.Instances != nil {
+		in, out := &in.Instances, &out.Instances
+		*out = make([]GuacamoleInstanceConnection, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacamoleConnectionStatus.
+func (in *GuacamoleConnectionStatus) DeepCopy() *GuacamoleConnectionStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacamoleConnectionStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacamoleInstance) DeepCopyInto(out *GuacamoleInstance) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacamoleInstance.
+func (in *GuacamoleInstance) DeepCopy() *GuacamoleInstance {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacamoleInstance)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *GuacamoleInstance) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacamoleInstanceAuth) DeepCopyInto(out *GuacamoleInstanceAuth) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacamoleInstanceAuth.
+func (in *GuacamoleInstanceAuth) DeepCopy() *GuacamoleInstanceAuth {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacamoleInstanceAuth)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacamoleInstanceConnection) DeepCopyInto(out *GuacamoleInstanceConnection) {
+	*out = *in
+	if in.SharingProfiles != nil {
+		in, out := &in.SharingProfiles, &out.SharingProfiles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ObserverGroups != nil {
+		in, out := &in.ObserverGroups, &out.ObserverGroups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacamoleInstanceConnection.
+func (in *GuacamoleInstanceConnection) DeepCopy() *GuacamoleInstanceConnection {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacamoleInstanceConnection)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacamoleInstanceList) DeepCopyInto(out *GuacamoleInstanceList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]GuacamoleInstance, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacamoleInstanceList.
+func (in *GuacamoleInstanceList) DeepCopy() *GuacamoleInstanceList {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacamoleInstanceList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *GuacamoleInstanceList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacamoleInstanceSpec) DeepCopyInto(out *GuacamoleInstanceSpec) {
+	*out = *in
+	out.CredentialsSecretRef = in.CredentialsSecretRef
+	if in.Auth != nil {
+		in, out := &in.Auth, &out.Auth
+		*out = new(GuacamoleInstanceAuth)
+		**out = **in
+	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(GuacamoleInstanceTLS)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Guacd != nil {
+		in, out := &in.Guacd, &out.Guacd
+		*out = new(GuacdSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacamoleInstanceSpec.
+func (in *GuacamoleInstanceSpec) DeepCopy() *GuacamoleInstanceSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacamoleInstanceSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacamoleInstanceTLS) DeepCopyInto(out *GuacamoleInstanceTLS) {
+	*out = *in
+	if in.CASecretRef != nil {
+		in, out := &in.CASecretRef, &out.CASecretRef
+		*out = new(SecretReference)
+		**out = **in
+	}
+	if in.ClientCertSecretRef != nil {
+		in, out := &in.ClientCertSecretRef, &out.ClientCertSecretRef
+		*out = new(SecretReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacamoleInstanceTLS.
+func (in *GuacamoleInstanceTLS) DeepCopy() *GuacamoleInstanceTLS {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacamoleInstanceTLS)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuacdSelector) DeepCopyInto(out *GuacdSelector) {
+	*out = *in
+	if in.PodLabels != nil {
+		in, out := &in.PodLabels, &out.PodLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuacdSelector.
+func (in *GuacdSelector) DeepCopy() *GuacdSelector {
+	if in == nil {
+		return nil
+	}
+	out := new(GuacdSelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretReference) DeepCopyInto(out *SecretReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretReference.
+func (in *SecretReference) DeepCopy() *SecretReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachine) DeepCopyInto(out *VirtualMachine) {
 	*out = *in
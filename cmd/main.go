@@ -14,12 +14,20 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	// Import k8s.io packages
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -27,15 +35,20 @@ import (
 
 	// Import controller-runtime packages
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	// Import KubeVirt API
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
-	// Import your controller
+	// Import the operator API and controller
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
 	"setofangdar.polito.it/vm-watcher/internal/controller"
 	//+kubebuilder:scaffold:imports
 )
@@ -51,27 +64,260 @@ func init() {
 	// Add KubeVirt scheme
 	utilruntime.Must(kubevirtv1.AddToScheme(scheme))
 
+	// Add the operator's own API
+	utilruntime.Must(kubevirtv1alpha1.AddToScheme(scheme))
+
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
 	var metricsAddr string
+	var secureMetrics bool
+	var metricsCertPath, metricsCertName, metricsCertKey string
 	var enableLeaderElection bool
 	var probeAddr string
 	var guacamoleBaseURL string
 	var guacamoleUsername string
 	var guacamolePassword string
+	var guacamoleCredentialsSecret string
+	var guacamoleCredentialsDir string
+	var guacamoleCredentialsReloadInterval time.Duration
+	var allowPlaintextPassword bool
+	var guacamoleAuthMode string
+	var guacamoleAuthHeader string
+	var guacamoleDataSource string
+	var guacamoleCAFile string
+	var guacamoleCASecret string
+	var guacamoleClientCertFile string
+	var guacamoleClientKeyFile string
+	var guacamoleClientCertSecret string
+	var guacamoleInsecureSkipVerify bool
+	var guacamoleTLSReloadInterval time.Duration
 	var httpTimeout time.Duration
+	var sharingProfiles string
+	var observerGroups string
+	var recordingEnabled bool
+	var recordingPath string
+	var recordingNameTemplate string
+	var recordingRoot string
+	var recordingSweepInterval time.Duration
+	var recordingIndexBindAddress, recordingIndexCertFile, recordingIndexKeyFile string
+	var recordingMaxAge time.Duration
+	var recordingMaxCount int
+	var recordingMaxSize string
+	var recordingExportEndpoint string
+	var recordingExportBucket string
+	var recordingExportRegion string
+	var recordingExportPrefix string
+	var sessionPollInterval time.Duration
+	var shortSessionThreshold time.Duration
+	var sessionUserLabel bool
+	var idleTimeout time.Duration
+	var idleCheckInterval time.Duration
+	var gatewayBindAddress string
+	var gatewayStartTimeout time.Duration
+	var gatewayCertFile, gatewayKeyFile string
+	var linkBindAddress string
+	var linkLifetime time.Duration
+	var linkCertFile, linkKeyFile string
+	var allowPlaintextServing bool
+	var guestProbe string
+	var guestProbeTimeout time.Duration
+	var network string
+	var ipFamily string
+	var allowedCIDRs string
+	var vmService string
+	var networkPolicy bool
+	var guacdNamespace string
+	var guacdPodLabels string
+	var operatorPodLabels string
+	var configMap string
+	var circuitBreakerThreshold int
+	var circuitBreakerOpenDuration time.Duration
+	var circuitBreakerRampDuration time.Duration
+	var guacamoleReadiness string
+	var healthCheckInterval time.Duration
+	var deletionPolicy string
+	var deletionTimeout time.Duration
+	var tombstoneConfigMap string
+	var tombstoneCollectInterval time.Duration
+	var guacamoleQPS float64
+	var guacamoleBurst int
+	var connectionBatchWindow time.Duration
+	var connectionBatchSize int
+	var connectionIndexRefreshInterval time.Duration
+	var maxConcurrentReconciles int
+	var syncPeriod time.Duration
+	var watchNamespaces string
 
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
+	flag.BoolVar(&secureMetrics, "metrics-secure", true,
+		"Serve the metrics endpoint over HTTPS, to clients authenticated and authorized by Kubernetes. "+
+			"Use --metrics-secure=false to serve plain HTTP instead.")
+	flag.StringVar(&metricsCertPath, "metrics-cert-path", "",
+		"Directory with the metrics server certificate. A self-signed certificate is generated when empty.")
+	flag.StringVar(&metricsCertName, "metrics-cert-name", "tls.crt", "Name of the metrics server certificate file")
+	flag.StringVar(&metricsCertKey, "metrics-cert-key", "tls.key", "Name of the metrics server key file")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
-	flag.StringVar(&guacamoleBaseURL, "guacamole-url", "", "Base URL of Apache Guacamole (e.g., https://guacamole.example.com)")
+	flag.StringVar(&guacamoleBaseURL, "guacamole-url", "",
+		"Base URL of the default Apache Guacamole instance (e.g., https://guacamole.example.com). "+
+			"Further instances are configured with GuacamoleInstance resources.")
 	flag.StringVar(&guacamoleUsername, "guacamole-username", "", "Guacamole admin username")
-	flag.StringVar(&guacamolePassword, "guacamole-password", "", "Guacamole admin password")
+	flag.StringVar(&guacamolePassword, "guacamole-password", "",
+		"Guacamole admin password. Visible in the process list, so it requires --allow-plaintext-password; "+
+			"prefer --guacamole-credentials-secret or --guacamole-credentials-dir.")
+	flag.BoolVar(&allowPlaintextPassword, "allow-plaintext-password", false,
+		"Accept --guacamole-password. Only meant for development.")
+	flag.StringVar(&guacamoleAuthMode, "guacamole-auth-mode", controller.AuthModePassword,
+		"How the operator logs in to the default Guacamole instance: password, json (encrypted JSON auth with the "+
+			"json-secret-key of the credentials Secret) or header (username in an HTTP header)")
+	flag.StringVar(&guacamoleAuthHeader, "guacamole-auth-header", controller.DefaultAuthHeader,
+		"HTTP header carrying the username in header auth mode")
+	flag.StringVar(&guacamoleCredentialsSecret, "guacamole-credentials-secret", "",
+		"Secret (namespace/name, or name in the operator namespace) whose username and password keys hold the "+
+			"Guacamole admin credentials, reloaded when they rotate")
+	flag.StringVar(&guacamoleCredentialsDir, "guacamole-credentials-dir", "",
+		"Directory of a mounted Secret with username and password files, reloaded when they rotate. "+
+			"Used instead of --guacamole-credentials-secret.")
+	flag.DurationVar(&guacamoleCredentialsReloadInterval, "guacamole-credentials-reload-interval",
+		controller.DefaultCredentialsReloadInterval, "Interval between checks of the Guacamole credentials for a rotation")
+	flag.StringVar(&guacamoleDataSource, "guacamole-data-source", "",
+		"Guacamole data source connections are written to (e.g., postgresql). Empty uses the one returned at login.")
+	flag.StringVar(&guacamoleCAFile, "guacamole-ca-file", "",
+		"PEM CA bundle the default Guacamole instance's certificate is verified against, instead of the system roots")
+	flag.StringVar(&guacamoleCASecret, "guacamole-ca-secret", "",
+		"Secret (namespace/name, or name in the operator namespace) whose ca.crt key holds the CA bundle, instead of --guacamole-ca-file")
+	flag.StringVar(&guacamoleClientCertFile, "guacamole-client-cert-file", "", "PEM client certificate presented to the default Guacamole instance")
+	flag.StringVar(&guacamoleClientKeyFile, "guacamole-client-key-file", "", "PEM private key of --guacamole-client-cert-file")
+	flag.StringVar(&guacamoleClientCertSecret, "guacamole-client-cert-secret", "",
+		"kubernetes.io/tls Secret (namespace/name, or name in the operator namespace) with the client certificate, "+
+			"instead of --guacamole-client-cert-file")
+	flag.BoolVar(&guacamoleInsecureSkipVerify, "guacamole-insecure-skip-verify", false,
+		"Do not verify the default Guacamole instance's certificate. Only meant for development.")
+	flag.DurationVar(&guacamoleTLSReloadInterval, "guacamole-tls-reload-interval", controller.DefaultTLSReloadInterval,
+		"Interval between checks of the Guacamole CA and client certificate files and Secrets for changes")
 	flag.DurationVar(&httpTimeout, "http-timeout", 30*time.Second, "HTTP client timeout for Guacamole API calls")
+	flag.StringVar(&sharingProfiles, "sharing-profiles", "",
+		"Comma separated sharing profile variants to create for each connection (read-only, full-control). "+
+			"Can be overridden per VM with the sharing-profiles annotation.")
+	flag.StringVar(&observerGroups, "observer-groups", "",
+		"Comma separated Guacamole user groups granted the sharing profiles. "+
+			"Can be overridden per VM with the observer-groups annotation.")
+	flag.BoolVar(&recordingEnabled, "recording-enabled", false,
+		"Record sessions by default. Can be overridden per namespace or VM with the recording annotation.")
+	flag.StringVar(&recordingPath, "recording-path", controller.DefaultRecordingPath,
+		"Directory inside guacd where session recordings are written, one subdirectory per namespace")
+	flag.StringVar(&recordingNameTemplate, "recording-name-template", controller.DefaultRecordingNameTemplate,
+		"Recording file name template. {namespace}, {vm} and {user} are substituted, ${GUAC_*} tokens are expanded by Guacamole.")
+	flag.StringVar(&recordingRoot, "recording-root", "",
+		"Directory where the recordings volume is mounted in the operator. Enables recording retention and export when set.")
+	flag.DurationVar(&recordingSweepInterval, "recording-sweep-interval", controller.DefaultRecordingSweepInterval,
+		"Interval between recording retention sweeps")
+	flag.StringVar(&recordingIndexBindAddress, "recording-index-bind-address", "",
+		"The address the recording index binds to (e.g., :8084). Empty disables the index.")
+	flag.StringVar(&recordingIndexCertFile, "recording-index-cert-file", "", "PEM certificate the recording index is served with")
+	flag.StringVar(&recordingIndexKeyFile, "recording-index-key-file", "", "PEM key of the recording index certificate")
+	flag.DurationVar(&recordingMaxAge, "recording-max-age", 0, "Delete recordings older than this (0 keeps them forever)")
+	flag.IntVar(&recordingMaxCount, "recording-max-count", 0, "Maximum number of recordings kept per namespace (0 is unlimited)")
+	flag.StringVar(&recordingMaxSize, "recording-max-size", "", "Maximum total recording size per namespace, e.g. 20Gi (empty is unlimited)")
+	flag.StringVar(&recordingExportEndpoint, "recording-export-endpoint", "",
+		"S3-compatible endpoint recordings are exported to (e.g., http://minio.minio.svc:9000). "+
+			"Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+	flag.StringVar(&recordingExportBucket, "recording-export-bucket", "guacamole-recordings", "Bucket recordings are exported to")
+	flag.StringVar(&recordingExportRegion, "recording-export-region", "us-east-1", "Region of the recording export bucket")
+	flag.StringVar(&recordingExportPrefix, "recording-export-prefix", "", "Key prefix for exported recordings")
+	flag.DurationVar(&sessionPollInterval, "session-poll-interval", controller.DefaultSessionPollInterval,
+		"Interval between polls of Guacamole session data for metrics (0 disables session metrics)")
+	flag.DurationVar(&shortSessionThreshold, "short-session-threshold", controller.DefaultShortSessionThreshold,
+		"Sessions ending within this duration of starting are counted as short sessions")
+	flag.BoolVar(&sessionUserLabel, "session-metrics-user-label", false,
+		"Export the active sessions per Guacamole user (one series per user and VM)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0,
+		"Stop running VMs without an active Guacamole session for this long (0 disables the default, "+
+			"VMs can still opt in with the idle-timeout annotation)")
+	flag.DurationVar(&idleCheckInterval, "idle-check-interval", controller.DefaultIdleCheckInterval,
+		"Interval between checks for idle VMs")
+	flag.StringVar(&gatewayBindAddress, "gateway-bind-address", "",
+		"The address the start-on-connect gateway binds to (e.g., :8082). Empty disables the gateway.")
+	flag.DurationVar(&gatewayStartTimeout, "gateway-start-timeout", controller.DefaultGatewayStartTimeout,
+		"How long the start-on-connect gateway waits for a stopped VM to become reachable")
+	flag.StringVar(&gatewayCertFile, "gateway-cert-file", "", "PEM certificate the start-on-connect gateway is served with")
+	flag.StringVar(&gatewayKeyFile, "gateway-key-file", "", "PEM key of the start-on-connect gateway certificate")
+	flag.StringVar(&linkBindAddress, "link-bind-address", "",
+		"The address the connection link server binds to (e.g., :8083). Empty disables the link server.")
+	flag.DurationVar(&linkLifetime, "link-lifetime", controller.DefaultLinkLifetime,
+		"How long a connection link can be used to log in to Guacamole")
+	flag.StringVar(&linkCertFile, "link-cert-file", "", "PEM certificate the connection link server is served with")
+	flag.StringVar(&linkKeyFile, "link-key-file", "", "PEM key of the connection link server certificate")
+	flag.BoolVar(&allowPlaintextServing, "allow-plaintext-serving", false,
+		"Serve plain HTTP from the servers without a certificate. Only meant for development.")
+	flag.StringVar(&guestProbe, "guest-probe", controller.GuestProbeNone,
+		"How the guest remote-desktop port is checked before a connection is published (tcp, handshake or none). "+
+			"Probes are sent from the operator pod, which must reach guests on the connection address like guacd does. "+
+			"Can be overridden per VM with the guest-probe annotation.")
+	flag.DurationVar(&guestProbeTimeout, "guest-probe-timeout", controller.DefaultGuestProbeTimeout,
+		"Timeout of a single guest probe")
+	flag.StringVar(&network, "network", "",
+		"Name of the VM network connections point at (empty uses any network). "+
+			"Can be overridden per VM with the network annotation.")
+	flag.StringVar(&ipFamily, "ip-family", "",
+		"Preferred IP family of connection addresses (ipv4 or ipv6, empty uses the first address). "+
+			"Can be overridden per VM with the ip-family annotation.")
+	flag.StringVar(&allowedCIDRs, "allowed-cidrs", "",
+		"Comma separated CIDRs connection addresses must belong to (empty allows any). "+
+			"Can be overridden per VM with the allowed-cidrs annotation.")
+	flag.StringVar(&vmService, "vm-service", controller.ServiceModeNone,
+		"Service created for each VM's remote-desktop port and used as connection hostname (none, clusterip or headless). "+
+			"Can be overridden per VM with the service annotation.")
+	flag.BoolVar(&networkPolicy, "network-policy", false,
+		"Create a NetworkPolicy per VM allowing only guacd to reach its remote-desktop port. "+
+			"Can be overridden per VM with the network-policy annotation.")
+	flag.StringVar(&guacdNamespace, "guacd-namespace", "guacamole", "Namespace of the guacd pods allowed by the VM NetworkPolicies")
+	flag.StringVar(&guacdPodLabels, "guacd-pod-labels", "app=guacd", "Comma separated key=value labels of the guacd pods allowed by the VM NetworkPolicies")
+	flag.StringVar(&operatorPodLabels, "operator-pod-labels", "control-plane=controller-manager",
+		"Comma separated key=value labels of the operator pods, allowed by the VM NetworkPolicies to probe guests")
+	flag.StringVar(&configMap, "config-map", controller.DefaultConfigMapName,
+		"ConfigMap (namespace/name, or name in the operator namespace) whose config.yaml overrides flags while the "+
+			"manager runs. Empty disables it.")
+	flag.IntVar(&circuitBreakerThreshold, "circuit-breaker-threshold", controller.DefaultCircuitBreakerThreshold,
+		"Consecutive failed requests to a Guacamole instance after which its requests are paused (0 disables the circuit breaker)")
+	flag.DurationVar(&circuitBreakerOpenDuration, "circuit-breaker-open-duration", controller.DefaultCircuitBreakerOpenDuration,
+		"How long requests to an unhealthy Guacamole instance are paused, doubled each time it fails again while recovering")
+	flag.DurationVar(&circuitBreakerRampDuration, "circuit-breaker-ramp-duration", controller.DefaultCircuitBreakerRampDuration,
+		"Time over which traffic to a recovering Guacamole instance is ramped back up")
+	flag.StringVar(&guacamoleReadiness, "guacamole-readiness", controller.ReadinessNone,
+		"How Guacamole health affects /readyz: always (unready while the default instances are unreachable), "+
+			"startup (unready until they were reachable once) or none (only the guacamole_up metric)")
+	flag.DurationVar(&healthCheckInterval, "guacamole-health-check-interval", controller.DefaultHealthCheckInterval,
+		"Minimum interval between two Guacamole health checks, /readyz reuses the last result in between")
+	flag.StringVar(&deletionPolicy, "deletion-policy", controller.DeletionPolicyBestEffort,
+		"What happens when a deleted VM's connection cannot be deleted from Guacamole: best-effort (leave it), "+
+			"block (keep the VM until it is deleted or --deletion-timeout passes) or tombstone (record it and delete it later)")
+	flag.DurationVar(&deletionTimeout, "deletion-timeout", controller.DefaultDeletionTimeout,
+		"Maximum time a deleted VM is kept while its Guacamole connection cannot be deleted or recorded")
+	flag.StringVar(&tombstoneConfigMap, "tombstone-config-map", controller.DefaultTombstoneConfigMapName,
+		"ConfigMap (namespace/name, or name in the operator namespace) recording the connections left to delete. Empty disables tombstones.")
+	flag.DurationVar(&tombstoneCollectInterval, "tombstone-collect-interval", controller.DefaultTombstoneCollectInterval,
+		"Interval between two attempts to delete the connections recorded as tombstones")
+	flag.Float64Var(&guacamoleQPS, "guacamole-qps", controller.DefaultGuacamoleQPS,
+		"Maximum sustained rate of requests to each Guacamole instance (0 disables the rate limit)")
+	flag.IntVar(&guacamoleBurst, "guacamole-burst", controller.DefaultGuacamoleBurst,
+		"Number of requests to each Guacamole instance allowed in a burst above --guacamole-qps")
+	flag.DurationVar(&connectionBatchWindow, "connection-batch-window", controller.DefaultConnectionBatchWindow,
+		"Time connection creations and deletions are held back to be sent to Guacamole as one JSON Patch request (0 disables batching)")
+	flag.IntVar(&connectionBatchSize, "connection-batch-size", controller.DefaultConnectionBatchSize,
+		"Number of connection writes after which a batch is sent without waiting for --connection-batch-window")
+	flag.DurationVar(&connectionIndexRefreshInterval, "connection-index-refresh-interval", controller.DefaultConnectionIndexRefreshInterval,
+		"Age after which the index of connection names of a Guacamole instance is rebuilt from a full list")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", controller.DefaultMaxConcurrentReconciles,
+		"Number of VMs reconciled in parallel")
+	flag.DurationVar(&syncPeriod, "sync-period", 10*time.Hour,
+		"Interval after which every cached object, and so every VM, is reconciled again even without a change")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma separated namespaces whose VMs the manager watches and caches; empty watches every namespace")
 
 	opts := zap.Options{
 		Development: true,
@@ -81,6 +327,48 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	// The password flag shows up in ps, the environment and credential sources do not
+	if guacamolePassword != "" && !allowPlaintextPassword {
+		setupLog.Error(nil, "--guacamole-password is visible in the process list. Use --guacamole-credentials-secret, "+
+			"--guacamole-credentials-dir or the GUACAMOLE_PASSWORD environment variable, or set --allow-plaintext-password for development")
+		os.Exit(1)
+	}
+	rotatingCredentials := guacamoleCredentialsSecret != "" || guacamoleCredentialsDir != ""
+
+	// Gateway requests carry Guacamole tokens, so they are only served in plain text on request
+	gatewayTLS := controller.ServingTLS{CertFile: gatewayCertFile, KeyFile: gatewayKeyFile, AllowPlaintext: allowPlaintextServing}
+	if gatewayBindAddress != "" {
+		if err := gatewayTLS.Validate(); err != nil {
+			setupLog.Error(err, "invalid start-on-connect gateway TLS, set --gateway-cert-file and --gateway-key-file "+
+				"or --allow-plaintext-serving for development")
+			os.Exit(1)
+		}
+	}
+
+	// Index requests carry Kubernetes tokens, so they are only served in plain text on request
+	recordingIndexTLS := controller.ServingTLS{
+		CertFile:       recordingIndexCertFile,
+		KeyFile:        recordingIndexKeyFile,
+		AllowPlaintext: allowPlaintextServing,
+	}
+	if recordingRoot != "" && recordingIndexBindAddress != "" {
+		if err := recordingIndexTLS.Validate(); err != nil {
+			setupLog.Error(err, "invalid recording index TLS, set --recording-index-cert-file and --recording-index-key-file "+
+				"or --allow-plaintext-serving for development")
+			os.Exit(1)
+		}
+	}
+
+	// Link requests carry Kubernetes tokens and return login URLs, so they are only served in plain text on request
+	linkTLS := controller.ServingTLS{CertFile: linkCertFile, KeyFile: linkKeyFile, AllowPlaintext: allowPlaintextServing}
+	if linkBindAddress != "" {
+		if err := linkTLS.Validate(); err != nil {
+			setupLog.Error(err, "invalid connection link server TLS, set --link-cert-file and --link-key-file "+
+				"or --allow-plaintext-serving for development")
+			os.Exit(1)
+		}
+	}
+
 	// Get Guacamole configuration from environment variables if not provided via flags
 	if guacamoleBaseURL == "" {
 		guacamoleBaseURL = os.Getenv("GUACAMOLE_BASE_URL")
@@ -91,26 +379,123 @@ func main() {
 	if guacamolePassword == "" {
 		guacamolePassword = os.Getenv("GUACAMOLE_PASSWORD")
 	}
+	if guacamoleDataSource == "" {
+		guacamoleDataSource = os.Getenv("GUACAMOLE_DATA_SOURCE")
+	}
 
-	// Validate required configuration
+	// Validate required configuration. Without a base URL there is no default instance and connections
+	// only go to GuacamoleInstances.
 	if guacamoleBaseURL == "" {
-		setupLog.Error(nil, "Guacamole base URL is required. Set via --guacamole-url flag or GUACAMOLE_BASE_URL environment variable")
+		setupLog.Info("No default Guacamole instance configured, only GuacamoleInstance resources are used. " +
+			"Set one via --guacamole-url flag or GUACAMOLE_BASE_URL environment variable")
+	} else if !rotatingCredentials {
+		if guacamoleAuthMode == controller.AuthModeJSON {
+			setupLog.Error(nil, "The json auth mode reads its secret key from --guacamole-credentials-secret or --guacamole-credentials-dir")
+			os.Exit(1)
+		}
+		if guacamoleUsername == "" {
+			setupLog.Error(nil, "Guacamole username is required. Set via --guacamole-username flag or GUACAMOLE_USERNAME environment variable")
+			os.Exit(1)
+		}
+		if guacamolePassword == "" && guacamoleAuthMode == controller.AuthModePassword {
+			setupLog.Error(nil, "Guacamole password is required. Set via --guacamole-password flag or GUACAMOLE_PASSWORD environment variable")
+			os.Exit(1)
+		}
+	}
+	switch guacamoleAuthMode {
+	case controller.AuthModePassword, controller.AuthModeJSON, controller.AuthModeHeader:
+	default:
+		setupLog.Error(nil, "--guacamole-auth-mode must be password, json or header", "auth_mode", guacamoleAuthMode)
 		os.Exit(1)
 	}
-	if guacamoleUsername == "" {
-		setupLog.Error(nil, "Guacamole username is required. Set via --guacamole-username flag or GUACAMOLE_USERNAME environment variable")
+	switch guacamoleReadiness {
+	case controller.ReadinessAlways, controller.ReadinessStartup, controller.ReadinessNone:
+	default:
+		setupLog.Error(nil, "--guacamole-readiness must be always, startup or none", "readiness", guacamoleReadiness)
 		os.Exit(1)
 	}
-	if guacamolePassword == "" {
-		setupLog.Error(nil, "Guacamole password is required. Set via --guacamole-password flag or GUACAMOLE_PASSWORD environment variable")
+	switch deletionPolicy {
+	case controller.DeletionPolicyBestEffort, controller.DeletionPolicyBlock, controller.DeletionPolicyTombstone:
+	default:
+		setupLog.Error(nil, "--deletion-policy must be best-effort, block or tombstone", "deletion_policy", deletionPolicy)
+		os.Exit(1)
+	}
+	if ipFamily != "" && ipFamily != controller.IPFamilyIPv4 && ipFamily != controller.IPFamilyIPv6 {
+		setupLog.Error(nil, "--ip-family must be ipv4 or ipv6", "ip_family", ipFamily)
+		os.Exit(1)
+	}
+	cidrs, err := controller.ParseCIDRs(allowedCIDRs)
+	if err != nil {
+		setupLog.Error(err, "invalid --allowed-cidrs")
+		os.Exit(1)
+	}
+	guacdLabels, err := labels.ConvertSelectorToLabelsMap(guacdPodLabels)
+	if err != nil {
+		setupLog.Error(err, "invalid --guacd-pod-labels")
+		os.Exit(1)
+	}
+	operatorLabels, err := labels.ConvertSelectorToLabelsMap(operatorPodLabels)
+	if err != nil {
+		setupLog.Error(err, "invalid --operator-pod-labels")
 		os.Exit(1)
 	}
 
+	// Only the operator ConfigMap is watched, not every ConfigMap in the cluster
+	configMapNamespace, configMapName := operatorNamespace(), configMap
+	if namespace, name, found := strings.Cut(configMap, "/"); found {
+		configMapNamespace, configMapName = namespace, name
+	}
+	if configMapName != "" && configMapNamespace == "" {
+		setupLog.Error(nil, "--config-map needs a namespace when running outside the cluster", "config_map", configMap)
+		os.Exit(1)
+	}
+	cacheOptions := cache.Options{}
+	if syncPeriod > 0 {
+		cacheOptions.SyncPeriod = &syncPeriod
+	}
+	if configMapName != "" {
+		cacheOptions.ByObject = map[client.Object]cache.ByObject{
+			&corev1.ConfigMap{}: {Namespaces: map[string]cache.Config{configMapNamespace: {}}},
+		}
+	}
+
+	// One operator per tenant only caches the tenant's namespaces. The Secrets of GuacamoleInstances are
+	// read from the API server, so they can live outside of them.
+	namespaces := controller.SplitList(watchNamespaces)
+	if len(namespaces) > 0 {
+		cacheOptions.DefaultNamespaces = make(map[string]cache.Config, len(namespaces))
+		for _, namespace := range namespaces {
+			cacheOptions.DefaultNamespaces[namespace] = cache.Config{}
+		}
+	}
+
+	// The metrics endpoint only answers clients whose token Kubernetes authenticates and allows to get /metrics
+	metricsServerOptions := metricsserver.Options{
+		BindAddress:   metricsAddr,
+		SecureServing: secureMetrics,
+	}
+	if secureMetrics {
+		metricsServerOptions.FilterProvider = filters.WithAuthenticationAndAuthorization
+	}
+	var metricsCertWatcher *certwatcher.CertWatcher
+	if metricsCertPath != "" {
+		metricsCertWatcher, err = certwatcher.New(
+			filepath.Join(metricsCertPath, metricsCertName),
+			filepath.Join(metricsCertPath, metricsCertKey),
+		)
+		if err != nil {
+			setupLog.Error(err, "unable to load metrics server certificate")
+			os.Exit(1)
+		}
+		metricsServerOptions.TLSOpts = append(metricsServerOptions.TLSOpts, func(config *tls.Config) {
+			config.GetCertificate = metricsCertWatcher.GetCertificate
+		})
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme: scheme,
-		Metrics: metricsserver.Options{
-			BindAddress: metricsAddr,
-		},
+		Scheme:  scheme,
+		Cache:   cacheOptions,
+		Metrics: metricsServerOptions,
 		WebhookServer: webhook.NewServer(webhook.Options{
 			Port: 9443,
 		}),
@@ -123,6 +508,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	if metricsCertWatcher != nil {
+		if err := mgr.Add(metricsCertWatcher); err != nil {
+			setupLog.Error(err, "unable to set up metrics certificate watcher")
+			os.Exit(1)
+		}
+	}
+
 	// Setup HTTP client with timeout
 	httpClient := &http.Client{
 		Timeout: httpTimeout,
@@ -133,19 +525,292 @@ func main() {
 		},
 	}
 
-	if err = (&controller.VirtualMachineReconciler{
-		Client:            mgr.GetClient(),
-		Scheme:            mgr.GetScheme(),
-		GuacamoleBaseURL:  guacamoleBaseURL,
-		GuacamoleUsername: guacamoleUsername,
-		GuacamolePassword: guacamolePassword,
-		HTTPClient:        httpClient,
-	}).SetupWithManager(mgr); err != nil {
+	// Admin credentials of the default instance, reloaded while the manager runs
+	var credentials *controller.GuacamoleCredentials
+	if rotatingCredentials {
+		credentialsSecret, err := controller.ParseSecretReference(guacamoleCredentialsSecret, operatorNamespace())
+		if err != nil {
+			setupLog.Error(err, "invalid --guacamole-credentials-secret")
+			os.Exit(1)
+		}
+		credentials = &controller.GuacamoleCredentials{
+			Reader:   mgr.GetAPIReader(),
+			Secret:   credentialsSecret,
+			Dir:      guacamoleCredentialsDir,
+			AuthMode: guacamoleAuthMode,
+			Interval: guacamoleCredentialsReloadInterval,
+		}
+		loadCtx, cancelLoad := context.WithTimeout(context.Background(), httpTimeout)
+		err = credentials.Load(loadCtx)
+		cancelLoad()
+		if err != nil {
+			setupLog.Error(err, "unable to load Guacamole credentials")
+			os.Exit(1)
+		}
+		if err := mgr.Add(credentials); err != nil {
+			setupLog.Error(err, "unable to set up Guacamole credentials reloader")
+			os.Exit(1)
+		}
+		guacamoleUsername, _ = credentials.Get()
+	}
+
+	// Custom CA, client certificate or disabled verification for the default instance. The certificates are
+	// reloaded while the manager runs.
+	if guacamoleCAFile != "" || guacamoleCASecret != "" || guacamoleClientCertFile != "" ||
+		guacamoleClientCertSecret != "" || guacamoleInsecureSkipVerify {
+		if (guacamoleClientCertFile == "") != (guacamoleClientKeyFile == "") {
+			setupLog.Error(nil, "--guacamole-client-cert-file and --guacamole-client-key-file must be set together")
+			os.Exit(1)
+		}
+		caSecret, err := controller.ParseSecretReference(guacamoleCASecret, operatorNamespace())
+		if err != nil {
+			setupLog.Error(err, "invalid --guacamole-ca-secret")
+			os.Exit(1)
+		}
+		clientCertSecret, err := controller.ParseSecretReference(guacamoleClientCertSecret, operatorNamespace())
+		if err != nil {
+			setupLog.Error(err, "invalid --guacamole-client-cert-secret")
+			os.Exit(1)
+		}
+		if guacamoleInsecureSkipVerify {
+			setupLog.Info("Certificate verification of the default Guacamole instance is disabled")
+		}
+
+		tlsTransport := &controller.GuacamoleTLSTransport{
+			Reader:             mgr.GetAPIReader(),
+			CAFile:             guacamoleCAFile,
+			CASecret:           caSecret,
+			ClientCertFile:     guacamoleClientCertFile,
+			ClientKeyFile:      guacamoleClientKeyFile,
+			ClientCertSecret:   clientCertSecret,
+			InsecureSkipVerify: guacamoleInsecureSkipVerify,
+			Interval:           guacamoleTLSReloadInterval,
+		}
+		loadCtx, cancelLoad := context.WithTimeout(context.Background(), httpTimeout)
+		err = tlsTransport.Load(loadCtx)
+		cancelLoad()
+		if err != nil {
+			setupLog.Error(err, "unable to load Guacamole TLS certificates")
+			os.Exit(1)
+		}
+		if err := mgr.Add(tlsTransport); err != nil {
+			setupLog.Error(err, "unable to set up Guacamole TLS reloader")
+			os.Exit(1)
+		}
+		httpClient.Transport = tlsTransport
+	}
+
+	// Everything the operator writes is attributed to its own field manager
+	operatorClient := client.WithFieldOwner(mgr.GetClient(), controller.FieldManager)
+
+	reconciler := &controller.VirtualMachineReconciler{
+		Client:              operatorClient,
+		APIReader:           mgr.GetAPIReader(),
+		Scheme:              mgr.GetScheme(),
+		GuacamoleBaseURL:    guacamoleBaseURL,
+		GuacamoleUsername:   guacamoleUsername,
+		GuacamolePassword:   guacamolePassword,
+		Credentials:         credentials,
+		GuacamoleAuthMode:   guacamoleAuthMode,
+		GuacamoleAuthHeader: guacamoleAuthHeader,
+		GuacamoleDataSource: guacamoleDataSource,
+		HTTPClient:          httpClient,
+		SharingProfiles:     controller.SplitList(sharingProfiles),
+		ObserverGroups:      controller.SplitList(observerGroups),
+
+		RecordingEnabled:      recordingEnabled,
+		RecordingPath:         recordingPath,
+		RecordingNameTemplate: recordingNameTemplate,
+
+		GuestProbeMode:    guestProbe,
+		GuestProbeTimeout: guestProbeTimeout,
+		Recorder:          mgr.GetEventRecorderFor("vm-watcher"),
+
+		Network:      network,
+		IPFamily:     ipFamily,
+		AllowedCIDRs: cidrs,
+		ServiceMode:  vmService,
+
+		NetworkPolicyEnabled: networkPolicy,
+		GuacdNamespace:       guacdNamespace,
+		GuacdPodLabels:       guacdLabels,
+		OperatorNamespace:    operatorNamespace(),
+		OperatorPodLabels:    operatorLabels,
+
+		CircuitBreakerThreshold:    circuitBreakerThreshold,
+		CircuitBreakerOpenDuration: circuitBreakerOpenDuration,
+		CircuitBreakerRampDuration: circuitBreakerRampDuration,
+
+		DeletionPolicy:  deletionPolicy,
+		DeletionTimeout: deletionTimeout,
+
+		GuacamoleQPS:                   guacamoleQPS,
+		GuacamoleBurst:                 guacamoleBurst,
+		ConnectionBatchWindow:          connectionBatchWindow,
+		ConnectionBatchSize:            connectionBatchSize,
+		ConnectionIndexRefreshInterval: connectionIndexRefreshInterval,
+
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		WatchNamespaces:         namespaces,
+	}
+
+	// Connections that could not be deleted with their VM, deleted once their instance is reachable again
+	tombstoneNamespace, tombstoneName := operatorNamespace(), tombstoneConfigMap
+	if namespace, name, found := strings.Cut(tombstoneConfigMap, "/"); found {
+		tombstoneNamespace, tombstoneName = namespace, name
+	}
+	switch {
+	case tombstoneName == "":
+	case tombstoneNamespace == "":
+		setupLog.Info("Tombstones disabled, --tombstone-config-map needs a namespace when running outside the cluster")
+	default:
+		reconciler.Tombstones = &controller.TombstoneStore{
+			Client:    operatorClient,
+			Reader:    mgr.GetAPIReader(),
+			Namespace: tombstoneNamespace,
+			Name:      tombstoneName,
+		}
+		if err := mgr.Add(&controller.TombstoneCollector{
+			Reconciler: reconciler,
+			Interval:   tombstoneCollectInterval,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up tombstone collector")
+			os.Exit(1)
+		}
+	}
+
+	// Settings from the operator ConfigMap, applied again whenever it changes
+	if configMapName != "" {
+		configReconciler := &controller.OperatorConfigReconciler{
+			Client:     operatorClient,
+			Reconciler: reconciler,
+			Namespace:  configMapNamespace,
+			Name:       configMapName,
+		}
+		loadCtx, cancelLoad := context.WithTimeout(context.Background(), httpTimeout)
+		err = configReconciler.Load(loadCtx, mgr.GetAPIReader())
+		cancelLoad()
+		if err != nil {
+			setupLog.Error(err, "unable to load operator configuration")
+			os.Exit(1)
+		}
+		if err = configReconciler.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "OperatorConfig")
+			os.Exit(1)
+		}
+	}
+
+	// A data source that is missing or cannot hold connections is a configuration mistake, while an
+	// unreachable Guacamole may come up later and is only reported
+	validateCtx, cancelValidate := context.WithTimeout(context.Background(), httpTimeout)
+	err = reconciler.ValidateDataSource(validateCtx)
+	cancelValidate()
+	switch {
+	case errors.Is(err, controller.ErrDataSourceUnavailable), errors.Is(err, controller.ErrConnectionManagementUnsupported):
+		setupLog.Error(err, "invalid Guacamole data source, set it with --guacamole-data-source or GUACAMOLE_DATA_SOURCE")
+		os.Exit(1)
+	case err != nil:
+		setupLog.Error(err, "unable to validate the Guacamole data source, continuing")
+	}
+
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "VirtualMachine")
 		os.Exit(1)
 	}
 	//+kubebuilder:scaffold:builder
 
+	if sessionPollInterval > 0 {
+		if err := mgr.Add(&controller.SessionMetricsCollector{
+			Reconciler:            reconciler,
+			Interval:              sessionPollInterval,
+			ShortSessionThreshold: shortSessionThreshold,
+			UserLabel:             sessionUserLabel,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up session metrics collector")
+			os.Exit(1)
+		}
+	}
+
+	if err := mgr.Add(&controller.IdleVMStopper{
+		Reconciler:  reconciler,
+		Interval:    idleCheckInterval,
+		IdleTimeout: idleTimeout,
+	}); err != nil {
+		setupLog.Error(err, "unable to set up idle VM stopper")
+		os.Exit(1)
+	}
+
+	if gatewayBindAddress != "" {
+		vmSubresources, err := controller.NewVMSubresourceClient(mgr.GetConfig(), mgr.GetHTTPClient())
+		if err != nil {
+			setupLog.Error(err, "unable to create KubeVirt subresource client")
+			os.Exit(1)
+		}
+		if err := mgr.Add(&controller.StartGateway{
+			Reconciler:     reconciler,
+			VMSubresources: vmSubresources,
+			BindAddress:    gatewayBindAddress,
+			TLS:            gatewayTLS,
+			StartTimeout:   gatewayStartTimeout,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up start-on-connect gateway")
+			os.Exit(1)
+		}
+	}
+
+	if linkBindAddress != "" {
+		if err := mgr.Add(&controller.LinkServer{
+			Reconciler:  reconciler,
+			BindAddress: linkBindAddress,
+			TLS:         linkTLS,
+			Lifetime:    linkLifetime,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up connection link server")
+			os.Exit(1)
+		}
+	}
+
+	if recordingRoot != "" {
+		retention := controller.RecordingRetention{
+			MaxAge:   recordingMaxAge,
+			MaxCount: recordingMaxCount,
+		}
+		if recordingMaxSize != "" {
+			maxSize, err := resource.ParseQuantity(recordingMaxSize)
+			if err != nil {
+				setupLog.Error(err, "invalid --recording-max-size")
+				os.Exit(1)
+			}
+			retention.MaxBytes = maxSize.Value()
+		}
+
+		janitor := &controller.RecordingJanitor{
+			Client:    operatorClient,
+			RootDir:   recordingRoot,
+			Interval:  recordingSweepInterval,
+			Retention: retention,
+			// Every replica serves the index, only the leader exports and deletes recordings
+			Elected:     mgr.Elected(),
+			BindAddress: recordingIndexBindAddress,
+			TLS:         recordingIndexTLS,
+		}
+		if recordingExportEndpoint != "" {
+			janitor.Exporter = &controller.S3Exporter{
+				Endpoint:        recordingExportEndpoint,
+				Region:          recordingExportRegion,
+				Bucket:          recordingExportBucket,
+				Prefix:          recordingExportPrefix,
+				AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			}
+		}
+
+		if err := mgr.Add(janitor); err != nil {
+			setupLog.Error(err, "unable to set up recording janitor")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -154,12 +819,34 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	healthCheck := &controller.GuacamoleHealthCheck{
+		Reconciler: reconciler,
+		Interval:   healthCheckInterval,
+		Mode:       guacamoleReadiness,
+	}
+	if err := mgr.AddReadyzCheck("guacamole", healthCheck.Check); err != nil {
+		setupLog.Error(err, "unable to set up Guacamole ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager",
 		"guacamole-url", guacamoleBaseURL,
-		"guacamole-username", guacamoleUsername)
+		"guacamole-username", guacamoleUsername,
+		"guacamole-data-source", guacamoleDataSource)
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
+
+// operatorNamespace returns the namespace the operator runs in, or "" when it runs outside the cluster
+func operatorNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	namespace, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(namespace))
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Default number of consecutive failed requests that open the circuit of an instance
+	DefaultCircuitBreakerThreshold = 5
+	// Default time requests to an instance are paused once its circuit opens
+	DefaultCircuitBreakerOpenDuration = 30 * time.Second
+	// Default time over which traffic to a recovering instance is ramped back up
+	DefaultCircuitBreakerRampDuration = time.Minute
+	// Share of requests admitted at the start of the ramp
+	circuitMinAdmission = 0.1
+	// The pause doubles every time the instance fails again while recovering, up to this many times the open duration
+	circuitMaxOpenFactor = 10
+)
+
+// ErrCircuitOpen is returned instead of sending a request to an instance whose circuit is open
+var ErrCircuitOpen = errors.New("requests to the Guacamole instance are paused after repeated failures")
+
+type circuitState int
+
+const (
+	circuitClosed     circuitState = iota // Requests flow normally
+	circuitOpen                           // Requests are rejected until the pause ends
+	circuitRecovering                     // A growing share of requests is admitted
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitRecovering:
+		return "recovering"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker pauses the requests to one Guacamole instance while it is unhealthy. Once the pause ends
+// traffic resumes gradually: the share of admitted requests grows from 10% to all of them over the ramp
+// duration, and a failure in that time pauses the instance again, for twice as long.
+type circuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+	rampDuration time.Duration
+
+	mu        sync.Mutex
+	state     circuitState
+	failures  int           // Consecutive failures while closed
+	openFor   time.Duration // Length of the current pause
+	changedAt time.Time     // When the circuit last changed state
+}
+
+// breaker returns the circuit breaker of the instance, or nil when circuit breaking is disabled
+func (r *VirtualMachineReconciler) breaker(instance string) *circuitBreaker {
+	if r.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+
+	r.breakersMu.Lock()
+	defer r.breakersMu.Unlock()
+	if r.breakers == nil {
+		r.breakers = make(map[string]*circuitBreaker)
+	}
+	breaker, exists := r.breakers[instance]
+	if !exists {
+		breaker = &circuitBreaker{
+			threshold:    r.CircuitBreakerThreshold,
+			openDuration: r.CircuitBreakerOpenDuration,
+			rampDuration: r.CircuitBreakerRampDuration,
+		}
+		if breaker.openDuration <= 0 {
+			breaker.openDuration = DefaultCircuitBreakerOpenDuration
+		}
+		if breaker.rampDuration <= 0 {
+			breaker.rampDuration = DefaultCircuitBreakerRampDuration
+		}
+		r.breakers[instance] = breaker
+	}
+	return breaker
+}
+
+// allow reports whether a request may be sent to the instance now
+func (b *circuitBreaker) allow(ctx context.Context, instance string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.changedAt) < b.openFor {
+			return false
+		}
+		// The pause is over, the first request probes the instance
+		b.transition(ctx, instance, circuitRecovering, now)
+		return true
+	case circuitRecovering:
+		elapsed := now.Sub(b.changedAt)
+		if elapsed >= b.rampDuration {
+			b.failures = 0
+			b.transition(ctx, instance, circuitClosed, now)
+			return true
+		}
+		admitted := circuitMinAdmission + (1-circuitMinAdmission)*float64(elapsed)/float64(b.rampDuration)
+		return rand.Float64() < admitted
+	default:
+		return true
+	}
+}
+
+// record updates the circuit with the outcome of a request
+func (b *circuitBreaker) record(ctx context.Context, instance string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case !failed:
+		if b.state == circuitClosed {
+			b.failures = 0
+		}
+	case b.state == circuitRecovering:
+		b.openFor = min(2*b.openFor, circuitMaxOpenFactor*b.openDuration)
+		b.transition(ctx, instance, circuitOpen, now)
+	case b.state == circuitClosed:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openFor = b.openDuration
+			b.transition(ctx, instance, circuitOpen, now)
+		}
+	}
+}
+
+// transition moves the circuit to a new state, must be called with the lock held
+func (b *circuitBreaker) transition(ctx context.Context, instance string, state circuitState, now time.Time) {
+	log.FromContext(ctx).Info("Guacamole circuit breaker changed state", "instance", instance,
+		"from", b.state.String(), "to", state.String(), "pause", b.openFor)
+	b.state = state
+	b.changedAt = now
+	circuitBreakerState.WithLabelValues(instance).Set(float64(state))
+}
+
+// requestFailed reports whether the outcome of a request counts against the health of the instance:
+// no response at all, or a server error. A cancelled request says nothing about the instance.
+func requestFailed(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	const openDuration = time.Minute
+	const rampDuration = time.Minute
+
+	// step is one request outcome, or the passing of time when elapse is set
+	type step struct {
+		failed bool
+		elapse time.Duration // Moves the last state change back by this much before allow is called
+	}
+	tests := []struct {
+		name        string
+		steps       []step
+		wantState   circuitState
+		wantOpenFor time.Duration
+		wantAllowed bool
+	}{
+		{
+			name:        "failures below the threshold keep it closed",
+			steps:       []step{{failed: true}, {failed: true}},
+			wantState:   circuitClosed,
+			wantAllowed: true,
+		},
+		{
+			name:        "a success resets the failure count",
+			steps:       []step{{failed: true}, {failed: true}, {}, {failed: true}, {failed: true}},
+			wantState:   circuitClosed,
+			wantAllowed: true,
+		},
+		{
+			name:        "threshold failures open it",
+			steps:       []step{{failed: true}, {failed: true}, {failed: true}},
+			wantState:   circuitOpen,
+			wantOpenFor: openDuration,
+			wantAllowed: false,
+		},
+		{
+			name:        "the pause ending starts the recovery",
+			steps:       []step{{failed: true}, {failed: true}, {failed: true}, {elapse: openDuration}},
+			wantState:   circuitRecovering,
+			wantOpenFor: openDuration,
+			wantAllowed: true,
+		},
+		{
+			name: "a failure while recovering doubles the pause",
+			steps: []step{{failed: true}, {failed: true}, {failed: true}, {elapse: openDuration},
+				{failed: true}},
+			wantState:   circuitOpen,
+			wantOpenFor: 2 * openDuration,
+			wantAllowed: false,
+		},
+		{
+			name: "the pause is bounded",
+			steps: []step{{failed: true}, {failed: true}, {failed: true},
+				{elapse: openDuration}, {failed: true}, {elapse: 2 * openDuration}, {failed: true},
+				{elapse: 4 * openDuration}, {failed: true}, {elapse: 8 * openDuration}, {failed: true},
+				{elapse: 10 * openDuration}, {failed: true}},
+			wantState:   circuitOpen,
+			wantOpenFor: circuitMaxOpenFactor * openDuration,
+			wantAllowed: false,
+		},
+		{
+			name: "the end of the ramp closes it",
+			steps: []step{{failed: true}, {failed: true}, {failed: true}, {elapse: openDuration},
+				{elapse: rampDuration}},
+			wantState:   circuitClosed,
+			wantOpenFor: openDuration,
+			wantAllowed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			breaker := &circuitBreaker{threshold: 3, openDuration: openDuration, rampDuration: rampDuration}
+			for _, s := range tt.steps {
+				if s.elapse > 0 {
+					breaker.changedAt = breaker.changedAt.Add(-s.elapse)
+					breaker.allow(ctx, "test")
+					continue
+				}
+				breaker.record(ctx, "test", s.failed)
+			}
+			if breaker.state != tt.wantState {
+				t.Errorf("state = %v, want %v", breaker.state, tt.wantState)
+			}
+			if breaker.openFor != tt.wantOpenFor {
+				t.Errorf("pause = %v, want %v", breaker.openFor, tt.wantOpenFor)
+			}
+			// While recovering admission is random, so only check the other states
+			if tt.wantState != circuitRecovering {
+				if allowed := breaker.allow(ctx, "test"); allowed != tt.wantAllowed {
+					t.Errorf("allow() = %v, want %v", allowed, tt.wantAllowed)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerRampAdmission(t *testing.T) {
+	ctx := context.Background()
+	breaker := &circuitBreaker{
+		threshold:    1,
+		openDuration: time.Minute,
+		rampDuration: time.Minute,
+		state:        circuitRecovering,
+		openFor:      time.Minute,
+		changedAt:    time.Now(),
+	}
+
+	// At the start of the ramp about circuitMinAdmission of the requests are admitted
+	admitted := 0
+	const requests = 10000
+	for range requests {
+		if breaker.allow(ctx, "test") {
+			admitted++
+		}
+	}
+	if share := float64(admitted) / requests; share < circuitMinAdmission/2 || share > circuitMinAdmission*2 {
+		t.Errorf("admitted %.2f of the requests at the start of the ramp, want about %.2f", share, circuitMinAdmission)
+	}
+}
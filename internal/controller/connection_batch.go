@@ -0,0 +1,184 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Default time connection writes are held back to be sent together with others
+	DefaultConnectionBatchWindow = 50 * time.Millisecond
+	// Default number of connection writes after which a batch is sent without waiting for the window to end
+	DefaultConnectionBatchSize = 50
+)
+
+// errBatchNotApplied means that a connection write was not applied as part of a batch and must be sent on its own
+var errBatchNotApplied = errors.New("connection write not applied in a batch")
+
+// connectionPatchResponse is Guacamole's answer to a JSON Patch, one outcome per operation
+type connectionPatchResponse struct {
+	Patches []struct {
+		Op         string `json:"op"`
+		Path       string `json:"path"`
+		Identifier string `json:"identifier"`
+	} `json:"patches"`
+}
+
+// queuedPatch is a connection write waiting in a batch: "add" at "/" creates the connection in the value,
+// "remove" at "/<identifier>" deletes a connection
+type queuedPatch struct {
+	patch  jsonPatchOperation
+	result chan patchResult
+}
+
+type patchResult struct {
+	identifier string // Identifier of the created connection, empty if Guacamole did not report it
+	err        error
+}
+
+// connectionBatcher collects the connection writes to one instance and sends those queued within the batch
+// window as a single JSON Patch request. The first write of a batch waits for the window to end and sends
+// it, the others wait for its outcome.
+type connectionBatcher struct {
+	mu          sync.Mutex
+	queue       []*queuedPatch
+	full        chan struct{} // Signalled when the queue reaches the batch size
+	unsupported bool          // The instance does not accept JSON Patch on connections
+}
+
+// batcher returns the connection batcher of the instance
+func (r *VirtualMachineReconciler) batcher(instance string) *connectionBatcher {
+	r.batchersMu.Lock()
+	defer r.batchersMu.Unlock()
+	if r.batchers == nil {
+		r.batchers = make(map[string]*connectionBatcher)
+	}
+	batcher, exists := r.batchers[instance]
+	if !exists {
+		batcher = &connectionBatcher{}
+		r.batchers[instance] = batcher
+	}
+	return batcher
+}
+
+// patchConnection applies a connection write as part of a batch and returns the identifier of a created
+// connection. It returns errBatchNotApplied when batching is disabled, the instance does not support it, or
+// the batch was rejected, so that the caller sends the write on its own and gets its own error.
+func (r *VirtualMachineReconciler) patchConnection(ctx context.Context, authResp *GuacamoleAuthResponse, patch jsonPatchOperation) (string, error) {
+	if r.ConnectionBatchWindow <= 0 {
+		return "", errBatchNotApplied
+	}
+	batcher := r.batcher(authResp.target.Name)
+	queued := &queuedPatch{patch: patch, result: make(chan patchResult, 1)}
+
+	batcher.mu.Lock()
+	if batcher.unsupported {
+		batcher.mu.Unlock()
+		return "", errBatchNotApplied
+	}
+	first := len(batcher.queue) == 0
+	if first {
+		batcher.full = make(chan struct{}, 1)
+	}
+	batcher.queue = append(batcher.queue, queued)
+	if len(batcher.queue) == r.batchSize() {
+		batcher.full <- struct{}{}
+	}
+	full := batcher.full
+	batcher.mu.Unlock()
+
+	if first {
+		timer := time.NewTimer(r.ConnectionBatchWindow)
+		select {
+		case <-timer.C:
+		case <-full:
+			timer.Stop()
+		}
+
+		batcher.mu.Lock()
+		batch := batcher.queue
+		batcher.queue = nil
+		batcher.mu.Unlock()
+
+		// The batch carries the writes of other reconciles, send it even if this one is cancelled
+		r.sendConnectionBatch(context.WithoutCancel(ctx), authResp, batcher, batch)
+	}
+
+	select {
+	case result := <-queued.result:
+		return result.identifier, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (r *VirtualMachineReconciler) batchSize() int {
+	if r.ConnectionBatchSize > 0 {
+		return r.ConnectionBatchSize
+	}
+	return DefaultConnectionBatchSize
+}
+
+// sendConnectionBatch sends the batch as one JSON Patch request and hands every write its outcome
+func (r *VirtualMachineReconciler) sendConnectionBatch(ctx context.Context, authResp *GuacamoleAuthResponse, batcher *connectionBatcher, batch []*queuedPatch) {
+	logger := log.FromContext(ctx)
+	instance := authResp.target.Name
+	patchBatchSize.WithLabelValues(instance).Observe(float64(len(batch)))
+
+	patches := make([]jsonPatchOperation, 0, len(batch))
+	for _, queued := range batch {
+		patches = append(patches, queued.patch)
+	}
+
+	var response connectionPatchResponse
+	err := r.doGuacamoleRequest(ctx, authResp, http.MethodPatch, "connections", patches, &response)
+	var apiErr *guacamoleAPIError
+	switch {
+	case err == nil:
+		if len(response.Patches) != len(batch) {
+			// Without one outcome per write the created identifiers are unknown, look them up by name
+			r.connectionIndex(instance).invalidate()
+		}
+		for i, queued := range batch {
+			result := patchResult{}
+			if len(response.Patches) == len(batch) && queued.patch.Op == "add" {
+				result.identifier = response.Patches[i].Identifier
+			}
+			queued.result <- result
+		}
+		return
+	case errors.As(err, &apiErr) && (apiErr.statusCode == http.StatusMethodNotAllowed || apiErr.statusCode == http.StatusNotImplemented):
+		logger.Info("Guacamole instance does not accept batched connection writes, sending them one by one", "instance", instance)
+		batcher.mu.Lock()
+		batcher.unsupported = true
+		batcher.mu.Unlock()
+		err = errBatchNotApplied
+	case errors.As(err, &apiErr) && apiErr.statusCode < http.StatusInternalServerError:
+		// Guacamole applies a patch as a whole, so one invalid write rejects the others; retry them one by one
+		logger.Info("Batched connection writes rejected, sending them one by one", "instance", instance,
+			"writes", len(batch), "reason", strings.TrimSpace(apiErr.body))
+		err = errBatchNotApplied
+	}
+	for _, queued := range batch {
+		queued.result <- patchResult{err: err}
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// batchServer answers connection JSON Patch requests with the given status, reporting one identifier per
+// operation unless short is set, and counts the requests and operations it received
+type batchServer struct {
+	status int
+	short  bool
+
+	requests   atomic.Int32
+	operations atomic.Int32
+}
+
+func (s *batchServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.requests.Add(1)
+	var patches []struct {
+		Op    string               `json:"op"`
+		Path  string               `json:"path"`
+		Value *GuacamoleConnection `json:"value"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&patches); err != nil || req.Method != http.MethodPatch {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	s.operations.Add(int32(len(patches)))
+	if s.status != http.StatusOK {
+		http.Error(w, "rejected", s.status)
+		return
+	}
+
+	var response connectionPatchResponse
+	for i, patch := range patches {
+		if s.short && i == len(patches)-1 {
+			break
+		}
+		response.Patches = append(response.Patches, struct {
+			Op         string `json:"op"`
+			Path       string `json:"path"`
+			Identifier string `json:"identifier"`
+		}{Op: patch.Op, Path: patch.Path, Identifier: fmt.Sprintf("id-%s", patch.Value.Name)})
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// batchTestReconciler returns a reconciler batching connection writes to the server, and a token for it
+func batchTestReconciler(server *httptest.Server, window time.Duration, size int) (*VirtualMachineReconciler, *GuacamoleAuthResponse) {
+	r := &VirtualMachineReconciler{ConnectionBatchWindow: window, ConnectionBatchSize: size}
+	authResp := &GuacamoleAuthResponse{
+		AuthToken:  "token",
+		DataSource: "postgresql",
+		target:     &GuacamoleTarget{Name: "test", BaseURL: server.URL, HTTPClient: server.Client()},
+	}
+	return r, authResp
+}
+
+// patchConcurrently sends one create per name at the same time and returns the outcomes in name order
+func patchConcurrently(r *VirtualMachineReconciler, authResp *GuacamoleAuthResponse, names []string) ([]string, []error) {
+	identifiers := make([]string, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			identifiers[i], errs[i] = r.patchConnection(ctx, authResp, jsonPatchOperation{
+				Op: "add", Path: "/", Value: &GuacamoleConnection{Name: name},
+			})
+		}()
+	}
+	wg.Wait()
+	return identifiers, errs
+}
+
+func TestPatchConnectionBatches(t *testing.T) {
+	tests := []struct {
+		name            string
+		status          int
+		short           bool
+		window          time.Duration
+		size            int
+		writes          int
+		wantRequests    int32
+		wantErr         error
+		wantIdentifiers bool
+		wantUnsupported bool
+	}{
+		{
+			name: "disabled", window: 0, writes: 1,
+			wantRequests: 0, wantErr: errBatchNotApplied,
+		},
+		{
+			name: "single write sent when the window ends", status: http.StatusOK, window: 10 * time.Millisecond, size: 50, writes: 1,
+			wantRequests: 1, wantIdentifiers: true,
+		},
+		{
+			name: "full batch sent at once", status: http.StatusOK, window: time.Hour, size: 5, writes: 5,
+			wantRequests: 1, wantIdentifiers: true,
+		},
+		{
+			name: "missing outcomes leave identifiers to a lookup", status: http.StatusOK, short: true, window: time.Hour, size: 3, writes: 3,
+			wantRequests: 1,
+		},
+		{
+			name: "unsupported instance", status: http.StatusMethodNotAllowed, window: time.Hour, size: 2, writes: 2,
+			wantRequests: 1, wantErr: errBatchNotApplied, wantUnsupported: true,
+		},
+		{
+			name: "rejected batch retried one by one", status: http.StatusBadRequest, window: time.Hour, size: 2, writes: 2,
+			wantRequests: 1, wantErr: errBatchNotApplied,
+		},
+		{
+			name: "server error returned to every write", status: http.StatusInternalServerError, window: time.Hour, size: 2, writes: 2,
+			wantRequests: 1, wantErr: &guacamoleAPIError{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &batchServer{status: tt.status, short: tt.short}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			r, authResp := batchTestReconciler(server, tt.window, tt.size)
+
+			var names []string
+			for i := range tt.writes {
+				names = append(names, fmt.Sprintf("vm%d", i))
+			}
+			identifiers, errs := patchConcurrently(r, authResp, names)
+
+			if got := handler.requests.Load(); got != tt.wantRequests {
+				t.Errorf("sent %d requests, want %d", got, tt.wantRequests)
+			}
+			if tt.wantRequests > 0 {
+				if got := handler.operations.Load(); got != int32(tt.writes) {
+					t.Errorf("sent %d operations, want %d", got, tt.writes)
+				}
+			}
+			for i, err := range errs {
+				switch want := tt.wantErr.(type) {
+				case nil:
+					if err != nil {
+						t.Errorf("write %d failed: %v", i, err)
+					}
+				case *guacamoleAPIError:
+					var apiErr *guacamoleAPIError
+					if !errors.As(err, &apiErr) || apiErr.statusCode != tt.status {
+						t.Errorf("write %d returned %v, want an API error with status %d", i, err, tt.status)
+					}
+				default:
+					if !errors.Is(err, want) {
+						t.Errorf("write %d returned %v, want %v", i, err, want)
+					}
+				}
+			}
+			for i, identifier := range identifiers {
+				want := ""
+				if tt.wantIdentifiers {
+					want = "id-" + names[i]
+				}
+				if identifier != want {
+					t.Errorf("write %d got identifier %q, want %q", i, identifier, want)
+				}
+			}
+			if r.batchers != nil {
+				if unsupported := r.batcher("test").unsupported; unsupported != tt.wantUnsupported {
+					t.Errorf("batcher unsupported = %v, want %v", unsupported, tt.wantUnsupported)
+				}
+			}
+		})
+	}
+}
+
+func TestPatchConnectionUnsupportedSkipsBatching(t *testing.T) {
+	handler := &batchServer{status: http.StatusMethodNotAllowed}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	r, authResp := batchTestReconciler(server, time.Millisecond, 50)
+
+	for range 3 {
+		if _, errs := patchConcurrently(r, authResp, []string{"vm"}); !errors.Is(errs[0], errBatchNotApplied) {
+			t.Fatalf("write returned %v, want %v", errs[0], errBatchNotApplied)
+		}
+	}
+	if got := handler.requests.Load(); got != 1 {
+		t.Errorf("sent %d requests, want only the one that found batching unsupported", got)
+	}
+}
+
+func TestPatchConnectionInvalidatesIndexOnMissingOutcomes(t *testing.T) {
+	handler := &batchServer{status: http.StatusOK, short: true}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	r, authResp := batchTestReconciler(server, time.Hour, 2)
+
+	index := r.connectionIndex("test")
+	index.replace(map[string]GuacamoleConnectionResponse{})
+	patchConcurrently(r, authResp, []string{"vm0", "vm1"})
+
+	if _, fresh := index.lookup("vm0", time.Hour); fresh {
+		t.Error("index still fresh after a batch without one outcome per write")
+	}
+	if len(index.byName) != 0 {
+		t.Errorf("index gained entries %v from a batch without outcomes", index.byName)
+	}
+}
+
+// unbatchedServer rejects batched connection writes, creates connections one by one with identifier 42 and
+// answers deletions with the given status
+type unbatchedServer struct {
+	deleteStatus int
+	requests     []string
+}
+
+func (s *unbatchedServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path+"?"+req.URL.RawQuery)
+	switch req.Method {
+	case http.MethodPatch:
+		http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+	case http.MethodPost:
+		var connection GuacamoleConnection
+		_ = json.NewDecoder(req.Body).Decode(&connection)
+		_ = json.NewEncoder(w).Encode(GuacamoleConnectionResponse{Identifier: "42", Name: connection.Name, Protocol: connection.Protocol})
+	case http.MethodDelete:
+		if s.deleteStatus != http.StatusNoContent {
+			http.Error(w, "rejected", s.deleteStatus)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestUnbatchedConnectionWrites(t *testing.T) {
+	tests := []struct {
+		name         string
+		deleteStatus int
+		wantErr      bool
+		wantToken    bool
+	}{
+		{name: "deleted", deleteStatus: http.StatusNoContent, wantToken: true},
+		{name: "already deleted", deleteStatus: http.StatusNotFound, wantToken: true},
+		{name: "token expired", deleteStatus: http.StatusForbidden, wantErr: true},
+		{name: "server error", deleteStatus: http.StatusInternalServerError, wantErr: true, wantToken: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &unbatchedServer{deleteStatus: tt.deleteStatus}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			r, authResp := batchTestReconciler(server, time.Millisecond, 50)
+			r.tokens = map[string]cachedToken{"test": {authResp: *authResp, expires: time.Now().Add(time.Hour)}}
+			index := r.connectionIndex("test")
+			index.replace(map[string]GuacamoleConnectionResponse{})
+
+			connectionID, err := r.createGuacamoleConnection(context.Background(), authResp, testVM(nil),
+				&GuacamoleConnection{Name: "default-vm", Protocol: "ssh"})
+			if err != nil || connectionID != "42" {
+				t.Fatalf("createGuacamoleConnection() = %q, %v, want 42", connectionID, err)
+			}
+			if identifiers, _ := index.lookup("default-vm", time.Hour); !slices.Equal(identifiers, []string{"42"}) {
+				t.Errorf("index has %v after creation, want [42]", identifiers)
+			}
+
+			err = r.deleteGuacamoleConnection(context.Background(), authResp, "42")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deleteGuacamoleConnection() error = %v, want error %v", err, tt.wantErr)
+			}
+			identifiers, _ := index.lookup("default-vm", time.Hour)
+			if removed := len(identifiers) == 0; removed == tt.wantErr {
+				t.Errorf("index has %v after deletion error %v", identifiers, err)
+			}
+			if _, cached := r.tokens["test"]; cached != tt.wantToken {
+				t.Errorf("token cached = %v, want %v", cached, tt.wantToken)
+			}
+
+			// The deletion is not batched again once the instance refused a batch
+			want := []string{
+				"PATCH /api/session/data/postgresql/connections?token=token",
+				"POST /api/session/data/postgresql/connections?token=token",
+				"DELETE /api/session/data/postgresql/connections/42?token=token",
+			}
+			if !slices.Equal(handler.requests, want) {
+				t.Errorf("requests = %v, want %v", handler.requests, want)
+			}
+		})
+	}
+}
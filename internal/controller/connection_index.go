@@ -0,0 +1,141 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Default age after which the connection index of an instance is rebuilt from a full list
+const DefaultConnectionIndexRefreshInterval = time.Minute
+
+// connectionIndex maps the connection names of one instance to their identifiers, so that looking up a VM's
+// connection does not list every connection. It is rebuilt from a full list once older than the refresh
+// interval, and kept up to date in between with the connections the operator creates and deletes itself.
+type connectionIndex struct {
+	refreshMu sync.Mutex // Held while the index is rebuilt, so that concurrent lookups share one list
+
+	mu        sync.Mutex
+	refreshed time.Time
+	byName    map[string][]string // Identifiers by connection name
+}
+
+// connectionIndex returns the index of the instance
+func (r *VirtualMachineReconciler) connectionIndex(instance string) *connectionIndex {
+	r.connectionIndexesMu.Lock()
+	defer r.connectionIndexesMu.Unlock()
+	if r.connectionIndexes == nil {
+		r.connectionIndexes = make(map[string]*connectionIndex)
+	}
+	index, exists := r.connectionIndexes[instance]
+	if !exists {
+		index = &connectionIndex{}
+		r.connectionIndexes[instance] = index
+	}
+	return index
+}
+
+// lookupGuacamoleConnections returns the identifiers of the connections with the given name, refreshing the
+// index of the instance first if it is stale
+func (r *VirtualMachineReconciler) lookupGuacamoleConnections(ctx context.Context, authResp *GuacamoleAuthResponse, connectionName string) ([]string, error) {
+	index := r.connectionIndex(authResp.target.Name)
+	if identifiers, fresh := index.lookup(connectionName, r.indexRefreshInterval()); fresh {
+		return identifiers, nil
+	}
+
+	index.refreshMu.Lock()
+	defer index.refreshMu.Unlock()
+	// Another lookup may have refreshed the index while this one waited
+	if identifiers, fresh := index.lookup(connectionName, r.indexRefreshInterval()); fresh {
+		return identifiers, nil
+	}
+	// Listing the connections rebuilds the index
+	if _, err := r.listGuacamoleConnections(ctx, authResp); err != nil {
+		return nil, err
+	}
+	identifiers, _ := index.lookup(connectionName, r.indexRefreshInterval())
+	return identifiers, nil
+}
+
+func (r *VirtualMachineReconciler) indexRefreshInterval() time.Duration {
+	if r.ConnectionIndexRefreshInterval > 0 {
+		return r.ConnectionIndexRefreshInterval
+	}
+	return DefaultConnectionIndexRefreshInterval
+}
+
+// lookup returns the identifiers of the connection name and whether the index is fresh enough to trust
+func (i *connectionIndex) lookup(connectionName string, maxAge time.Duration) ([]string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.refreshed.IsZero() || time.Since(i.refreshed) >= maxAge {
+		return nil, false
+	}
+	return slices.Clone(i.byName[connectionName]), true
+}
+
+// replace rebuilds the index from a full list of the connections
+func (i *connectionIndex) replace(connections map[string]GuacamoleConnectionResponse) {
+	byName := make(map[string][]string, len(connections))
+	for identifier, connection := range connections {
+		byName[connection.Name] = append(byName[connection.Name], identifier)
+	}
+	for _, identifiers := range byName {
+		slices.Sort(identifiers)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.byName = byName
+	i.refreshed = time.Now()
+}
+
+// add records a connection the operator created
+func (i *connectionIndex) add(connectionName, identifier string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.byName == nil {
+		i.byName = make(map[string][]string)
+	}
+	if !slices.Contains(i.byName[connectionName], identifier) {
+		i.byName[connectionName] = append(i.byName[connectionName], identifier)
+	}
+}
+
+// remove forgets a connection the operator deleted
+func (i *connectionIndex) remove(identifier string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for name, identifiers := range i.byName {
+		if idx := slices.Index(identifiers, identifier); idx >= 0 {
+			identifiers = slices.Delete(identifiers, idx, idx+1)
+			if len(identifiers) == 0 {
+				delete(i.byName, name)
+			} else {
+				i.byName[name] = identifiers
+			}
+			return
+		}
+	}
+}
+
+// invalidate makes the next lookup rebuild the index, e.g. after a write failed because the index was stale
+func (i *connectionIndex) invalidate() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.refreshed = time.Time{}
+}
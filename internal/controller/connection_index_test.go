@@ -0,0 +1,134 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestConnectionIndex(t *testing.T) {
+	listed := map[string]GuacamoleConnectionResponse{
+		"3": {Name: "lab-a-vm1"},
+		"1": {Name: "lab-a-vm1"},
+		"2": {Name: "lab-b-vm2"},
+	}
+
+	tests := []struct {
+		name      string
+		update    func(i *connectionIndex)
+		maxAge    time.Duration
+		lookup    string
+		want      []string
+		wantFresh bool
+	}{
+		{
+			name:   "never built",
+			update: func(i *connectionIndex) {},
+			maxAge: time.Minute,
+			lookup: "lab-a-vm1",
+		},
+		{
+			name:      "duplicates sorted",
+			update:    func(i *connectionIndex) { i.replace(listed) },
+			maxAge:    time.Minute,
+			lookup:    "lab-a-vm1",
+			want:      []string{"1", "3"},
+			wantFresh: true,
+		},
+		{
+			name:      "unknown name",
+			update:    func(i *connectionIndex) { i.replace(listed) },
+			maxAge:    time.Minute,
+			lookup:    "lab-c-vm3",
+			wantFresh: true,
+		},
+		{
+			name: "stale",
+			update: func(i *connectionIndex) {
+				i.replace(listed)
+				i.refreshed = i.refreshed.Add(-2 * time.Minute)
+			},
+			maxAge: time.Minute,
+			lookup: "lab-a-vm1",
+		},
+		{
+			name: "added connection",
+			update: func(i *connectionIndex) {
+				i.replace(listed)
+				i.add("lab-c-vm3", "4")
+				i.add("lab-c-vm3", "4")
+			},
+			maxAge:    time.Minute,
+			lookup:    "lab-c-vm3",
+			want:      []string{"4"},
+			wantFresh: true,
+		},
+		{
+			name: "removed duplicate",
+			update: func(i *connectionIndex) {
+				i.replace(listed)
+				i.remove("1")
+			},
+			maxAge:    time.Minute,
+			lookup:    "lab-a-vm1",
+			want:      []string{"3"},
+			wantFresh: true,
+		},
+		{
+			name: "removed last connection",
+			update: func(i *connectionIndex) {
+				i.replace(listed)
+				i.remove("2")
+			},
+			maxAge:    time.Minute,
+			lookup:    "lab-b-vm2",
+			wantFresh: true,
+		},
+		{
+			name: "invalidated",
+			update: func(i *connectionIndex) {
+				i.replace(listed)
+				i.invalidate()
+			},
+			maxAge: time.Minute,
+			lookup: "lab-a-vm1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index := &connectionIndex{}
+			tt.update(index)
+			got, fresh := index.lookup(tt.lookup, tt.maxAge)
+			if fresh != tt.wantFresh {
+				t.Errorf("lookup(%q) fresh = %v, want %v", tt.lookup, fresh, tt.wantFresh)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("lookup(%q) = %v, want %v", tt.lookup, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectionIndexLookupIsCopy(t *testing.T) {
+	index := &connectionIndex{}
+	index.replace(map[string]GuacamoleConnectionResponse{"1": {Name: "lab-a-vm1"}})
+
+	got, _ := index.lookup("lab-a-vm1", time.Minute)
+	got[0] = "changed"
+	if again, _ := index.lookup("lab-a-vm1", time.Minute); again[0] != "1" {
+		t.Errorf("changing a lookup result changed the index to %v", again)
+	}
+}
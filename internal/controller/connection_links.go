@@ -0,0 +1,238 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// Default time a connection link can be opened
+	DefaultLinkLifetime = 5 * time.Minute
+	// Subresource of the VM a Kubernetes user must be allowed to get to receive a link
+	LinkSubresource = "guacamole-link"
+)
+
+// ConnectionLink is the response of the link server
+type ConnectionLink struct {
+	URL      string      `json:"url"`
+	Instance string      `json:"instance"`
+	Expires  metav1.Time `json:"expires"`
+}
+
+// LinkServer serves POST /links/<namespace>/<vm>. It returns a one-click Guacamole URL carrying an encrypted
+// JSON auth payload with the VM's connection, so that the caller can open the VM without a Guacamole user
+// or a stored connection. The payload can only be used to log in until it expires.
+//
+// The caller authenticates with a Kubernetes bearer token, checked with a TokenReview, and must be allowed
+// to get the guacamole-link subresource of the VM, checked with a SubjectAccessReview. Both the token and
+// the returned URL grant access, so links are served over TLS.
+type LinkServer struct {
+	Reconciler  *VirtualMachineReconciler // Provides the Guacamole and Kubernetes clients
+	BindAddress string
+	TLS         ServingTLS
+	Lifetime    time.Duration
+}
+
+// Start serves the links until the context is cancelled
+func (s *LinkServer) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("link-server")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/links/", func(w http.ResponseWriter, req *http.Request) {
+		s.handleLink(log.IntoContext(req.Context(), logger), w, req)
+	})
+
+	server := &http.Server{
+		Addr:              s.BindAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	logger.Info("Starting connection link server", "address", s.BindAddress, "tls", s.TLS.CertFile != "")
+	return serveHTTP(log.IntoContext(ctx, logger), server, s.TLS)
+}
+
+// NeedLeaderElection lets every replica serve links
+func (s *LinkServer) NeedLeaderElection() bool {
+	return false
+}
+
+// handleLink authorizes the caller and returns a link to the requested VM
+func (s *LinkServer) handleLink(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(ctx)
+	r := s.Reconciler
+
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "links are created with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/links/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "expected /links/<namespace>/<vm>", http.StatusNotFound)
+		return
+	}
+	vmKey := client.ObjectKey{Namespace: parts[0], Name: parts[1]}
+
+	bearer, found := bearerToken(req)
+	if !found {
+		http.Error(w, "missing Kubernetes bearer token", http.StatusUnauthorized)
+		return
+	}
+	user, err := reviewToken(ctx, r.Client, bearer)
+	if err != nil {
+		logger.Info("Rejected link request", "vm", vmKey, "reason", err.Error())
+		http.Error(w, "invalid Kubernetes bearer token", http.StatusUnauthorized)
+		return
+	}
+	if err := reviewAccess(ctx, r.Client, user, authorizationv1.ResourceAttributes{
+		Namespace:   vmKey.Namespace,
+		Verb:        "get",
+		Group:       kubevirtv1.GroupVersion.Group,
+		Resource:    "virtualmachines",
+		Subresource: LinkSubresource,
+		Name:        vmKey.Name,
+	}); err != nil {
+		if errors.Is(err, errNotAllowed) {
+			http.Error(w, fmt.Sprintf("%s may not get %s of this VM", user.Username, LinkSubresource), http.StatusForbidden)
+			return
+		}
+		logger.Error(err, "Failed to authorize link request", "vm", vmKey, "user", user.Username)
+		http.Error(w, "failed to authorize request", http.StatusInternalServerError)
+		return
+	}
+
+	var vm kubevirtv1.VirtualMachine
+	if err := r.Get(ctx, vmKey, &vm); err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			http.Error(w, "VM not found", http.StatusNotFound)
+			return
+		}
+		logger.Error(err, "Failed to get VM", "vm", vmKey)
+		http.Error(w, "failed to get VM", http.StatusInternalServerError)
+		return
+	}
+	if !r.settings().selects(&vm) {
+		http.Error(w, "VM is not managed by the operator", http.StatusNotFound)
+		return
+	}
+	if vm.Status.PrintableStatus != kubevirtv1.VirtualMachineStatusRunning {
+		http.Error(w, "VM is not running", http.StatusConflict)
+		return
+	}
+
+	target, err := s.linkTarget(ctx, &vm, req.URL.Query().Get("instance"))
+	if err != nil {
+		logger.Error(err, "Failed to resolve Guacamole instances", "vm", vmKey)
+		http.Error(w, "Guacamole unavailable", http.StatusBadGateway)
+		return
+	}
+	if target == nil {
+		http.Error(w, "no Guacamole instance of this VM has a link secret key", http.StatusNotFound)
+		return
+	}
+
+	connection, err := r.buildGuacamoleConnection(ctx, &vm)
+	if err != nil {
+		logger.Error(err, "Failed to build Guacamole connection", "vm", vmKey)
+		http.Error(w, "failed to build connection", http.StatusInternalServerError)
+		return
+	}
+
+	username, err := linkUsername(target, user.Username)
+	if err != nil {
+		logger.Info("Rejected link request", "vm", vmKey, "user", user.Username, "reason", err.Error())
+		http.Error(w, "this user cannot be issued links", http.StatusForbidden)
+		return
+	}
+
+	expires := time.Now().Add(s.lifetime())
+	payload, err := encryptJSONAuth(target.LinkSecretKey, &jsonAuthPayload{
+		Username: username,
+		Expires:  expires.UnixMilli(),
+		Connections: map[string]jsonAuthConnection{
+			connection.Name: {Protocol: connection.Protocol, Parameters: connection.Parameters},
+		},
+	})
+	if err != nil {
+		logger.Error(err, "Failed to encrypt connection link", "vm", vmKey)
+		http.Error(w, "failed to create link", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Issued connection link", "vm", vm.Name, "namespace", vm.Namespace, "user", user.Username,
+		"instance", target.Name, "expires", expires)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(ConnectionLink{
+		URL:      fmt.Sprintf("%s/?data=%s", strings.TrimSuffix(target.BaseURL, "/"), url.QueryEscape(payload)),
+		Instance: target.Name,
+		Expires:  metav1.NewTime(expires),
+	}); err != nil {
+		logger.Error(err, "Failed to write connection link", "vm", vmKey)
+	}
+}
+
+// linkUsername returns the Guacamole username of the link session of a Kubernetes user. It is kept under
+// LinkUsernamePrefix so that it never matches a database account, whose permissions the session would get,
+// and in particular never the operator's own account.
+func linkUsername(target *GuacamoleTarget, kubernetesUsername string) (string, error) {
+	if kubernetesUsername == "" {
+		return "", errors.New("empty username")
+	}
+	username := LinkUsernamePrefix + kubernetesUsername
+	if username == target.Username {
+		return "", fmt.Errorf("username %s is the operator's Guacamole account", username)
+	}
+	return username, nil
+}
+
+// linkTarget returns the VM's instance the link is signed for: the named one, or else the first with a link
+// secret key. It returns nil if there is none.
+func (s *LinkServer) linkTarget(ctx context.Context, vm *kubevirtv1.VirtualMachine, instance string) (*GuacamoleTarget, error) {
+	targets, err := s.Reconciler.guacamoleTargetsFor(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		if len(target.LinkSecretKey) == 0 || (instance != "" && target.Name != instance) {
+			continue
+		}
+		return target, nil
+	}
+	return nil, nil
+}
+
+func (s *LinkServer) lifetime() time.Duration {
+	if s.Lifetime > 0 {
+		return s.Lifetime
+	}
+	return DefaultLinkLifetime
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+const (
+	// The VM is not running yet, so no connection is published
+	ReasonWaitingForRunning = "WaitingForRunning"
+	// The guest does not answer on its remote-desktop port yet
+	ReasonGuestNotListening = "GuestNotListening"
+	// The connection is published and the guest answers
+	ReasonConnectionReady = "ConnectionReady"
+	// The VM was stopped after its connection had been published
+	ReasonVMNotRunning = "VMNotRunning"
+	// Publishing the connection failed MaxRetryAttempts times in a row
+	ReasonRetriesExhausted = "RetriesExhausted"
+	// Publishing the connection succeeded again after failures
+	ReasonRecovered = "Recovered"
+)
+
+// vmSettingAnnotations are the per-VM annotations that change the connection or how it is published. Changing
+// one re-publishes the connection of a running VM.
+var vmSettingAnnotations = []string{
+	"vm-watcher.setofangdar.polito.it/protocol",
+	"vm-watcher.setofangdar.polito.it/port",
+	"vm-watcher.setofangdar.polito.it/username",
+	"vm-watcher.setofangdar.polito.it/password",
+	"vm-watcher.setofangdar.polito.it/domain",
+	NetworkAnnotation,
+	InterfaceAnnotation,
+	IPFamilyAnnotation,
+	AllowedCIDRsAnnotation,
+	ServiceModeAnnotation,
+	NetworkPolicyAnnotation,
+	RecordingAnnotation,
+	GuestProbeAnnotation,
+}
+
+// connectionHash returns a hash of the connection and the per-VM settings it is published with
+func connectionHash(vm *kubevirtv1.VirtualMachine, config *GuacamoleConnection) string {
+	hash := sha256.New()
+	// Maps are marshalled with sorted keys, so the same connection always hashes the same
+	data, _ := json.Marshal(config)
+	hash.Write(data)
+	for _, annotation := range vmSettingAnnotations {
+		value, exists := vm.Annotations[annotation]
+		fmt.Fprintf(hash, "\n%s %t %q", annotation, exists, value)
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// connectionOutdated reports whether the connection the VM would get now differs from the published one. A
+// connection that cannot be built is reported as outdated, so that syncing it reports the error.
+func (r *VirtualMachineReconciler) connectionOutdated(ctx context.Context, vm *kubevirtv1.VirtualMachine, connection *kubevirtv1alpha1.GuacamoleConnection) bool {
+	config, err := r.buildGuacamoleConnection(ctx, vm)
+	if err != nil {
+		return true
+	}
+	return connection.Status.ConnectionHash != connectionHash(vm, config)
+}
+
+// ensureConnectionStatus returns the GuacamoleConnection status object of the VM, creating it if needed.
+// The object is owned by the VM so it is garbage collected with it.
+func (r *VirtualMachineReconciler) ensureConnectionStatus(ctx context.Context, vm *kubevirtv1.VirtualMachine) (*kubevirtv1alpha1.GuacamoleConnection, error) {
+	var connection kubevirtv1alpha1.GuacamoleConnection
+	err := r.Get(ctx, client.ObjectKeyFromObject(vm), &connection)
+	if err == nil {
+		return &connection, nil
+	}
+	if client.IgnoreNotFound(err) != nil {
+		return nil, fmt.Errorf("failed to get GuacamoleConnection: %w", err)
+	}
+
+	connection = kubevirtv1alpha1.GuacamoleConnection{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      vm.Name,
+			Namespace: vm.Namespace,
+		},
+		Spec: kubevirtv1alpha1.GuacamoleConnectionSpec{
+			VirtualMachineName: vm.Name,
+		},
+	}
+	if err := controllerutil.SetControllerReference(vm, &connection, r.Scheme); err != nil {
+		return nil, fmt.Errorf("failed to set owner reference: %w", err)
+	}
+	if err := r.Create(ctx, &connection); err != nil {
+		return nil, fmt.Errorf("failed to create GuacamoleConnection: %w", err)
+	}
+	return &connection, nil
+}
+
+// setReadyCondition updates the Ready condition of the status object and reports whether it changed
+func (r *VirtualMachineReconciler) setReadyCondition(ctx context.Context, connection *kubevirtv1alpha1.GuacamoleConnection, status metav1.ConditionStatus, reason, message string) (bool, error) {
+	return r.setCondition(ctx, connection, kubevirtv1alpha1.ConditionReady, status, reason, message)
+}
+
+// setCondition updates a condition of the status object and reports whether it changed
+func (r *VirtualMachineReconciler) setCondition(ctx context.Context, connection *kubevirtv1alpha1.GuacamoleConnection, conditionType string, status metav1.ConditionStatus, reason, message string) (bool, error) {
+	patch := client.MergeFrom(connection.DeepCopy())
+	changed := meta.SetStatusCondition(&connection.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: connection.Generation,
+	})
+	if !changed {
+		return false, nil
+	}
+	if err := r.Status().Patch(ctx, connection, patch); err != nil {
+		return false, fmt.Errorf("failed to update GuacamoleConnection status: %w", err)
+	}
+	return true, nil
+}
+
+// markConnectionReady records the published connection settings, their hash and the configuration revision
+// they were built with in the status object and sets it Ready
+func (r *VirtualMachineReconciler) markConnectionReady(ctx context.Context, connection *kubevirtv1alpha1.GuacamoleConnection, config *GuacamoleConnection, revision, hash string) error {
+	patch := client.MergeFrom(connection.DeepCopy())
+	connection.Status.ConfigRevision = revision
+	connection.Status.ConnectionHash = hash
+	connection.Status.Protocol = config.Protocol
+	connection.Status.Hostname = config.Parameters["hostname"]
+	connection.Status.Port = config.Parameters["port"]
+	meta.SetStatusCondition(&connection.Status.Conditions, metav1.Condition{
+		Type:               kubevirtv1alpha1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             ReasonConnectionReady,
+		Message:            "Guacamole connection is published and the guest is listening",
+		ObservedGeneration: connection.Generation,
+	})
+	if err := r.Status().Patch(ctx, connection, patch); err != nil {
+		return fmt.Errorf("failed to update GuacamoleConnection status: %w", err)
+	}
+	return nil
+}
+
+// recordSyncedStatus records in the status object that the connection is published and was last synced
+// while the VM had the given printable status
+func (r *VirtualMachineReconciler) recordSyncedStatus(ctx context.Context, connection *kubevirtv1alpha1.GuacamoleConnection, vmStatus string) error {
+	if connection.Status.Published && connection.Status.ObservedVMStatus == vmStatus {
+		return nil
+	}
+	patch := client.MergeFrom(connection.DeepCopy())
+	connection.Status.Published = true
+	connection.Status.ObservedVMStatus = vmStatus
+	if err := r.Status().Patch(ctx, connection, patch); err != nil {
+		return fmt.Errorf("failed to update GuacamoleConnection status: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"maps"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func testVM(annotations map[string]string) *kubevirtv1.VirtualMachine {
+	return &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm1", Namespace: "lab-a", Annotations: annotations}}
+}
+
+func TestConnectionHash(t *testing.T) {
+	baseAnnotations := map[string]string{NetworkAnnotation: "lab", "example.com/owner": "alice"}
+	baseConnection := func() *GuacamoleConnection {
+		return &GuacamoleConnection{
+			ParentIdentifier: "ROOT",
+			Name:             "lab-a-vm1",
+			Protocol:         "rdp",
+			Parameters:       map[string]string{"hostname": "10.0.0.5", "port": "3389", "security": "any"},
+			Attributes:       map[string]string{},
+		}
+	}
+	base := connectionHash(testVM(baseAnnotations), baseConnection())
+
+	tests := []struct {
+		name        string
+		annotations func(map[string]string)
+		connection  func(*GuacamoleConnection)
+		wantChange  bool
+	}{
+		{name: "unchanged"},
+		{name: "unrelated annotation", annotations: func(a map[string]string) { a["example.com/owner"] = "bob" }},
+		{name: "operator annotation not affecting the connection", annotations: func(a map[string]string) { a[IdleTimeoutAnnotation] = "1h" }},
+		{name: "address", connection: func(c *GuacamoleConnection) { c.Parameters["hostname"] = "10.0.0.6" }, wantChange: true},
+		{name: "parameter added", connection: func(c *GuacamoleConnection) { c.Parameters["recording-path"] = "/rec" }, wantChange: true},
+		{name: "network", annotations: func(a map[string]string) { a[NetworkAnnotation] = "storage" }, wantChange: true},
+		{name: "network removed", annotations: func(a map[string]string) { delete(a, NetworkAnnotation) }, wantChange: true},
+		{name: "empty interface added", annotations: func(a map[string]string) { a[InterfaceAnnotation] = "" }, wantChange: true},
+		{name: "network policy", annotations: func(a map[string]string) { a[NetworkPolicyAnnotation] = "true" }, wantChange: true},
+		{name: "guest probe", annotations: func(a map[string]string) { a[GuestProbeAnnotation] = GuestProbeNone }, wantChange: true},
+		{name: "service", annotations: func(a map[string]string) { a[ServiceModeAnnotation] = ServiceModeClusterIP }, wantChange: true},
+		{name: "recording", annotations: func(a map[string]string) { a[RecordingAnnotation] = "true" }, wantChange: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := maps.Clone(baseAnnotations)
+			if tt.annotations != nil {
+				tt.annotations(annotations)
+			}
+			connection := baseConnection()
+			if tt.connection != nil {
+				tt.connection(connection)
+			}
+			if changed := connectionHash(testVM(annotations), connection) != base; changed != tt.wantChange {
+				t.Errorf("hash changed = %v, want %v", changed, tt.wantChange)
+			}
+		})
+	}
+}
+
+func TestVMChanged(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(*kubevirtv1.VirtualMachine)
+		want   bool
+	}{
+		{name: "nothing", update: func(*kubevirtv1.VirtualMachine) {}},
+		{name: "resource version only", update: func(vm *kubevirtv1.VirtualMachine) { vm.ResourceVersion = "2" }},
+		{name: "unrelated annotation", update: func(vm *kubevirtv1.VirtualMachine) { vm.Annotations["example.com/owner"] = "bob" }},
+		{name: "status", update: func(vm *kubevirtv1.VirtualMachine) {
+			vm.Status.PrintableStatus = kubevirtv1.VirtualMachineStatusStopped
+		}, want: true},
+		{name: "generation", update: func(vm *kubevirtv1.VirtualMachine) { vm.Generation = 2 }, want: true},
+		{name: "deletion", update: func(vm *kubevirtv1.VirtualMachine) { vm.DeletionTimestamp = &metav1.Time{} }, want: true},
+		{name: "instances", update: func(vm *kubevirtv1.VirtualMachine) { vm.Annotations[GuacamoleInstancesAnnotation] = "staff" }, want: true},
+		{name: "sharing profiles", update: func(vm *kubevirtv1.VirtualMachine) { vm.Annotations[SharingProfilesAnnotation] = "read-only" }, want: true},
+		{name: "port", update: func(vm *kubevirtv1.VirtualMachine) { vm.Annotations["vm-watcher.setofangdar.polito.it/port"] = "3390" }, want: true},
+		{name: "allowed CIDRs", update: func(vm *kubevirtv1.VirtualMachine) { vm.Annotations[AllowedCIDRsAnnotation] = "10.0.0.0/8" }, want: true},
+		{name: "ip family", update: func(vm *kubevirtv1.VirtualMachine) { vm.Annotations[IPFamilyAnnotation] = IPFamilyIPv6 }, want: true},
+		{name: "network removed", update: func(vm *kubevirtv1.VirtualMachine) { delete(vm.Annotations, NetworkAnnotation) }, want: true},
+		{name: "empty network policy added", update: func(vm *kubevirtv1.VirtualMachine) { vm.Annotations[NetworkPolicyAnnotation] = "" }, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldVM := testVM(map[string]string{NetworkAnnotation: "lab", "example.com/owner": "alice"})
+			oldVM.Generation = 1
+			oldVM.Status.PrintableStatus = kubevirtv1.VirtualMachineStatusRunning
+			newVM := oldVM.DeepCopy()
+			tt.update(newVM)
+			if got := vmChanged(oldVM, newVM); got != tt.want {
+				t.Errorf("vmChanged = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
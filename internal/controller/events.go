@@ -0,0 +1,54 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// Reasons of the events emitted on VMs about their Guacamole connection
+const (
+	// The connection was created in an instance
+	EventConnectionCreated = "ConnectionCreated"
+	// The connection was updated in an instance, e.g. with the VM's new address
+	EventConnectionUpdated = "ConnectionUpdated"
+	// The connection was deleted from an instance
+	EventConnectionDeleted = "ConnectionDeleted"
+	// The connection could not be created or updated in an instance
+	EventConnectionFailed = "ConnectionFailed"
+	// The operator could not log in to an instance
+	EventAuthenticationFailed = "AuthenticationFailed"
+	// The protocol annotation names a protocol that is not supported, RDP is used instead
+	EventUnsupportedProtocol = "UnsupportedProtocol"
+	// No address of the VM is known, the connection points at the VM name
+	EventHostnameFallback = "HostnameFallback"
+	// Publishing the connection failed MaxRetryAttempts times in a row
+	EventDegraded = "Degraded"
+	// The finalizer was removed although the connection could not be deleted from an instance
+	EventCleanupSkipped = "CleanupSkipped"
+	// The connection could not be deleted from an instance and was recorded as a tombstone, to be deleted later
+	EventCleanupDeferred = "CleanupDeferred"
+	// The guest does not accept connections on its remote-desktop port yet
+	EventGuestNotListening = "GuestNotListening"
+	// The VM was stopped after its connection had no active session for longer than its idle timeout
+	EventIdleStop = "IdleStop"
+)
+
+// recordEvent emits an event on the VM, if the reconciler has a recorder
+func (r *VirtualMachineReconciler) recordEvent(vm *kubevirtv1.VirtualMachine, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(vm, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Log in with a username and password
+	AuthModePassword = "password"
+	// Log in with a payload signed and encrypted with the secret key of Guacamole's JSON auth extension
+	AuthModeJSON = "json"
+	// Log in with the username in an HTTP header, as sent by an authenticating proxy to Guacamole's header auth extension
+	AuthModeHeader = "header"
+
+	// Header read by Guacamole's header auth extension unless configured otherwise
+	DefaultAuthHeader = "REMOTE_USER"
+
+	// Key of the credentials Secrets holding the hex encoded secret key of the JSON auth extension
+	jsonSecretKeySecretKey = "json-secret-key"
+	// Key of the credentials Secrets holding the hex encoded secret key connection links are signed with
+	linkSecretKeySecretKey = "link-secret-key"
+	// Prefix of the Guacamole username of connection link sessions, keeping them apart from database accounts
+	LinkUsernamePrefix = "k8s:"
+	// Time a JSON auth payload can be used to log in
+	jsonAuthPayloadLifetime = time.Minute
+)
+
+// jsonAuthPayload is the data authenticated by Guacamole's JSON auth extension
+type jsonAuthPayload struct {
+	Username    string                        `json:"username"`
+	Expires     int64                         `json:"expires,omitempty"` // Milliseconds since the epoch
+	Connections map[string]jsonAuthConnection `json:"connections"`
+}
+
+// jsonAuthConnection is a connection made available by a JSON auth payload
+type jsonAuthConnection struct {
+	ID         string            `json:"id,omitempty"`
+	Protocol   string            `json:"protocol"`
+	Parameters map[string]string `json:"parameters"`
+}
+
+// ParseJSONSecretKey decodes the secret key of the JSON auth extension, 32 hex digits
+func ParseJSONSecretKey(value string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("secret key is not hex encoded: %w", err)
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("secret key must be 128 bits (32 hex digits), got %d bits", len(key)*8)
+	}
+	return key, nil
+}
+
+// parseLinkSecretKey decodes the link secret key of a credentials Secret, nil if it is not set. Links are
+// signed with a key of their own so that a link payload can never be used as an admin login, which is why
+// the key is refused in AuthModeJSON, where the JSON auth extension already holds the operator's login key.
+func parseLinkSecretKey(data map[string][]byte, authMode string) ([]byte, error) {
+	value := data[linkSecretKeySecretKey]
+	if len(value) == 0 {
+		return nil, nil
+	}
+	if authMode == AuthModeJSON {
+		return nil, fmt.Errorf("%s cannot be used with the %s auth mode, links need their own JSON auth key", linkSecretKeySecretKey, AuthModeJSON)
+	}
+	key, err := ParseJSONSecretKey(string(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", linkSecretKeySecretKey, err)
+	}
+	return key, nil
+}
+
+// encryptJSONAuth signs the payload with HMAC-SHA256 and encrypts signature and payload with AES-128-CBC
+// and a zero IV, as Guacamole's JSON auth extension expects, returning the base64 encoded result
+func encryptJSONAuth(secretKey []byte, payload *jsonAuthPayload) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal JSON auth payload: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write(data)
+	plaintext := append(mac.Sum(nil), data...)
+
+	// PKCS#7 padding
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid secret key: %w", err)
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(ciphertext, plaintext)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// loginRequest builds the request exchanging the instance's credentials for an auth token
+func (t *GuacamoleTarget) loginRequest(ctx context.Context) (*http.Request, error) {
+	authURL := fmt.Sprintf("%s/api/tokens", strings.TrimSuffix(t.BaseURL, "/"))
+
+	data := url.Values{}
+	switch t.AuthMode {
+	case AuthModeJSON:
+		// A short-lived payload without connections: the session gets the permissions of the database
+		// account of the same username
+		payload, err := encryptJSONAuth(t.JSONSecretKey, &jsonAuthPayload{
+			Username:    t.Username,
+			Expires:     time.Now().Add(jsonAuthPayloadLifetime).UnixMilli(),
+			Connections: map[string]jsonAuthConnection{},
+		})
+		if err != nil {
+			return nil, err
+		}
+		data.Set("data", payload)
+	case AuthModeHeader:
+	case "", AuthModePassword:
+		data.Set("username", t.Username)
+		data.Set("password", t.Password)
+	default:
+		return nil, fmt.Errorf("unsupported auth mode %q", t.AuthMode)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", authURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create auth request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if t.AuthMode == AuthModeHeader {
+		header := t.AuthHeader
+		if header == "" {
+			header = DefaultAuthHeader
+		}
+		req.Header.Set(header, t.Username)
+	}
+	return req, nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decryptJSONAuth reverses encryptJSONAuth the way Guacamole's JSON auth extension does, checking the
+// padding and the signature
+func decryptJSONAuth(t *testing.T, secretKey []byte, data string) *jsonAuthPayload {
+	t.Helper()
+	ciphertext, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		t.Fatalf("payload is not base64: %v", err)
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		t.Fatalf("ciphertext length %d is not a positive multiple of the block size", len(ciphertext))
+	}
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding < 1 || padding > aes.BlockSize ||
+		!bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		t.Fatalf("invalid PKCS#7 padding %d", padding)
+	}
+	plaintext = plaintext[:len(plaintext)-padding]
+
+	signature, message := plaintext[:sha256.Size], plaintext[sha256.Size:]
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write(message)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		t.Fatal("signature does not match the payload")
+	}
+
+	var payload jsonAuthPayload
+	if err := json.Unmarshal(message, &payload); err != nil {
+		t.Fatalf("payload is not JSON: %v", err)
+	}
+	return &payload
+}
+
+func TestEncryptJSONAuth(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	tests := []struct {
+		name    string
+		payload jsonAuthPayload
+	}{
+		{
+			name:    "login without connections",
+			payload: jsonAuthPayload{Username: "vm-watcher", Expires: 1700000000000, Connections: map[string]jsonAuthConnection{}},
+		},
+		{
+			name: "connection link",
+			payload: jsonAuthPayload{
+				Username: "k8s:system:serviceaccount:lab-a:student",
+				Expires:  1700000000000,
+				Connections: map[string]jsonAuthConnection{
+					"lab-a-vm1": {Protocol: "rdp", Parameters: map[string]string{"hostname": "10.0.0.1", "port": "3389"}},
+				},
+			},
+		},
+		{
+			// 32 bytes of signature plus a payload of a length that needs a full block of padding
+			name:    "block aligned",
+			payload: jsonAuthPayload{Username: strings.Repeat("u", 14), Connections: map[string]jsonAuthConnection{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encryptJSONAuth(key, &tt.payload)
+			if err != nil {
+				t.Fatalf("encryptJSONAuth failed: %v", err)
+			}
+			if got := decryptJSONAuth(t, key, data); !reflect.DeepEqual(*got, tt.payload) {
+				t.Errorf("decrypted payload = %+v, want %+v", *got, tt.payload)
+			}
+		})
+	}
+}
+
+func TestEncryptJSONAuthInvalidKey(t *testing.T) {
+	if _, err := encryptJSONAuth([]byte("short"), &jsonAuthPayload{Username: "vm-watcher"}); err == nil {
+		t.Error("encryptJSONAuth accepted a key that is not 128 bits")
+	}
+}
+
+func TestParseLinkSecretKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string][]byte
+		authMode string
+		wantKey  bool
+		wantErr  bool
+	}{
+		{name: "not set", data: map[string][]byte{}},
+		{name: "password mode", data: map[string][]byte{linkSecretKeySecretKey: []byte("000102030405060708090a0b0c0d0e0f\n")}, authMode: AuthModePassword, wantKey: true},
+		{name: "header mode", data: map[string][]byte{linkSecretKeySecretKey: []byte("000102030405060708090a0b0c0d0e0f")}, authMode: AuthModeHeader, wantKey: true},
+		{name: "refused in json mode", data: map[string][]byte{linkSecretKeySecretKey: []byte("000102030405060708090a0b0c0d0e0f")}, authMode: AuthModeJSON, wantErr: true},
+		{name: "not hex", data: map[string][]byte{linkSecretKeySecretKey: []byte("not a key")}, wantErr: true},
+		{name: "wrong length", data: map[string][]byte{linkSecretKeySecretKey: []byte("0001")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parseLinkSecretKey(tt.data, tt.authMode)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLinkSecretKey error = %v, want error %v", err, tt.wantErr)
+			}
+			if (len(key) > 0) != tt.wantKey {
+				t.Errorf("parseLinkSecretKey key = %x, want key %v", key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestLinkUsername(t *testing.T) {
+	tests := []struct {
+		name           string
+		operator       string
+		kubernetesUser string
+		want           string
+		wantErr        bool
+	}{
+		{name: "service account", operator: "guacadmin", kubernetesUser: "system:serviceaccount:lab-a:student", want: "k8s:system:serviceaccount:lab-a:student"},
+		{name: "same name as the operator", operator: "guacadmin", kubernetesUser: "guacadmin", want: "k8s:guacadmin"},
+		{name: "operator account under the prefix", operator: "k8s:alice", kubernetesUser: "alice", wantErr: true},
+		{name: "empty", operator: "guacadmin", kubernetesUser: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := linkUsername(&GuacamoleTarget{Username: tt.operator}, tt.kubernetesUser)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("linkUsername error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("linkUsername = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
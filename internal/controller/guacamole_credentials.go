@@ -0,0 +1,253 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+const (
+	// Default interval between checks of the credentials Secret or files for a rotation
+	DefaultCredentialsReloadInterval = 30 * time.Second
+	// Time an admin auth token is reused before logging in again
+	TokenTTL = 5 * time.Minute
+)
+
+// guacamoleCredentials are the username with the password or JSON auth secret key it logs in with
+type guacamoleCredentials struct {
+	username      string
+	password      string
+	secretKey     string // Raw secret key of the JSON auth extension
+	linkSecretKey string // Raw secret key connection links are signed with
+}
+
+// GuacamoleCredentials provides the admin credentials of the default instance from a Secret, read through the
+// API, or from the files of a mounted Secret. While running it reloads them, so that a rotated password is used
+// without restarting the operator. Tokens issued for the previous credentials are dropped on their next use.
+type GuacamoleCredentials struct {
+	// Reader reads the Secret, normally the manager's API reader so that the first load works before the cache starts
+	Reader client.Reader
+
+	Secret *kubevirtv1alpha1.SecretReference // "username", "password", "json-secret-key" and "link-secret-key" keys
+	Dir    string                            // Directory with files named like the Secret keys, used instead of Secret
+	// Auth mode the credentials are used with, deciding whether a password or a secret key is required
+	AuthMode string
+	// Interval between checks for a rotation
+	Interval time.Duration
+
+	current atomic.Pointer[guacamoleCredentials]
+}
+
+// Get returns the current username and password
+func (c *GuacamoleCredentials) Get() (string, string) {
+	credentials := c.load()
+	return credentials.username, credentials.password
+}
+
+// load returns the current credentials
+func (c *GuacamoleCredentials) load() guacamoleCredentials {
+	if credentials := c.current.Load(); credentials != nil {
+		return *credentials
+	}
+	return guacamoleCredentials{}
+}
+
+// Load reads the credentials and switches to them if they changed since the last load
+func (c *GuacamoleCredentials) Load(ctx context.Context) error {
+	data := make(map[string][]byte)
+	if c.Dir != "" {
+		for _, key := range []string{usernameSecretKey, passwordSecretKey, jsonSecretKeySecretKey, linkSecretKeySecretKey} {
+			value, err := os.ReadFile(filepath.Join(c.Dir, key))
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to read %s: %w", key, err)
+			}
+			data[key] = bytes.TrimRight(value, "\r\n")
+		}
+	} else {
+		var secret corev1.Secret
+		if err := c.Reader.Get(ctx, client.ObjectKey{Namespace: c.Secret.Namespace, Name: c.Secret.Name}, &secret); err != nil {
+			return fmt.Errorf("failed to get credentials Secret: %w", err)
+		}
+		data = secret.Data
+	}
+
+	credentials := guacamoleCredentials{
+		username: strings.TrimSpace(string(data[usernameSecretKey])),
+		password: string(data[passwordSecretKey]),
+	}
+	if credentials.username == "" {
+		return fmt.Errorf("credentials need a non-empty %s", usernameSecretKey)
+	}
+	if c.AuthMode == AuthModeJSON {
+		secretKey, err := ParseJSONSecretKey(string(data[jsonSecretKeySecretKey]))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", jsonSecretKeySecretKey, err)
+		}
+		credentials.secretKey = string(secretKey)
+	}
+	linkSecretKey, err := parseLinkSecretKey(data, c.AuthMode)
+	if err != nil {
+		return err
+	}
+	credentials.linkSecretKey = string(linkSecretKey)
+	switch c.AuthMode {
+	case AuthModeJSON, AuthModeHeader:
+	default:
+		if credentials.password == "" {
+			return fmt.Errorf("credentials need a non-empty %s", passwordSecretKey)
+		}
+	}
+
+	previous := c.current.Load()
+	if previous != nil && *previous == credentials {
+		return nil
+	}
+	c.current.Store(&credentials)
+	if previous != nil {
+		log.FromContext(ctx).Info("Guacamole credentials rotated", "username", credentials.username)
+	}
+	return nil
+}
+
+// Start implements manager.Runnable and reloads the credentials until the context is cancelled.
+// A failed reload keeps the previous credentials.
+func (c *GuacamoleCredentials) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("guacamole-credentials")
+	ctx = log.IntoContext(ctx, logger)
+
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultCredentialsReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := c.Load(ctx); err != nil {
+				logger.Error(err, "Failed to reload Guacamole credentials, keeping the previous ones")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection lets every replica reload its credentials
+func (c *GuacamoleCredentials) NeedLeaderElection() bool {
+	return false
+}
+
+// cachedToken is an admin auth token kept for reuse
+type cachedToken struct {
+	fingerprint string // Of the instance settings and credentials the token was issued for
+	authResp    GuacamoleAuthResponse
+	expires     time.Time
+}
+
+// targetFingerprint identifies the settings and credentials of an instance without keeping the password
+func targetFingerprint(target *GuacamoleTarget) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		target.BaseURL, target.Username, target.Password, target.DataSource,
+		target.AuthMode, target.AuthHeader, string(target.JSONSecretKey),
+	}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedToken returns a copy of the reusable token of the instance, or nil if it must log in. A token issued
+// for other credentials is also returned, as stale, so that the caller can revoke it.
+func (r *VirtualMachineReconciler) cachedToken(target *GuacamoleTarget) (*GuacamoleAuthResponse, *GuacamoleAuthResponse) {
+	r.tokensMu.Lock()
+	defer r.tokensMu.Unlock()
+
+	cached, exists := r.tokens[target.Name]
+	if !exists {
+		return nil, nil
+	}
+	if cached.fingerprint != targetFingerprint(target) {
+		delete(r.tokens, target.Name)
+		stale := cached.authResp
+		return nil, &stale
+	}
+	if time.Now().After(cached.expires) {
+		delete(r.tokens, target.Name)
+		return nil, nil
+	}
+	authResp := cached.authResp
+	authResp.target = target
+	return &authResp, nil
+}
+
+// storeToken keeps the token for reuse by later requests to the instance
+func (r *VirtualMachineReconciler) storeToken(target *GuacamoleTarget, authResp *GuacamoleAuthResponse) {
+	r.tokensMu.Lock()
+	defer r.tokensMu.Unlock()
+	if r.tokens == nil {
+		r.tokens = make(map[string]cachedToken)
+	}
+	r.tokens[target.Name] = cachedToken{
+		fingerprint: targetFingerprint(target),
+		authResp:    *authResp,
+		expires:     time.Now().Add(TokenTTL),
+	}
+}
+
+// checkTokenStatus drops the cached token when Guacamole rejected it, e.g. because the session expired
+func (r *VirtualMachineReconciler) checkTokenStatus(authResp *GuacamoleAuthResponse, statusCode int) {
+	if statusCode != http.StatusUnauthorized && statusCode != http.StatusForbidden {
+		return
+	}
+	r.tokensMu.Lock()
+	defer r.tokensMu.Unlock()
+	if cached, exists := r.tokens[authResp.target.Name]; exists && cached.authResp.AuthToken == authResp.AuthToken {
+		delete(r.tokens, authResp.target.Name)
+	}
+}
+
+// revokeToken logs a token out of Guacamole. Failures are only logged: the token expires by itself.
+func (r *VirtualMachineReconciler) revokeToken(ctx context.Context, authResp *GuacamoleAuthResponse) {
+	logger := log.FromContext(ctx)
+
+	revokeURL := fmt.Sprintf("%s/api/tokens/%s", strings.TrimSuffix(authResp.target.BaseURL, "/"), url.PathEscape(authResp.AuthToken))
+	req, err := http.NewRequestWithContext(ctx, "DELETE", revokeURL, nil)
+	if err != nil {
+		logger.Error(err, "Failed to create token revocation request")
+		return
+	}
+	resp, err := r.sendGuacamoleRequest(authResp.target, req)
+	if err != nil {
+		logger.Error(err, "Failed to revoke Guacamole token", "instance", authResp.target.Name)
+		return
+	}
+	resp.Body.Close()
+	logger.Info("Revoked Guacamole token issued for previous credentials", "instance", authResp.target.Name, "status_code", resp.StatusCode)
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writeCredentials writes the files of a mounted credentials Secret, removing the keys without a value
+func writeCredentials(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for _, key := range []string{usernameSecretKey, passwordSecretKey} {
+		path := filepath.Join(dir, key)
+		value, exists := files[key]
+		if !exists {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.WriteFile(path, []byte(value), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGuacamoleCredentialsLoad(t *testing.T) {
+	tests := []struct {
+		name         string
+		authMode     string
+		files        map[string]string
+		wantErr      bool
+		wantUsername string
+		wantPassword string
+	}{
+		{
+			name:         "password",
+			files:        map[string]string{usernameSecretKey: " guacadmin\n", passwordSecretKey: "s3cret\n"},
+			wantUsername: "guacadmin",
+			wantPassword: "s3cret",
+		},
+		{name: "missing username", files: map[string]string{passwordSecretKey: "s3cret"}, wantErr: true},
+		{name: "missing password", files: map[string]string{usernameSecretKey: "guacadmin"}, wantErr: true},
+		{
+			name:         "header auth without password",
+			authMode:     AuthModeHeader,
+			files:        map[string]string{usernameSecretKey: "guacadmin"},
+			wantUsername: "guacadmin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeCredentials(t, dir, tt.files)
+			credentials := &GuacamoleCredentials{Dir: dir, AuthMode: tt.authMode}
+
+			err := credentials.Load(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, want error %v", err, tt.wantErr)
+			}
+			if username, password := credentials.Get(); username != tt.wantUsername || password != tt.wantPassword {
+				t.Errorf("Get() = %q, %q, want %q, %q", username, password, tt.wantUsername, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestGuacamoleCredentialsRotation(t *testing.T) {
+	dir := t.TempDir()
+	writeCredentials(t, dir, map[string]string{usernameSecretKey: "guacadmin", passwordSecretKey: "old"})
+	credentials := &GuacamoleCredentials{Dir: dir}
+	if err := credentials.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	writeCredentials(t, dir, map[string]string{usernameSecretKey: "guacadmin", passwordSecretKey: "new"})
+	if err := credentials.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, password := credentials.Get(); password != "new" {
+		t.Errorf("password = %q after rotation, want new", password)
+	}
+
+	// A Secret caught mid-update keeps the previous credentials
+	writeCredentials(t, dir, map[string]string{usernameSecretKey: "guacadmin"})
+	if err := credentials.Load(context.Background()); err == nil {
+		t.Error("Load() accepted credentials without a password")
+	}
+	if _, password := credentials.Get(); password != "new" {
+		t.Errorf("password = %q after a failed reload, want new", password)
+	}
+}
+
+// tokenServer issues one token per login, accepting only the current password, and records revocations
+type tokenServer struct {
+	password string
+
+	mu      sync.Mutex
+	logins  int
+	revoked []string
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == "/api/tokens":
+		if req.FormValue("password") != s.password {
+			http.Error(w, "invalid credentials", http.StatusForbidden)
+			return
+		}
+		s.logins++
+		_ = json.NewEncoder(w).Encode(GuacamoleAuthResponse{
+			AuthToken:            fmt.Sprintf("token-%d", s.logins),
+			Username:             req.FormValue("username"),
+			DataSource:           "postgresql",
+			AvailableDataSources: []string{"postgresql"},
+		})
+	case req.Method == http.MethodDelete && strings.HasPrefix(req.URL.Path, "/api/tokens/"):
+		s.revoked = append(s.revoked, strings.TrimPrefix(req.URL.Path, "/api/tokens/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestTokenRotationAndInvalidation(t *testing.T) {
+	dir := t.TempDir()
+	writeCredentials(t, dir, map[string]string{usernameSecretKey: "guacadmin", passwordSecretKey: "old"})
+	credentials := &GuacamoleCredentials{Dir: dir}
+	if err := credentials.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	guacamole := &tokenServer{password: "old"}
+	server := httptest.NewServer(guacamole)
+	defer server.Close()
+	r := &VirtualMachineReconciler{GuacamoleBaseURL: server.URL, HTTPClient: server.Client(), Credentials: credentials}
+
+	authenticate := func(wantToken string) *GuacamoleAuthResponse {
+		t.Helper()
+		authResp, err := r.authenticateWithGuacamole(context.Background(), r.defaultTarget())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authResp.AuthToken != wantToken {
+			t.Fatalf("token = %s, want %s", authResp.AuthToken, wantToken)
+		}
+		return authResp
+	}
+
+	first := authenticate("token-1")
+	authenticate("token-1")
+	if guacamole.logins != 1 {
+		t.Errorf("logged in %d times, want the token reused", guacamole.logins)
+	}
+
+	// The token of the old password is revoked and the new password logs in
+	guacamole.password = "new"
+	writeCredentials(t, dir, map[string]string{usernameSecretKey: "guacadmin", passwordSecretKey: "new"})
+	if err := credentials.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	second := authenticate("token-2")
+	if !slices.Equal(guacamole.revoked, []string{"token-1"}) {
+		t.Errorf("revoked %v, want the token of the old password", guacamole.revoked)
+	}
+
+	// A rejection of an older token keeps the current one, a rejection of the current one drops it
+	r.checkTokenStatus(first, http.StatusUnauthorized)
+	authenticate("token-2")
+	r.checkTokenStatus(second, http.StatusNotFound)
+	authenticate("token-2")
+	r.checkTokenStatus(second, http.StatusForbidden)
+	authenticate("token-3")
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+var (
+	// ErrDataSourceUnavailable is returned when the configured data source is not offered by the instance
+	ErrDataSourceUnavailable = errors.New("data source not available")
+	// ErrConnectionManagementUnsupported is returned when connections cannot be created in the data source
+	ErrConnectionManagementUnsupported = errors.New("data source does not support connection management")
+)
+
+// selectDataSource points the token at the instance's configured data source, failing if the login did not offer it
+func selectDataSource(authResp *GuacamoleAuthResponse, target *GuacamoleTarget) error {
+	if target.DataSource == "" {
+		return nil
+	}
+	if !slices.Contains(authResp.AvailableDataSources, target.DataSource) {
+		return fmt.Errorf("%w: instance %s has no data source %q, available data sources are %v",
+			ErrDataSourceUnavailable, target.Name, target.DataSource, authResp.AvailableDataSources)
+	}
+	authResp.DataSource = target.DataSource
+	return nil
+}
+
+// checkConnectionManagement verifies that the admin user can create connections in the token's data source.
+// Read-only sources such as OIDC or header authentication grant no system permissions. Only a missing
+// permission or a refused permissions request wraps ErrConnectionManagementUnsupported; an instance that
+// cannot be reached returns the request error.
+func (r *VirtualMachineReconciler) checkConnectionManagement(ctx context.Context, authResp *GuacamoleAuthResponse) error {
+	var permissions GuacamoleEffectivePermissions
+	if err := r.doGuacamoleRequest(ctx, authResp, "GET", "self/effectivePermissions", nil, &permissions); err != nil {
+		var apiErr *guacamoleAPIError
+		if errors.As(err, &apiErr) && apiErr.statusCode == http.StatusForbidden {
+			return fmt.Errorf("%w: permissions in data source %q refused: %v",
+				ErrConnectionManagementUnsupported, authResp.DataSource, err)
+		}
+		return fmt.Errorf("failed to get permissions in data source %q: %w", authResp.DataSource, err)
+	}
+	if slices.Contains(permissions.SystemPermissions, "ADMINISTER") ||
+		slices.Contains(permissions.SystemPermissions, "CREATE_CONNECTION") {
+		return nil
+	}
+	return fmt.Errorf("%w: user %s lacks CREATE_CONNECTION in data source %q, set the data source explicitly (available: %v)",
+		ErrConnectionManagementUnsupported, authResp.Username, authResp.DataSource, authResp.AvailableDataSources)
+}
+
+// ValidateDataSource logs in to the instance configured by flags and checks that its data source exists and
+// accepts new connections. Errors wrapping ErrDataSourceUnavailable or ErrConnectionManagementUnsupported are
+// configuration mistakes, anything else means the instance could not be reached.
+func (r *VirtualMachineReconciler) ValidateDataSource(ctx context.Context) error {
+	target := r.defaultTarget()
+	if target == nil {
+		return nil
+	}
+	authResp, err := r.authenticateWithGuacamole(ctx, target)
+	if err != nil {
+		return err
+	}
+	return r.checkConnectionManagement(ctx, authResp)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSelectDataSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		wantSource string
+		wantErr    error
+	}{
+		{name: "login default", wantSource: "json"},
+		{name: "available", configured: "postgresql", wantSource: "postgresql"},
+		{name: "unavailable", configured: "mysql", wantSource: "json", wantErr: ErrDataSourceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authResp := &GuacamoleAuthResponse{DataSource: "json", AvailableDataSources: []string{"json", "postgresql"}}
+			err := selectDataSource(authResp, &GuacamoleTarget{Name: "test", DataSource: tt.configured})
+			if !errors.Is(err, tt.wantErr) || (err != nil) != (tt.wantErr != nil) {
+				t.Errorf("selectDataSource() error = %v, want %v", err, tt.wantErr)
+			}
+			if authResp.DataSource != tt.wantSource {
+				t.Errorf("data source = %q, want %q", authResp.DataSource, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestCheckConnectionManagement(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		permissions []string
+		// wantErr is nil for success and errUnreachable for an error that is not a configuration mistake
+		wantErr error
+	}{
+		{name: "administrator", status: http.StatusOK, permissions: []string{"ADMINISTER"}},
+		{name: "connection creator", status: http.StatusOK, permissions: []string{"CREATE_USER", "CREATE_CONNECTION"}},
+		{name: "read-only data source", status: http.StatusOK, wantErr: ErrConnectionManagementUnsupported},
+		{name: "permissions refused", status: http.StatusForbidden, wantErr: ErrConnectionManagementUnsupported},
+		{name: "instance failing", status: http.StatusInternalServerError, wantErr: errUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/api/session/data/postgresql/self/effectivePermissions" {
+					t.Errorf("unexpected request %s", req.URL.Path)
+				}
+				if tt.status != http.StatusOK {
+					http.Error(w, "failed", tt.status)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(GuacamoleEffectivePermissions{SystemPermissions: tt.permissions})
+			}))
+			defer server.Close()
+			r, authResp := batchTestReconciler(server, 0, 0)
+
+			err := r.checkConnectionManagement(context.Background(), authResp)
+			switch tt.wantErr {
+			case nil:
+				if err != nil {
+					t.Errorf("checkConnectionManagement() error = %v", err)
+				}
+			case errUnreachable:
+				if err == nil || errors.Is(err, ErrConnectionManagementUnsupported) {
+					t.Errorf("checkConnectionManagement() error = %v, want a request error", err)
+				}
+			default:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("checkConnectionManagement() error = %v, want %v", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+// errUnreachable marks test cases expecting a request error rather than a configuration mistake
+var errUnreachable = errors.New("unreachable")
@@ -0,0 +1,121 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Readiness fails whenever the last health check failed
+	ReadinessAlways = "always"
+	// Readiness fails until the first successful health check, later outages are only reported by the metric
+	ReadinessStartup = "startup"
+	// Readiness ignores Guacamole, the health check only feeds the metric
+	ReadinessNone = "none"
+
+	// Default time a health check result is reused before Guacamole is checked again
+	DefaultHealthCheckInterval = 30 * time.Second
+	// Timeout of one health check
+	healthCheckTimeout = 10 * time.Second
+)
+
+// GuacamoleHealthCheck checks that the default Guacamole instances are reachable and that the operator can
+// log in and manage connections there. Results are cached for the interval, so that probes hitting /readyz
+// do not turn into Guacamole traffic, and exported as the guacamole_up metric.
+type GuacamoleHealthCheck struct {
+	Reconciler *VirtualMachineReconciler // Provides the Guacamole and Kubernetes clients
+	Interval   time.Duration
+	Mode       string // always, startup or none (the default)
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	lastErr   error
+	healthy   bool // Whether a check ever succeeded
+}
+
+// Check implements healthz.Checker
+func (c *GuacamoleHealthCheck) Check(req *http.Request) error {
+	err := c.check(req.Context())
+	switch c.Mode {
+	case "", ReadinessNone:
+		return nil
+	case ReadinessStartup:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.healthy {
+			return nil
+		}
+	}
+	return err
+}
+
+// check returns the result of the last health check, checking again once it is older than the interval.
+// Concurrent callers wait for the same check.
+func (c *GuacamoleHealthCheck) check(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < interval {
+		return c.lastErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	err := c.Reconciler.checkGuacamole(ctx)
+	switch {
+	case err != nil && (c.lastErr == nil || err.Error() != c.lastErr.Error()):
+		log.FromContext(ctx).Info("Guacamole health check failed", "reason", err.Error())
+	case err == nil && c.lastErr != nil:
+		log.FromContext(ctx).Info("Guacamole health check succeeded again")
+	}
+	c.checkedAt = time.Now()
+	c.lastErr = err
+	c.healthy = c.healthy || err == nil
+	return err
+}
+
+// checkGuacamole logs in to every default instance and checks that connections can be managed there
+func (r *VirtualMachineReconciler) checkGuacamole(ctx context.Context) error {
+	targets, err := r.defaultTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, target := range targets {
+		authResp, err := r.authenticateWithGuacamole(ctx, target)
+		if err == nil {
+			err = r.checkConnectionManagement(ctx, authResp)
+		}
+		if err != nil {
+			guacamoleUp.WithLabelValues(target.Name).Set(0)
+			errs = append(errs, fmt.Errorf("instance %s: %w", target.Name, err))
+			continue
+		}
+		guacamoleUp.WithLabelValues(target.Name).Set(1)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// healthServer is a Guacamole instance that answers every request with 503 while down
+type healthServer struct {
+	down     atomic.Bool
+	requests atomic.Int32
+}
+
+func (s *healthServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.requests.Add(1)
+	if s.down.Load() {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	switch req.URL.Path {
+	case "/api/tokens":
+		_ = json.NewEncoder(w).Encode(GuacamoleAuthResponse{AuthToken: "token", DataSource: "postgresql", AvailableDataSources: []string{"postgresql"}})
+	case "/api/session/data/postgresql/self/effectivePermissions":
+		_ = json.NewEncoder(w).Encode(GuacamoleEffectivePermissions{SystemPermissions: []string{"ADMINISTER"}})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func healthTestReconciler(t *testing.T, server *httptest.Server) *VirtualMachineReconciler {
+	return &VirtualMachineReconciler{
+		Client:            fake.NewClientBuilder().WithScheme(newTestScheme(t)).Build(),
+		GuacamoleBaseURL:  server.URL,
+		GuacamoleUsername: "guacadmin",
+		GuacamolePassword: "guacadmin",
+		HTTPClient:        server.Client(),
+	}
+}
+
+func TestGuacamoleHealthCheckModes(t *testing.T) {
+	// Guacamole is down, comes up, then goes down again
+	outages := []bool{true, false, true}
+	tests := []struct {
+		mode      string
+		wantReady []bool
+	}{
+		{mode: ReadinessAlways, wantReady: []bool{false, true, false}},
+		{mode: ReadinessStartup, wantReady: []bool{false, true, true}},
+		{mode: ReadinessNone, wantReady: []bool{true, true, true}},
+		{mode: "", wantReady: []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			guacamole := &healthServer{}
+			server := httptest.NewServer(guacamole)
+			defer server.Close()
+			health := &GuacamoleHealthCheck{Reconciler: healthTestReconciler(t, server), Interval: time.Nanosecond, Mode: tt.mode}
+
+			for i, down := range outages {
+				guacamole.down.Store(down)
+				time.Sleep(time.Millisecond)
+				req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+				if ready := health.Check(req) == nil; ready != tt.wantReady[i] {
+					t.Errorf("check %d: ready = %v, want %v", i, ready, tt.wantReady[i])
+				}
+				// The metric reports every outage whatever the readiness mode
+				want := 1.0
+				if down {
+					want = 0
+				}
+				if got := testutil.ToFloat64(guacamoleUp.WithLabelValues(DefaultGuacamoleInstance)); got != want {
+					t.Errorf("check %d: guacamole_up = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGuacamoleHealthCheckCachesResult(t *testing.T) {
+	guacamole := &healthServer{}
+	server := httptest.NewServer(guacamole)
+	defer server.Close()
+	health := &GuacamoleHealthCheck{Reconciler: healthTestReconciler(t, server), Interval: time.Hour, Mode: ReadinessAlways}
+
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	if err := health.Check(req); err != nil {
+		t.Fatal(err)
+	}
+	requests := guacamole.requests.Load()
+	guacamole.down.Store(true)
+	if err := health.Check(req); err != nil {
+		t.Errorf("Check() = %v, want the cached success", err)
+	}
+	if got := guacamole.requests.Load(); got != requests {
+		t.Errorf("sent %d requests for a cached result", got-requests)
+	}
+}
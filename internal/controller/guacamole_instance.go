@@ -0,0 +1,521 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+const (
+	// Annotation on a VM or namespace with the comma separated GuacamoleInstances its connections are published to
+	GuacamoleInstancesAnnotation = "vm-watcher.setofangdar.polito.it/guacamole-instances"
+	// Name of the Guacamole instance configured by flags
+	DefaultGuacamoleInstance = "default"
+
+	// Keys of the GuacamoleInstance credentials and CA Secrets
+	usernameSecretKey = "username"
+	passwordSecretKey = "password"
+	caSecretKey       = "ca.crt"
+)
+
+// ErrDefaultInstanceNotConfigured is returned when the default instance is asked for without a Guacamole URL
+var ErrDefaultInstanceNotConfigured = errors.New("the default Guacamole instance is not configured")
+
+// GuacamoleTarget is a Guacamole deployment connections are published to
+type GuacamoleTarget struct {
+	Name       string // DefaultGuacamoleInstance or the GuacamoleInstance name
+	BaseURL    string
+	Username   string
+	Password   string
+	DataSource string // Data source connections are written to; empty uses the one returned at login
+	HTTPClient *http.Client
+	// How the operator logs in: AuthModePassword (the default), AuthModeJSON or AuthModeHeader
+	AuthMode      string
+	AuthHeader    string // Header carrying the username in AuthModeHeader, DefaultAuthHeader when empty
+	JSONSecretKey []byte // Secret key of the JSON auth extension in AuthModeJSON
+	LinkSecretKey []byte // Secret key connection links are signed with, never set in AuthModeJSON
+	// guacd pods the instance connects to VMs from; an empty namespace uses the operator's flags
+	GuacdNamespace string
+	GuacdPodLabels map[string]string
+}
+
+// httpClient returns the HTTP client for the instance
+func (t *GuacamoleTarget) httpClient() *http.Client {
+	if t.HTTPClient == nil {
+		return &http.Client{Timeout: 30 * time.Second}
+	}
+	return t.HTTPClient
+}
+
+// instanceHTTPClient is the HTTP client of a GuacamoleInstance, reused while its TLS settings are unchanged
+type instanceHTTPClient struct {
+	version string
+	client  *http.Client
+}
+
+// defaultTarget returns the instance configured by flags, or nil when there is none
+func (r *VirtualMachineReconciler) defaultTarget() *GuacamoleTarget {
+	settings := r.settings()
+	if settings.guacamoleURL == "" {
+		return nil
+	}
+	username, password := r.GuacamoleUsername, r.GuacamolePassword
+	var secretKey, linkSecretKey []byte
+	if r.Credentials != nil {
+		credentials := r.Credentials.load()
+		username, password = credentials.username, credentials.password
+		secretKey, linkSecretKey = []byte(credentials.secretKey), []byte(credentials.linkSecretKey)
+	}
+	return &GuacamoleTarget{
+		Name:          DefaultGuacamoleInstance,
+		BaseURL:       settings.guacamoleURL,
+		Username:      username,
+		Password:      password,
+		DataSource:    settings.guacamoleDataSource,
+		HTTPClient:    r.HTTPClient,
+		AuthMode:      r.GuacamoleAuthMode,
+		AuthHeader:    r.GuacamoleAuthHeader,
+		JSONSecretKey: secretKey,
+		LinkSecretKey: linkSecretKey,
+	}
+}
+
+// guacamoleTargetsFor returns the instances the VM's connection is published to. The guacamole-instances
+// annotation of the VM wins over the one of its namespace; without either the default instances are used.
+func (r *VirtualMachineReconciler) guacamoleTargetsFor(ctx context.Context, vm *kubevirtv1.VirtualMachine) ([]*GuacamoleTarget, error) {
+	value, selected := vm.Annotations[GuacamoleInstancesAnnotation]
+	if !selected {
+		var namespace corev1.Namespace
+		if err := r.Get(ctx, client.ObjectKey{Name: vm.Namespace}, &namespace); err != nil {
+			return nil, fmt.Errorf("failed to get namespace: %w", err)
+		}
+		value, selected = namespace.Annotations[GuacamoleInstancesAnnotation]
+	}
+	if !selected {
+		return r.defaultTargets(ctx)
+	}
+
+	var targets []*GuacamoleTarget
+	for _, name := range SplitList(value) {
+		target, err := r.guacamoleTarget(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// guacamoleTarget returns the instance with the given name
+func (r *VirtualMachineReconciler) guacamoleTarget(ctx context.Context, name string) (*GuacamoleTarget, error) {
+	if name == DefaultGuacamoleInstance {
+		if target := r.defaultTarget(); target != nil {
+			return target, nil
+		}
+		return nil, ErrDefaultInstanceNotConfigured
+	}
+
+	var instance kubevirtv1alpha1.GuacamoleInstance
+	if err := r.Get(ctx, client.ObjectKey{Name: name}, &instance); err != nil {
+		return nil, fmt.Errorf("failed to get GuacamoleInstance %s: %w", name, err)
+	}
+	return r.instanceTarget(ctx, &instance)
+}
+
+// defaultTargets returns the instance configured by flags and the GuacamoleInstances marked as default
+func (r *VirtualMachineReconciler) defaultTargets(ctx context.Context) ([]*GuacamoleTarget, error) {
+	return r.listTargets(ctx, func(instance *kubevirtv1alpha1.GuacamoleInstance) bool {
+		return instance.Spec.Default
+	})
+}
+
+// allGuacamoleTargets returns every known instance. Instances that cannot be used (e.g. because their
+// credentials Secret is missing) are logged and skipped.
+func (r *VirtualMachineReconciler) allGuacamoleTargets(ctx context.Context) ([]*GuacamoleTarget, error) {
+	return r.listTargets(ctx, func(*kubevirtv1alpha1.GuacamoleInstance) bool {
+		return true
+	})
+}
+
+// listTargets returns the instance configured by flags and the GuacamoleInstances matching the filter
+func (r *VirtualMachineReconciler) listTargets(ctx context.Context, include func(*kubevirtv1alpha1.GuacamoleInstance) bool) ([]*GuacamoleTarget, error) {
+	var targets []*GuacamoleTarget
+	if target := r.defaultTarget(); target != nil {
+		targets = append(targets, target)
+	}
+
+	var instances kubevirtv1alpha1.GuacamoleInstanceList
+	if err := r.List(ctx, &instances); err != nil {
+		if meta.IsNoMatchError(err) {
+			// The GuacamoleInstance CRD is not installed
+			return targets, nil
+		}
+		return nil, fmt.Errorf("failed to list GuacamoleInstances: %w", err)
+	}
+	for i := range instances.Items {
+		instance := &instances.Items[i]
+		if !include(instance) {
+			continue
+		}
+		target, err := r.instanceTarget(ctx, instance)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "Skipping unusable Guacamole instance", "instance", instance.Name)
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// instanceTarget reads the credentials of a GuacamoleInstance and returns it as a target
+func (r *VirtualMachineReconciler) instanceTarget(ctx context.Context, instance *kubevirtv1alpha1.GuacamoleInstance) (*GuacamoleTarget, error) {
+	credentials, err := r.getSecret(ctx, instance.Spec.CredentialsSecretRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials of GuacamoleInstance %s: %w", instance.Name, err)
+	}
+
+	httpClient, err := r.instanceClient(ctx, instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up HTTP client of GuacamoleInstance %s: %w", instance.Name, err)
+	}
+
+	target := &GuacamoleTarget{
+		Name:       instance.Name,
+		BaseURL:    instance.Spec.URL,
+		Username:   string(credentials.Data[usernameSecretKey]),
+		Password:   string(credentials.Data[passwordSecretKey]),
+		DataSource: instance.Spec.DataSource,
+		HTTPClient: httpClient,
+	}
+	if auth := instance.Spec.Auth; auth != nil {
+		target.AuthMode = auth.Mode
+		target.AuthHeader = auth.Header
+	}
+	if guacd := instance.Spec.Guacd; guacd != nil {
+		target.GuacdNamespace = guacd.Namespace
+		target.GuacdPodLabels = guacd.PodLabels
+	}
+	if target.AuthMode == AuthModeJSON {
+		if target.JSONSecretKey, err = ParseJSONSecretKey(string(credentials.Data[jsonSecretKeySecretKey])); err != nil {
+			return nil, fmt.Errorf("invalid %s of GuacamoleInstance %s: %w", jsonSecretKeySecretKey, instance.Name, err)
+		}
+	}
+	if target.LinkSecretKey, err = parseLinkSecretKey(credentials.Data, target.AuthMode); err != nil {
+		return nil, fmt.Errorf("invalid credentials of GuacamoleInstance %s: %w", instance.Name, err)
+	}
+	return target, nil
+}
+
+// instanceClient returns the HTTP client of a GuacamoleInstance, building a new one when its TLS settings changed
+func (r *VirtualMachineReconciler) instanceClient(ctx context.Context, instance *kubevirtv1alpha1.GuacamoleInstance) (*http.Client, error) {
+	var material tlsMaterial
+	insecureSkipVerify := false
+	version := instance.ResourceVersion
+	if instance.Spec.TLS != nil {
+		insecureSkipVerify = instance.Spec.TLS.InsecureSkipVerify
+		if ref := instance.Spec.TLS.CASecretRef; ref != nil {
+			secret, err := r.getSecret(ctx, *ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get CA: %w", err)
+			}
+			material.ca = secret.Data[caSecretKey]
+			version += "/" + secret.ResourceVersion
+		}
+		if ref := instance.Spec.TLS.ClientCertSecretRef; ref != nil {
+			secret, err := r.getSecret(ctx, *ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get client certificate: %w", err)
+			}
+			material.cert = secret.Data[corev1.TLSCertKey]
+			material.key = secret.Data[corev1.TLSPrivateKeyKey]
+			version += "/" + secret.ResourceVersion
+		}
+	}
+
+	r.instanceClientsMu.Lock()
+	defer r.instanceClientsMu.Unlock()
+
+	cached, exists := r.instanceClients[instance.Name]
+	if exists && cached.version == version {
+		return cached.client, nil
+	}
+
+	tlsConfig, err := material.tlsConfig(insecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		// Drop connections made with the previous certificates
+		cached.client.CloseIdleConnections()
+	}
+	timeout := 30 * time.Second
+	if r.HTTPClient != nil && r.HTTPClient.Timeout > 0 {
+		timeout = r.HTTPClient.Timeout
+	}
+	httpClient := &http.Client{
+		Timeout:   timeout,
+		Transport: newTLSTransport(tlsConfig),
+	}
+
+	if r.instanceClients == nil {
+		r.instanceClients = make(map[string]instanceHTTPClient)
+	}
+	r.instanceClients[instance.Name] = instanceHTTPClient{version: version, client: httpClient}
+	return httpClient, nil
+}
+
+// getSecret returns the referenced Secret. Secrets are read from the API server rather than the cache, so that
+// the operator neither watches every Secret of the cluster nor depends on the namespaces it caches.
+func (r *VirtualMachineReconciler) getSecret(ctx context.Context, ref kubevirtv1alpha1.SecretReference) (*corev1.Secret, error) {
+	var secret corev1.Secret
+	if err := r.APIReader.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// syncConnection builds the VM's connection, checks that the guest is listening and publishes the
+// connection to every selected instance. It reports false with the result to return when the reconcile
+// has to be retried later.
+func (r *VirtualMachineReconciler) syncConnection(ctx context.Context, vm *kubevirtv1.VirtualMachine, connectionStatus *kubevirtv1alpha1.GuacamoleConnection, targets []*GuacamoleTarget) (ctrl.Result, bool) {
+	logger := log.FromContext(ctx)
+	settings := r.settings()
+
+	// Get VM connection details
+	connection, err := r.buildGuacamoleConnection(ctx, vm)
+	if err != nil {
+		logger.Error(err, "Failed to build Guacamole connection config")
+		observeReconcile(ReconcileFailed)
+		return r.retryLater(ctx, vm, connectionStatus, err), false
+	}
+
+	// Only publish the connection once the guest answers on its remote-desktop port
+	if ready := r.checkGuestReady(ctx, vm, connectionStatus, connection); !ready {
+		observeReconcile(ReconcileWaitingForGuest)
+		return ctrl.Result{RequeueAfter: settings.guestProbeRetryDelay}, false
+	}
+
+	if err := r.publishConnection(ctx, vm, connectionStatus, targets, connection); err != nil {
+		logger.Error(err, "Failed to publish Guacamole connection")
+		// Back off per VM instead of using controller-runtime's rate limiter, whose failures are not per cause
+		observeReconcile(ReconcileFailed)
+		return r.retryLater(ctx, vm, connectionStatus, err), false
+	}
+
+	if err := r.markConnectionReady(ctx, connectionStatus, connection, settings.revision, connectionHash(vm, connection)); err != nil {
+		logger.Error(err, "Failed to update connection status")
+	}
+	r.resetRetries(ctx, vm, connectionStatus)
+	return ctrl.Result{}, true
+}
+
+// publishConnection creates or updates the connection in every target and records its identifiers in the
+// status object. Instances are synced independently: one failing does not keep the connection from the
+// others, its error is returned once every instance was tried.
+func (r *VirtualMachineReconciler) publishConnection(ctx context.Context, vm *kubevirtv1.VirtualMachine, connectionStatus *kubevirtv1alpha1.GuacamoleConnection, targets []*GuacamoleTarget, connection *GuacamoleConnection) error {
+	logger := log.FromContext(ctx)
+
+	patch := client.MergeFrom(connectionStatus.DeepCopy())
+	var errs []error
+	for _, target := range targets {
+		authResp, err := r.authenticateWithGuacamole(ctx, target)
+		if err != nil {
+			r.recordEvent(vm, corev1.EventTypeWarning, EventAuthenticationFailed,
+				"Failed to log in to Guacamole instance %s: %v", target.Name, err)
+			errs = append(errs, fmt.Errorf("instance %s: failed to authenticate: %w", target.Name, err))
+			continue
+		}
+
+		// Adopt a connection left by an earlier attempt instead of creating a duplicate
+		connectionID, err := r.findGuacamoleConnectionID(ctx, authResp, connection.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("instance %s: %w", target.Name, err))
+			continue
+		}
+
+		if connectionID == "" {
+			// ConnectionID is Guacamole's unique identifier for the created connection
+			connectionID, err = r.createGuacamoleConnection(ctx, authResp, vm, connection)
+			if err != nil {
+				// Explain a failure caused by a data source that cannot hold connections
+				if checkErr := r.checkConnectionManagement(ctx, authResp); errors.Is(checkErr, ErrConnectionManagementUnsupported) {
+					err = checkErr
+				}
+				// The connection may exist after all, e.g. created by someone else since the index was built
+				r.connectionIndex(target.Name).invalidate()
+				r.recordEvent(vm, corev1.EventTypeWarning, EventConnectionFailed,
+					"Failed to create Guacamole connection %s in instance %s: %v", connection.Name, target.Name, err)
+				errs = append(errs, fmt.Errorf("instance %s: %w", target.Name, err))
+				continue
+			}
+			r.recordEvent(vm, corev1.EventTypeNormal, EventConnectionCreated,
+				"Created %s connection %s in Guacamole instance %s", connection.Protocol, connection.Name, target.Name)
+		} else {
+			if err := r.doGuacamoleRequest(ctx, authResp, "PUT", "connections/"+url.PathEscape(connectionID), connection, nil); err != nil {
+				// The index may point at a connection deleted outside the operator
+				r.connectionIndex(target.Name).invalidate()
+				r.recordEvent(vm, corev1.EventTypeWarning, EventConnectionFailed,
+					"Failed to update Guacamole connection %s in instance %s: %v", connection.Name, target.Name, err)
+				errs = append(errs, fmt.Errorf("instance %s: failed to update connection: %w", target.Name, err))
+				continue
+			}
+			r.recordEvent(vm, corev1.EventTypeNormal, EventConnectionUpdated,
+				"Updated Guacamole connection %s in instance %s to %s:%s",
+				connection.Name, target.Name, connection.Parameters["hostname"], connection.Parameters["port"])
+		}
+
+		published := setInstanceConnection(&connectionStatus.Status.Instances, target.Name, connectionID)
+
+		// The connection is usable without its sharing profiles, but a failure is retried like any other
+		variants, groups, err := r.reconcileSharingProfiles(ctx, authResp, vm, *published)
+		if err != nil {
+			logger.Error(err, "Failed to set up Guacamole sharing profiles", "instance", target.Name, "connection_id", connectionID)
+			errs = append(errs, fmt.Errorf("instance %s: %w", target.Name, err))
+			continue
+		}
+		published.SharingProfiles, published.ObserverGroups = variants, groups
+	}
+
+	if err := r.Status().Patch(ctx, connectionStatus, patch); err != nil {
+		errs = append(errs, fmt.Errorf("failed to update GuacamoleConnection status: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// unpublishDeselected deletes the connection from the instances recorded in the status object
+// that are no longer selected for the VM
+func (r *VirtualMachineReconciler) unpublishDeselected(ctx context.Context, vm *kubevirtv1.VirtualMachine, connectionStatus *kubevirtv1alpha1.GuacamoleConnection, targets []*GuacamoleTarget) error {
+	logger := log.FromContext(ctx)
+
+	patch := client.MergeFrom(connectionStatus.DeepCopy())
+	connectionName := fmt.Sprintf("%s-%s", vm.Namespace, vm.Name)
+	var errs []error
+	kept := connectionStatus.Status.Instances[:0:0]
+	for _, published := range connectionStatus.Status.Instances {
+		if slices.ContainsFunc(targets, func(t *GuacamoleTarget) bool { return t.Name == published.Instance }) {
+			kept = append(kept, published)
+			continue
+		}
+
+		target, err := r.guacamoleTarget(ctx, published.Instance)
+		if client.IgnoreNotFound(err) != nil {
+			// The instance still exists but cannot be used right now
+			errs = append(errs, err)
+			kept = append(kept, published)
+			continue
+		}
+		if target != nil {
+			if err := r.deleteGuacamoleConnectionByName(ctx, target, connectionName); err != nil {
+				errs = append(errs, fmt.Errorf("instance %s: %w", target.Name, err))
+				kept = append(kept, published)
+				continue
+			}
+		}
+		logger.Info("Removed connection from deselected Guacamole instance", "vm", vm.Name, "instance", published.Instance)
+		r.recordEvent(vm, corev1.EventTypeNormal, EventConnectionDeleted,
+			"Deleted Guacamole connection %s from deselected instance %s", connectionName, published.Instance)
+	}
+
+	if len(kept) == len(connectionStatus.Status.Instances) {
+		return errors.Join(errs...)
+	}
+	connectionStatus.Status.Instances = kept
+	if err := r.Status().Patch(ctx, connectionStatus, patch); err != nil {
+		errs = append(errs, fmt.Errorf("failed to update GuacamoleConnection status: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// missingInstances reports whether a selected instance has no connection recorded yet
+func missingInstances(connectionStatus *kubevirtv1alpha1.GuacamoleConnection, targets []*GuacamoleTarget) bool {
+	for _, target := range targets {
+		if !slices.ContainsFunc(connectionStatus.Status.Instances, func(published kubevirtv1alpha1.GuacamoleInstanceConnection) bool {
+			return published.Instance == target.Name
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+// setInstanceConnection records the connection identifier of an instance and returns its entry. The sharing
+// state of an entry whose connection was replaced is dropped, since it applied to the old connection.
+func setInstanceConnection(instances *[]kubevirtv1alpha1.GuacamoleInstanceConnection, instance, connectionID string) *kubevirtv1alpha1.GuacamoleInstanceConnection {
+	for i := range *instances {
+		published := &(*instances)[i]
+		if published.Instance == instance {
+			if published.ConnectionIdentifier != connectionID {
+				published.ConnectionIdentifier = connectionID
+				published.SharingProfiles, published.ObserverGroups = nil, nil
+			}
+			return published
+		}
+	}
+	*instances = append(*instances, kubevirtv1alpha1.GuacamoleInstanceConnection{
+		Instance:             instance,
+		ConnectionIdentifier: connectionID,
+	})
+	return &(*instances)[len(*instances)-1]
+}
+
+// connectionTargets returns the instances selected for the VM together with those its connection was
+// published to, for cleanup
+func (r *VirtualMachineReconciler) connectionTargets(ctx context.Context, vm *kubevirtv1.VirtualMachine) ([]*GuacamoleTarget, error) {
+	var errs []error
+	targets, err := r.guacamoleTargetsFor(ctx, vm)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	var connectionStatus kubevirtv1alpha1.GuacamoleConnection
+	if err := r.Get(ctx, client.ObjectKeyFromObject(vm), &connectionStatus); client.IgnoreNotFound(err) != nil {
+		errs = append(errs, fmt.Errorf("failed to get GuacamoleConnection: %w", err))
+	}
+	for _, published := range connectionStatus.Status.Instances {
+		if slices.ContainsFunc(targets, func(t *GuacamoleTarget) bool { return t.Name == published.Instance }) {
+			continue
+		}
+		target, err := r.guacamoleTarget(ctx, published.Instance)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets, errors.Join(errs...)
+}
+
+// instanceNames returns the names of the targets, for logging
+func instanceNames(targets []*GuacamoleTarget) []string {
+	names := make([]string, 0, len(targets))
+	for _, target := range targets {
+		names = append(names, target.Name)
+	}
+	return names
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+// newTestScheme returns a scheme with every type the operator reads or writes
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, kubevirtv1.AddToScheme, kubevirtv1alpha1.AddToScheme} {
+		if err := add(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return scheme
+}
+
+func TestInstanceTargetReadsSecretsFromAPIServer(t *testing.T) {
+	const linkKey = "000102030405060708090a0b0c0d0e0f"
+	tests := []struct {
+		name     string
+		auth     *kubevirtv1alpha1.GuacamoleInstanceAuth
+		guacd    *kubevirtv1alpha1.GuacdSelector
+		data     map[string][]byte
+		noSecret bool
+		wantErr  bool
+		wantLink bool
+	}{
+		{name: "password", data: map[string][]byte{usernameSecretKey: []byte("guacadmin"), passwordSecretKey: []byte("secret")}},
+		{
+			name:     "password with link key",
+			data:     map[string][]byte{usernameSecretKey: []byte("guacadmin"), passwordSecretKey: []byte("secret"), linkSecretKeySecretKey: []byte(linkKey)},
+			wantLink: true,
+		},
+		{
+			name: "json",
+			auth: &kubevirtv1alpha1.GuacamoleInstanceAuth{Mode: AuthModeJSON},
+			data: map[string][]byte{usernameSecretKey: []byte("guacadmin"), jsonSecretKeySecretKey: []byte(linkKey)},
+		},
+		{
+			name:  "guacd selector",
+			guacd: &kubevirtv1alpha1.GuacdSelector{Namespace: "guacamole-staff", PodLabels: map[string]string{"app": "guacd-staff"}},
+			data:  map[string][]byte{usernameSecretKey: []byte("guacadmin"), passwordSecretKey: []byte("secret")},
+		},
+		{name: "json without secret key", auth: &kubevirtv1alpha1.GuacamoleInstanceAuth{Mode: AuthModeJSON}, data: map[string][]byte{usernameSecretKey: []byte("guacadmin")}, wantErr: true},
+		{name: "missing Secret", noSecret: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := newTestScheme(t)
+			var objects []client.Object
+			if !tt.noSecret {
+				objects = append(objects, &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "staff-guacamole", Namespace: "guacamole-staff"},
+					Data:       tt.data,
+				})
+			}
+			r := &VirtualMachineReconciler{
+				// The cache holds no Secrets: reading them through it would fail
+				Client:    fake.NewClientBuilder().WithScheme(scheme).Build(),
+				APIReader: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+				Scheme:    scheme,
+			}
+			instance := &kubevirtv1alpha1.GuacamoleInstance{
+				ObjectMeta: metav1.ObjectMeta{Name: "staff"},
+				Spec: kubevirtv1alpha1.GuacamoleInstanceSpec{
+					URL:                  "https://staff.example.com/guacamole",
+					CredentialsSecretRef: kubevirtv1alpha1.SecretReference{Name: "staff-guacamole", Namespace: "guacamole-staff"},
+					Auth:                 tt.auth,
+					Guacd:                tt.guacd,
+				},
+			}
+
+			target, err := r.instanceTarget(context.Background(), instance)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("instanceTarget error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if target.Name != "staff" || target.BaseURL != instance.Spec.URL || target.Username != "guacadmin" {
+				t.Errorf("target = %+v, want the staff instance logging in as guacadmin", target)
+			}
+			if target.Password != string(tt.data[passwordSecretKey]) {
+				t.Errorf("password = %q, want %q", target.Password, tt.data[passwordSecretKey])
+			}
+			if (len(target.LinkSecretKey) > 0) != tt.wantLink {
+				t.Errorf("link secret key = %x, want key %v", target.LinkSecretKey, tt.wantLink)
+			}
+			if tt.guacd != nil && (target.GuacdNamespace != tt.guacd.Namespace || !reflect.DeepEqual(target.GuacdPodLabels, tt.guacd.PodLabels)) {
+				t.Errorf("guacd = %s %v, want %+v", target.GuacdNamespace, target.GuacdPodLabels, tt.guacd)
+			}
+			if tt.guacd == nil && target.GuacdNamespace != "" {
+				t.Errorf("guacd namespace = %q, want the operator's", target.GuacdNamespace)
+			}
+		})
+	}
+}
@@ -17,20 +17,30 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	corev1 "k8s.io/api/core/v1"
 	kubevirtv1 "kubevirt.io/api/core/v1"
@@ -39,24 +49,101 @@ import (
 const (
 	// Finalizer to ensure proper cleanup
 	VMWatcherFinalizer = "vm-watcher.setofangdar.polito.it/finalizer"
-	// Annotation to track if we've already processed this VM
+	// Annotation earlier versions set once the VM was processed, now the published field of the GuacamoleConnection status
 	ProcessedAnnotation = "vm-watcher.setofangdar.polito.it/processed"
-	// Annotation to track the last known status
+	// Annotation earlier versions used for the last known status, now the observedVMStatus field of the GuacamoleConnection status
 	LastStatusAnnotation = "vm-watcher.setofangdar.polito.it/last-status"
-	// Default retry delay
+	// Default retry delay, doubled after every consecutive failure
 	DefaultRetryDelay = 2 * time.Minute
-	// Maximum retry attempts
+	// Consecutive failures after which a connection is reported Degraded
 	MaxRetryAttempts = 3
+	// Default number of VMs reconciled in parallel
+	DefaultMaxConcurrentReconciles = 2
 )
 
 // VirtualMachineReconciler reconciles KubeVirt VirtualMachine objects
 type VirtualMachineReconciler struct {
 	client.Client
-	Scheme            *runtime.Scheme
-	GuacamoleBaseURL  string // Base URL of Guacamole (e.g., https://guacamole.example.com)
-	GuacamoleUsername string // Guacamole admin username
-	GuacamolePassword string // Guacamole admin password
-	HTTPClient        *http.Client
+	APIReader           client.Reader // Uncached reader for the Secrets of GuacamoleInstances, which are not cached
+	Scheme              *runtime.Scheme
+	GuacamoleBaseURL    string                // Base URL of Guacamole (e.g., https://guacamole.example.com)
+	GuacamoleUsername   string                // Guacamole admin username
+	GuacamolePassword   string                // Guacamole admin password
+	GuacamoleAuthMode   string                // password, json or header
+	GuacamoleAuthHeader string                // Header carrying the username in header auth mode
+	Credentials         *GuacamoleCredentials // Rotating admin credentials, replacing GuacamoleUsername and GuacamolePassword when set
+	GuacamoleDataSource string                // Data source connections are written to; empty uses the one returned at login
+	HTTPClient          *http.Client
+	SharingProfiles     []string // Default sharing profile variants created for each connection
+	ObserverGroups      []string // Default Guacamole user groups granted the sharing profiles
+	// Session recording defaults, overridable per namespace or VM with the recording annotation
+	RecordingEnabled      bool
+	RecordingPath         string // Recording directory as mounted inside guacd
+	RecordingNameTemplate string
+	// Guest readiness probing before a connection is published
+	GuestProbeMode    string // tcp, handshake or none; overridable per VM with the guest-probe annotation
+	GuestProbeTimeout time.Duration
+	Recorder          record.EventRecorder
+	// Default VMI address selection, overridable per VM with the network, ip-family and allowed-cidrs annotations
+	Network      string
+	IPFamily     string
+	AllowedCIDRs []netip.Prefix
+	// Service created for each VM (none, clusterip or headless), overridable per VM with the service annotation
+	ServiceMode string
+	// NetworkPolicy restricting each VM's remote-desktop port to guacd, overridable per VM with the network-policy annotation
+	NetworkPolicyEnabled bool
+	GuacdNamespace       string
+	GuacdPodLabels       map[string]string
+	OperatorNamespace    string // Namespace of the operator pods, allowed to probe guests; empty when running outside the cluster
+	OperatorPodLabels    map[string]string
+	// Circuit breaker pausing the requests to an unhealthy Guacamole instance, disabled with a zero threshold
+	CircuitBreakerThreshold    int
+	CircuitBreakerOpenDuration time.Duration
+	CircuitBreakerRampDuration time.Duration
+	// What happens to a deleted VM whose connection cannot be deleted, overridable per VM with the deletion-policy annotation
+	DeletionPolicy  string          // best-effort, block or tombstone
+	DeletionTimeout time.Duration   // How long the finalizer is kept at most
+	Tombstones      *TombstoneStore // Connections left to delete once their instance is reachable; nil disables tombstones
+	// Client-side rate limit per Guacamole instance, disabled with a zero QPS
+	GuacamoleQPS   float64
+	GuacamoleBurst int
+	// Connection writes sent together as one JSON Patch request per instance, disabled with a zero window
+	ConnectionBatchWindow time.Duration
+	ConnectionBatchSize   int
+	// Age after which the connection index of an instance is rebuilt from a full list
+	ConnectionIndexRefreshInterval time.Duration
+	// Number of VMs reconciled in parallel
+	MaxConcurrentReconciles int
+	// Namespaces the manager caches, empty for every namespace; connections of other namespaces are never orphans
+	WatchNamespaces []string
+
+	// HTTP clients of the GuacamoleInstances, by instance name
+	instanceClientsMu sync.Mutex
+	instanceClients   map[string]instanceHTTPClient
+	// Admin auth tokens reused across requests, by instance name
+	tokensMu sync.Mutex
+	tokens   map[string]cachedToken
+	// Circuit breakers, by instance name
+	breakersMu sync.Mutex
+	breakers   map[string]*circuitBreaker
+	// Rate limiters, by instance name
+	limitersMu sync.Mutex
+	limiters   map[string]flowcontrol.RateLimiter
+	// Connection write batchers, by instance name
+	batchersMu sync.Mutex
+	batchers   map[string]*connectionBatcher
+	// Connection name indexes, by instance name
+	connectionIndexesMu sync.Mutex
+	connectionIndexes   map[string]*connectionIndex
+	// Consecutive failures to sync each VM's connection
+	retriesMu sync.Mutex
+	retries   map[types.NamespacedName]int
+
+	// Settings from the operator ConfigMap, nil until one is loaded
+	currentSettings atomic.Pointer[operatorSettings]
+	// VMs queued for a new configuration, and closed once this replica leads
+	resync  chan event.GenericEvent
+	elected <-chan struct{}
 }
 
 // GuacamoleAuthResponse represents the authentication response from Guacamole
@@ -65,6 +152,8 @@ type GuacamoleAuthResponse struct {
 	Username             string   `json:"username"`
 	DataSource           string   `json:"dataSource"`
 	AvailableDataSources []string `json:"availableDataSources"`
+
+	target *GuacamoleTarget // Instance the token was issued by
 }
 
 // GuacamoleConnection represents a Guacamole connection configuration
@@ -89,7 +178,14 @@ type GuacamoleConnectionResponse struct {
 // +kubebuilder:rbac:groups=kubevirt.io,resources=virtualmachines,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=kubevirt.io,resources=virtualmachines/status,verbs=get
 // +kubebuilder:rbac:groups=kubevirt.io,resources=virtualmachineinstances,verbs=get;list;watch
-// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=kubevirt.setofangdar.polito.it,resources=guacamoleconnections,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=kubevirt.setofangdar.polito.it,resources=guacamoleconnections/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=kubevirt.setofangdar.polito.it,resources=guacamoleinstances,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get
 
 func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
@@ -111,22 +207,67 @@ func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		return r.handleDeletion(ctx, &vm)
 	}
 
+	// VMs outside the configured selector are left alone; a VM deselected after its connection was published
+	// keeps its connection, Service and NetworkPolicy until it is deleted
+	settings := r.settings()
+	if !settings.selects(&vm) {
+		logger.V(1).Info("VM not selected by the operator configuration, skipping", "name", vm.Name, "namespace", vm.Namespace)
+		return ctrl.Result{}, nil
+	}
+
 	// Add finalizer if not present
 	if !controllerutil.ContainsFinalizer(&vm, VMWatcherFinalizer) {
-		controllerutil.AddFinalizer(&vm, VMWatcherFinalizer)
-		if err := r.Update(ctx, &vm); err != nil {
+		if err := r.addFinalizer(ctx, &vm); err != nil {
 			logger.Error(err, "Failed to add finalizer")
+			observeReconcile(ReconcileFailed)
 			return ctrl.Result{}, err
 		}
 		return ctrl.Result{Requeue: true}, nil
 	}
 
+	// Get or create the status object reporting the state of the connection
+	connectionStatus, err := r.ensureConnectionStatus(ctx, &vm)
+	if err != nil {
+		logger.Error(err, "Failed to ensure GuacamoleConnection status object")
+		observeReconcile(ReconcileFailed)
+		return ctrl.Result{}, err
+	}
+
+	// VMs processed by earlier versions carry the connection state in annotations
+	if err := r.adoptLegacyState(ctx, &vm, connectionStatus); err != nil {
+		logger.Error(err, "Failed to adopt connection state from VM annotations")
+		observeReconcile(ReconcileFailed)
+		return ctrl.Result{}, err
+	}
+
+	// Keep the VM's Service in line with its remote-desktop port when the operator manages one
+	if err := r.reconcileVMService(ctx, &vm); err != nil {
+		logger.Error(err, "Failed to reconcile VM Service")
+		observeReconcile(ReconcileFailed)
+		return ctrl.Result{}, err
+	}
+
+	// Guacamole instances the connection is published to
+	targets, err := r.guacamoleTargetsFor(ctx, &vm)
+	if err != nil {
+		logger.Error(err, "Failed to resolve Guacamole instances")
+		observeReconcile(ReconcileFailed)
+		return r.retryLater(ctx, &vm, connectionStatus, err), nil
+	}
+
+	// Restrict the remote-desktop port to the guacd pods of those instances when the VM is protected by a NetworkPolicy
+	if err := r.reconcileNetworkPolicy(ctx, &vm, targets); err != nil {
+		logger.Error(err, "Failed to reconcile VM NetworkPolicy")
+		observeReconcile(ReconcileFailed)
+		return ctrl.Result{}, err
+	}
+
 	// Check if this is a new VM that we haven't processed yet
-	isNewVM := vm.Annotations[ProcessedAnnotation] != "true"
+	isNewVM := !connectionStatus.Status.Published
 
 	// Check if status has changed
 	currentStatus := string(vm.Status.PrintableStatus)
-	lastStatus := vm.Annotations[LastStatusAnnotation]
+	lastStatus := connectionStatus.Status.ObservedVMStatus
 	statusChanged := lastStatus != "" && lastStatus != currentStatus
 
 	if isNewVM {
@@ -135,53 +276,92 @@ func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		// Wait for VM to be running before creating Guacamole connection
 		if vm.Status.PrintableStatus != kubevirtv1.VirtualMachineStatusRunning {
 			logger.Info("VM not yet running, waiting", "name", vm.Name, "status", vm.Status.PrintableStatus)
-			return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+			if _, err := r.setReadyCondition(ctx, connectionStatus, metav1.ConditionFalse, ReasonWaitingForRunning,
+				fmt.Sprintf("VM is %s", vm.Status.PrintableStatus)); err != nil {
+				logger.Error(err, "Failed to update connection status")
+			}
+			observeReconcile(ReconcileWaitingForRunning)
+			return ctrl.Result{RequeueAfter: settings.waitingForRunningDelay}, nil
 		}
 
-		// Create Guacamole connection
-		// ConnectionID is Guacamole's unique identifier for the created connection
-		_, err := r.createGuacamoleConnection(ctx, &vm)
-		if err != nil {
-			logger.Error(err, "Failed to create Guacamole connection")
-			// Instead of controlled controller-runtime's exponential backoff, use retry timing for external API failures
-			return ctrl.Result{RequeueAfter: DefaultRetryDelay}, nil
+		// Create the Guacamole connection in every selected instance once the guest is listening
+		if result, done := r.syncConnection(ctx, &vm, connectionStatus, targets); !done {
+			return result, nil
 		}
 
 		// Mark as processed
-		if vm.Annotations == nil {
-			vm.Annotations = make(map[string]string)
-		}
-		vm.Annotations[ProcessedAnnotation] = "true"
-		vm.Annotations[LastStatusAnnotation] = currentStatus
-		if err := r.Update(ctx, &vm); err != nil {
-			logger.Error(err, "Failed to update processed annotation")
+		if err := r.recordSyncedStatus(ctx, connectionStatus, currentStatus); err != nil {
+			logger.Error(err, "Failed to record published connection")
+			observeReconcile(ReconcileFailed)
 			return ctrl.Result{}, err
 		}
+		observeReconcile(ReconcileCreated)
 
 		logger.Info("Successfully created Guacamole connection",
 			"vm", vm.Name,
-			"namespace", vm.Namespace)
+			"namespace", vm.Namespace,
+			"instances", instanceNames(targets))
 	} else if statusChanged {
 		logger.Info("VM status changed", "name", vm.Name, "old_status", lastStatus, "new_status", currentStatus)
 
 		// Handle status changes
 		if currentStatus == string(kubevirtv1.VirtualMachineStatusStopped) {
-			// VM stopped, connection may need to be disabled
-			logger.Info("VM stopped, connection may need to be disabled", "vm", vm.Name)
+			// VM stopped, the connection stays but is no longer usable
+			logger.Info("VM stopped, marking connection not ready", "vm", vm.Name)
+			if _, err := r.setReadyCondition(ctx, connectionStatus, metav1.ConditionFalse, ReasonVMNotRunning, "VM is Stopped"); err != nil {
+				logger.Error(err, "Failed to update connection status")
+			}
 		} else if currentStatus == string(kubevirtv1.VirtualMachineStatusRunning) {
-			// VM restarted, update connection if needed
-			logger.Info("VM restarted, connection may need to be updated", "vm", vm.Name)
+			// VM restarted, its address may have changed
+			logger.Info("VM restarted, updating connection", "vm", vm.Name)
+			// The last status is only recorded once the connection is updated, so this branch runs again until then
+			if result, done := r.syncConnection(ctx, &vm, connectionStatus, targets); !done {
+				return result, nil
+			}
+			observeReconcile(ReconcileUpdated)
 		}
 
 		// Update last status
-		if vm.Annotations == nil {
-			vm.Annotations = make(map[string]string)
-		}
-		vm.Annotations[LastStatusAnnotation] = currentStatus
-		if err := r.Update(ctx, &vm); err != nil {
-			logger.Error(err, "Failed to update last status annotation")
+		if err := r.recordSyncedStatus(ctx, connectionStatus, currentStatus); err != nil {
+			logger.Error(err, "Failed to record last VM status")
+			observeReconcile(ReconcileFailed)
 			return ctrl.Result{}, err
 		}
+	} else if currentStatus == string(kubevirtv1.VirtualMachineStatusRunning) && missingInstances(connectionStatus, targets) {
+		// Instances were selected after the connection was published
+		logger.Info("Guacamole instance selection changed, publishing connection", "vm", vm.Name, "instances", instanceNames(targets))
+		if result, done := r.syncConnection(ctx, &vm, connectionStatus, targets); !done {
+			return result, nil
+		}
+		observeReconcile(ReconcileUpdated)
+	} else if currentStatus == string(kubevirtv1.VirtualMachineStatusRunning) && r.sharingOutdated(ctx, &vm, connectionStatus) {
+		// The sharing profiles or observer groups of the VM changed, or setting them up failed
+		logger.Info("Sharing profiles changed, updating connection", "vm", vm.Name)
+		if result, done := r.syncConnection(ctx, &vm, connectionStatus, targets); !done {
+			return result, nil
+		}
+		observeReconcile(ReconcileUpdated)
+	} else if currentStatus == string(kubevirtv1.VirtualMachineStatusRunning) && r.configOutdated(connectionStatus) {
+		// The operator configuration changed since the connection was published
+		logger.Info("Operator configuration changed, updating connection", "vm", vm.Name)
+		if result, done := r.syncConnection(ctx, &vm, connectionStatus, targets); !done {
+			return result, nil
+		}
+		observeReconcile(ReconcileUpdated)
+	} else if currentStatus == string(kubevirtv1.VirtualMachineStatusRunning) && r.connectionOutdated(ctx, &vm, connectionStatus) {
+		// The per-VM settings changed, or the VM's address changed while it kept running
+		logger.Info("Connection settings changed, updating connection", "vm", vm.Name)
+		if result, done := r.syncConnection(ctx, &vm, connectionStatus, targets); !done {
+			return result, nil
+		}
+		observeReconcile(ReconcileUpdated)
+	}
+
+	// Instances no longer selected lose the connection
+	if err := r.unpublishDeselected(ctx, &vm, connectionStatus, targets); err != nil {
+		logger.Error(err, "Failed to remove connection from deselected Guacamole instances")
+		observeReconcile(ReconcileFailed)
+		return r.retryLater(ctx, &vm, connectionStatus, err), nil
 	}
 
 	return ctrl.Result{}, nil
@@ -195,58 +375,88 @@ func (r *VirtualMachineReconciler) handleDeletion(ctx context.Context, vm *kubev
 	// Always try to delete by name first (most reliable approach)
 	connectionName := fmt.Sprintf("%s-%s", vm.Namespace, vm.Name)
 	logger.Info("Deleting Guacamole connection by name", "connection_name", connectionName)
-	
-	if err := r.deleteGuacamoleConnectionByName(ctx, connectionName); err != nil {
-		logger.Error(err, "Failed to delete Guacamole connection", "connection_name", connectionName)
-		// Don't fail the deletion - log and continue
+
+	// Delete from every instance the connection may have been published to
+	targets, resolveErr := r.connectionTargets(ctx, vm)
+	if resolveErr != nil {
+		logger.Error(resolveErr, "Failed to resolve some Guacamole instances", "connection_name", connectionName)
+	}
+	var failed []*GuacamoleTarget
+	var errs []error
+	for _, target := range targets {
+		if err := r.deleteGuacamoleConnectionByName(ctx, target, connectionName); err != nil {
+			logger.Error(err, "Failed to delete Guacamole connection", "connection_name", connectionName, "instance", target.Name)
+			failed = append(failed, target)
+			errs = append(errs, fmt.Errorf("instance %s: %w", target.Name, err))
+			continue
+		}
+		r.recordEvent(vm, corev1.EventTypeNormal, EventConnectionDeleted,
+			"Deleted Guacamole connection %s from instance %s", connectionName, target.Name)
+	}
+
+	// The deletion policy decides whether the finalizer waits for the instances that failed
+	if (len(failed) > 0 || resolveErr != nil) && r.handleFailedCleanup(ctx, vm, connectionName, failed, resolveErr) {
+		logger.Info("Keeping finalizer until the Guacamole connection is deleted", "connection_name", connectionName,
+			"instances", instanceNames(failed))
+		observeReconcile(ReconcileFailed)
+		result := r.retryLater(ctx, vm, nil, errors.Join(append(errs, resolveErr)...))
+		// Come back when the deletion timeout passes rather than a full backoff period later
+		if left := r.deletionTimeLeft(vm); left > 0 && result.RequeueAfter > left {
+			result.RequeueAfter = left
+		}
+		return result, nil
 	}
 
+	// The NetworkPolicy is owned by the VM, but remove it with the connection rather than waiting for garbage collection
+	if err := r.deleteNetworkPolicy(ctx, vm); err != nil {
+		logger.Error(err, "Failed to delete VM NetworkPolicy")
+	}
+	r.forgetRetries(vm)
+
 	// Remove our finalizer
 	if controllerutil.ContainsFinalizer(vm, VMWatcherFinalizer) {
-		controllerutil.RemoveFinalizer(vm, VMWatcherFinalizer)
-		if err := r.Update(ctx, vm); err != nil {
+		if err := r.removeFinalizer(ctx, vm); err != nil {
 			logger.Error(err, "Failed to remove finalizer")
+			observeReconcile(ReconcileFailed)
 			return ctrl.Result{}, err
 		}
 		logger.Info("Successfully removed finalizer", "name", vm.Name, "namespace", vm.Namespace)
 	}
 
+	observeReconcile(ReconcileDeleted)
 	logger.Info("Successfully handled VM deletion", "name", vm.Name, "namespace", vm.Namespace)
 	return ctrl.Result{}, nil
 }
 
-// authenticateWithGuacamole gets an authentication token from Guacamole
-func (r *VirtualMachineReconciler) authenticateWithGuacamole(ctx context.Context) (*GuacamoleAuthResponse, error) {
-	if r.GuacamoleBaseURL == "" {
+// authenticateWithGuacamole gets an authentication token from a Guacamole instance
+func (r *VirtualMachineReconciler) authenticateWithGuacamole(ctx context.Context, target *GuacamoleTarget) (*GuacamoleAuthResponse, error) {
+	if target == nil || target.BaseURL == "" {
 		return nil, fmt.Errorf("guacamole base url not configured")
 	}
 
-	authURL := fmt.Sprintf("%s/api/tokens", strings.TrimSuffix(r.GuacamoleBaseURL, "/"))
-
-	// Prepare form data
-	data := url.Values{}
-	data.Set("username", r.GuacamoleUsername)
-	data.Set("password", r.GuacamolePassword)
-
-	req, err := http.NewRequestWithContext(ctx, "POST", authURL, strings.NewReader(data.Encode()))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create auth request: %w", err)
+	// Reuse the token of an earlier login, revoking one issued for credentials that have since rotated
+	cached, stale := r.cachedToken(target)
+	if stale != nil {
+		r.revokeToken(ctx, stale)
+	}
+	if cached != nil {
+		return cached, nil
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	client := r.HTTPClient
-	if client == nil {
-		client = &http.Client{Timeout: 30 * time.Second}
+	req, err := target.loginRequest(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := r.sendGuacamoleRequest(target, req)
 	if err != nil {
+		authFailures.WithLabelValues(target.Name).Inc()
 		return nil, fmt.Errorf("failed to authenticate with Guacamole: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		authFailures.WithLabelValues(target.Name).Inc()
 		return nil, fmt.Errorf("authentication failed with status %d", resp.StatusCode)
 	}
 
@@ -254,117 +464,157 @@ func (r *VirtualMachineReconciler) authenticateWithGuacamole(ctx context.Context
 	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
 		return nil, fmt.Errorf("failed to decode auth response: %w", err)
 	}
+	authResp.target = target
+	if err := selectDataSource(&authResp, target); err != nil {
+		return nil, err
+	}
+	r.storeToken(target, &authResp)
 
 	return &authResp, nil
 }
 
-// createGuacamoleConnection creates a new connection in Guacamole for the VM
-func (r *VirtualMachineReconciler) createGuacamoleConnection(ctx context.Context, vm *kubevirtv1.VirtualMachine) (string, error) {
-	logger := log.FromContext(ctx)
+// guacamoleAPIError is returned by doGuacamoleRequest when Guacamole answers with an error status
+type guacamoleAPIError struct {
+	method     string
+	path       string
+	statusCode int
+	body       string
+}
 
-	// Authenticate with Guacamole
-	authResp, err := r.authenticateWithGuacamole(ctx)
-	if err != nil {
-		return "", fmt.Errorf("failed to authenticate: %w", err)
-	}
+func (e *guacamoleAPIError) Error() string {
+	return fmt.Sprintf("%s %s failed with status %d: %s", e.method, e.path, e.statusCode, e.body)
+}
 
-	// Get VM connection details
-	connection, err := r.buildGuacamoleConnection(ctx, vm)
-	if err != nil {
-		return "", fmt.Errorf("failed to build connection config: %w", err)
+// doGuacamoleRequest sends an authenticated JSON request to the Guacamole REST API.
+// path is relative to the data source (e.g., "connections") and may carry a query string.
+// If out is non-nil the response body is decoded into it.
+func (r *VirtualMachineReconciler) doGuacamoleRequest(ctx context.Context, authResp *GuacamoleAuthResponse, method, path string, in, out interface{}) error {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
 	}
-
-	// Create connection via API
-	createURL := fmt.Sprintf("%s/api/session/data/%s/connections?token=%s",
-		strings.TrimSuffix(r.GuacamoleBaseURL, "/"),
+	requestURL := fmt.Sprintf("%s/api/session/data/%s/%s%stoken=%s",
+		strings.TrimSuffix(authResp.target.BaseURL, "/"),
 		authResp.DataSource,
+		path,
+		separator,
 		authResp.AuthToken)
 
-	body, err := json.Marshal(connection)
+	var body *bytes.Buffer
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewBuffer(data)
+	} else {
+		body = &bytes.Buffer{}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, body)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal connection: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", createURL, bytes.NewBuffer(body))
+	resp, err := r.sendGuacamoleRequest(authResp.target, req)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("%s %s failed: %w", method, path, err)
 	}
+	defer resp.Body.Close()
 
-	req.Header.Set("Content-Type", "application/json")
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		r.checkTokenStatus(authResp, resp.StatusCode)
+		errorBody := make([]byte, 1024)
+		n, _ := resp.Body.Read(errorBody)
+		return &guacamoleAPIError{method: method, path: path, statusCode: resp.StatusCode, body: string(errorBody[:n])}
+	}
 
-	client := r.HTTPClient
-	if client == nil {
-		client = &http.Client{Timeout: 30 * time.Second}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode %s response: %w", path, err)
+		}
 	}
 
-	resp, err := client.Do(req)
+	return nil
+}
+
+// createGuacamoleConnection creates a new connection in Guacamole for the VM
+func (r *VirtualMachineReconciler) createGuacamoleConnection(ctx context.Context, authResp *GuacamoleAuthResponse, vm *kubevirtv1.VirtualMachine, connection *GuacamoleConnection) (string, error) {
+	logger := log.FromContext(ctx)
+
+	// Send the connection together with those of other VMs created at the same time
+	connectionID, err := r.patchConnection(ctx, authResp, jsonPatchOperation{Op: "add", Path: "/", Value: connection})
+	if err == nil && connectionID == "" {
+		connectionID, err = r.findGuacamoleConnectionID(ctx, authResp, connection.Name)
+		if err == nil && connectionID == "" {
+			err = fmt.Errorf("connection %s missing after batched creation", connection.Name)
+		}
+	}
+	if errors.Is(err, errBatchNotApplied) {
+		// The instance does not accept batched writes, create the connection on its own
+		var connResp GuacamoleConnectionResponse
+		err = r.doGuacamoleRequest(ctx, authResp, "POST", "connections", connection, &connResp)
+		connectionID = connResp.Identifier
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to create connection: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return "", fmt.Errorf("connection creation failed with status %d", resp.StatusCode)
+	logger.Info("Successfully created Guacamole connection",
+		"vm", vm.Name,
+		"instance", authResp.target.Name,
+		"connection_id", connectionID,
+		"protocol", connection.Protocol)
+	r.connectionIndex(authResp.target.Name).add(connection.Name, connectionID)
+
+	return connectionID, nil
+}
+
+// updateGuacamoleConnection rebuilds the connection configuration for the VM (e.g., after its IP changed)
+// and replaces the existing Guacamole connection with it
+func (r *VirtualMachineReconciler) updateGuacamoleConnection(ctx context.Context, authResp *GuacamoleAuthResponse, vm *kubevirtv1.VirtualMachine, connectionID string) error {
+	logger := log.FromContext(ctx)
+
+	connection, err := r.buildGuacamoleConnection(ctx, vm)
+	if err != nil {
+		return fmt.Errorf("failed to build connection config: %w", err)
 	}
 
-	var connResp GuacamoleConnectionResponse
-	if err := json.NewDecoder(resp.Body).Decode(&connResp); err != nil {
-		return "", fmt.Errorf("failed to decode connection response: %w", err)
+	if err := r.doGuacamoleRequest(ctx, authResp, "PUT", "connections/"+url.PathEscape(connectionID), connection, nil); err != nil {
+		return fmt.Errorf("failed to update connection: %w", err)
 	}
 
-	logger.Info("Successfully created Guacamole connection",
+	logger.Info("Successfully updated Guacamole connection",
 		"vm", vm.Name,
-		"connection_id", connResp.Identifier,
-		"protocol", connResp.Protocol)
+		"instance", authResp.target.Name,
+		"connection_id", connectionID,
+		"hostname", connection.Parameters["hostname"])
+	r.recordEvent(vm, corev1.EventTypeNormal, EventConnectionUpdated,
+		"Updated Guacamole connection %s in instance %s to %s:%s",
+		connection.Name, authResp.target.Name, connection.Parameters["hostname"], connection.Parameters["port"])
 
-	return connResp.Identifier, nil
+	return nil
 }
 
 // buildGuacamoleConnection builds the connection configuration for Guacamole
 func (r *VirtualMachineReconciler) buildGuacamoleConnection(ctx context.Context, vm *kubevirtv1.VirtualMachine) (*GuacamoleConnection, error) {
 	logger := log.FromContext(ctx)
 
-	// Default to RDP protocol
-	protocol := "rdp"
-	port := "3389"
-
-	// Check for custom protocol in annotations
-	if vm.Annotations != nil {
-		if customProtocol, exists := vm.Annotations["vm-watcher.setofangdar.polito.it/protocol"]; exists {
-			normalizedProtocol := strings.ToLower(customProtocol)
-			// Only allow RDP and VNC protocols
-			if normalizedProtocol == "rdp" || normalizedProtocol == "vnc" {
-				protocol = normalizedProtocol
-			} else {
-				logger.Info("Unsupported protocol specified, defaulting to RDP",
-					"vm", vm.Name,
-					"requestedProtocol", customProtocol,
-					"supportedProtocols", "rdp, vnc")
-			}
-		}
-		if customPort, exists := vm.Annotations["vm-watcher.setofangdar.polito.it/port"]; exists {
-			port = customPort
-		}
-	}
+	protocol, port := r.connectionProtocolAndPort(ctx, vm)
 
-	// Set default ports based on protocol
-	switch protocol {
-	case "vnc":
-		if port == "3389" { // If still default RDP port
-			port = "5900"
-		}
-	case "rdp":
-		if port == "5900" { // If still default VNC port
-			port = "3389"
+	// Use the stable name of the VM's Service when the operator manages one, else the VM IP address
+	hostname := r.vmServiceHostname(vm)
+	if hostname == "" {
+		var err error
+		hostname, err = r.getVMHostname(ctx, vm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get VM hostname: %w", err)
 		}
 	}
 
-	// Get VM IP address
-	hostname, err := r.getVMHostname(ctx, vm)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get VM hostname: %w", err)
-	}
-
 	// Build connection name
 	connectionName := fmt.Sprintf("%s-%s", vm.Namespace, vm.Name)
 
@@ -415,9 +665,34 @@ func (r *VirtualMachineReconciler) buildGuacamoleConnection(ctx context.Context,
 			}
 		}
 
+	case "ssh":
+		// Add SSH credentials if provided
+		if vm.Annotations != nil {
+			if username, exists := vm.Annotations["vm-watcher.setofangdar.polito.it/username"]; exists {
+				parameters["username"] = username
+			}
+			if password, exists := vm.Annotations["vm-watcher.setofangdar.polito.it/password"]; exists {
+				parameters["password"] = password
+			}
+		}
+
 	default:
 		// This should not happen due to validation above, but handle gracefully
-		return nil, fmt.Errorf("unsupported protocol '%s', only 'rdp' and 'vnc' are supported", protocol)
+		return nil, fmt.Errorf("unsupported protocol '%s', only 'rdp', 'vnc' and 'ssh' are supported", protocol)
+	}
+
+	// Apply the parameter defaults of the operator configuration, the address and credentials stay the VM's
+	for name, value := range r.settings().protocols[protocol].Parameters {
+		switch name {
+		case "hostname", "port", "username", "password", "domain":
+			continue
+		}
+		parameters[name] = value
+	}
+
+	// Add session recording parameters if recording is enabled for this VM or its namespace
+	if err := r.applyRecordingPolicy(ctx, vm, protocol, parameters); err != nil {
+		return nil, fmt.Errorf("failed to apply recording policy: %w", err)
 	}
 
 	// Set empty values for unused parameters (Guacamole expects all parameters)
@@ -460,6 +735,60 @@ func (r *VirtualMachineReconciler) buildGuacamoleConnection(ctx context.Context,
 	return connection, nil
 }
 
+// connectionProtocolAndPort returns the remote-desktop protocol and guest port of the VM
+func (r *VirtualMachineReconciler) connectionProtocolAndPort(ctx context.Context, vm *kubevirtv1.VirtualMachine) (string, string) {
+	logger := log.FromContext(ctx)
+
+	// Default to RDP protocol
+	protocol := "rdp"
+	port := "3389"
+
+	// Check for custom protocol in annotations
+	if vm.Annotations != nil {
+		if customProtocol, exists := vm.Annotations["vm-watcher.setofangdar.polito.it/protocol"]; exists {
+			normalizedProtocol := strings.ToLower(customProtocol)
+			// Only allow RDP, VNC and SSH protocols
+			if normalizedProtocol == "rdp" || normalizedProtocol == "vnc" || normalizedProtocol == "ssh" {
+				protocol = normalizedProtocol
+			} else {
+				logger.Info("Unsupported protocol specified, defaulting to RDP",
+					"vm", vm.Name,
+					"requestedProtocol", customProtocol,
+					"supportedProtocols", "rdp, vnc, ssh")
+				r.recordEvent(vm, corev1.EventTypeWarning, EventUnsupportedProtocol,
+					"Protocol %q is not supported (rdp, vnc or ssh), using rdp", customProtocol)
+			}
+		}
+		if customPort, exists := vm.Annotations["vm-watcher.setofangdar.polito.it/port"]; exists {
+			port = customPort
+		}
+	}
+	_, customPort := vm.Annotations["vm-watcher.setofangdar.polito.it/port"]
+
+	// Set default ports based on protocol
+	switch protocol {
+	case "vnc":
+		if port == "3389" { // If still default RDP port
+			port = "5900"
+		}
+	case "rdp":
+		if port == "5900" { // If still default VNC port
+			port = "3389"
+		}
+	case "ssh":
+		if port == "3389" { // If still default RDP port
+			port = "22"
+		}
+	}
+
+	// The operator configuration may change the default port of the protocol
+	if defaultPort := r.settings().defaultPort(protocol); defaultPort != "" && !customPort {
+		port = defaultPort
+	}
+
+	return protocol, port
+}
+
 // getVMHostname extracts the hostname/IP for the VM
 func (r *VirtualMachineReconciler) getVMHostname(ctx context.Context, vm *kubevirtv1.VirtualMachine) (string, error) {
 	// Try to get the VMI to extract IP address
@@ -474,16 +803,18 @@ func (r *VirtualMachineReconciler) getVMHostname(ctx context.Context, vm *kubevi
 			return "", fmt.Errorf("failed to get VMI: %w", err)
 		}
 		// VMI not found, use VM name as hostname
+		r.recordEvent(vm, corev1.EventTypeWarning, EventHostnameFallback,
+			"No VMI found, connection points at the VM name %s", vm.Name)
 		return vm.Name, nil
 	}
 
-	// Extract IP address from VMI status
-	if len(vmi.Status.Interfaces) > 0 {
-		for _, iface := range vmi.Status.Interfaces {
-			if iface.IP != "" {
-				return iface.IP, nil
-			}
-		}
+	// Extract IP address from VMI status, on the network guacd can route to
+	ip, err := r.selectInterfaceIP(vm, &vmi)
+	if err != nil {
+		return "", err
+	}
+	if ip != "" {
+		return ip, nil
 	}
 
 	// If no IP found, try to find a service that might expose this VM
@@ -508,11 +839,13 @@ func (r *VirtualMachineReconciler) getVMHostname(ctx context.Context, vm *kubevi
 	}
 
 	// Fallback to VM name
+	r.recordEvent(vm, corev1.EventTypeWarning, EventHostnameFallback,
+		"No IP address or Service found for the VM, connection points at the VM name %s", vm.Name)
 	return vm.Name, nil
 }
 
 // deleteGuacamoleConnection deletes the Guacamole connection when VM is deleted
-func (r *VirtualMachineReconciler) deleteGuacamoleConnection(ctx context.Context, connectionID string) error {
+func (r *VirtualMachineReconciler) deleteGuacamoleConnection(ctx context.Context, authResp *GuacamoleAuthResponse, connectionID string) error {
 	logger := log.FromContext(ctx)
 
 	if connectionID == "" {
@@ -520,120 +853,90 @@ func (r *VirtualMachineReconciler) deleteGuacamoleConnection(ctx context.Context
 		return nil
 	}
 
-	logger.Info("Deleting Guacamole connection", "connection_id", connectionID)
+	logger.Info("Deleting Guacamole connection", "connection_id", connectionID, "instance", authResp.target.Name)
 
-	// Authenticate with Guacamole
-	authResp, err := r.authenticateWithGuacamole(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to authenticate: %w", err)
-	}
-
-	// Delete connection via API
-	deleteURL := fmt.Sprintf("%s/api/session/data/%s/connections/%s?token=%s",
-		strings.TrimSuffix(r.GuacamoleBaseURL, "/"),
-		authResp.DataSource,
-		connectionID,
-		authResp.AuthToken)
-
-	logger.Info("Making DELETE request to Guacamole", "url", deleteURL)
-
-	req, err := http.NewRequestWithContext(ctx, "DELETE", deleteURL, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create delete request: %w", err)
-	}
-
-	client := r.HTTPClient
-	if client == nil {
-		client = &http.Client{Timeout: 30 * time.Second}
+	// Send the deletion together with those of other VMs deleted at the same time
+	_, err := r.patchConnection(ctx, authResp, jsonPatchOperation{Op: "remove", Path: "/" + connectionID})
+	if errors.Is(err, errBatchNotApplied) {
+		// The instance does not accept batched writes, delete the connection on its own
+		err = r.doGuacamoleRequest(ctx, authResp, "DELETE", "connections/"+url.PathEscape(connectionID), nil, nil)
+		var apiErr *guacamoleAPIError
+		if errors.As(err, &apiErr) && apiErr.statusCode == http.StatusNotFound {
+			// Consider this a success since the connection is gone
+			logger.Info("Guacamole connection not found (already deleted?)", "connection_id", connectionID)
+			err = nil
+		}
 	}
-
-	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to delete connection: %w", err)
 	}
-	defer resp.Body.Close()
-
-	logger.Info("Received response from Guacamole", "status_code", resp.StatusCode)
 
-	// Handle different status codes
-	switch resp.StatusCode {
-	case http.StatusOK, http.StatusNoContent:
-		logger.Info("Successfully deleted Guacamole connection", "connection_id", connectionID)
-		return nil
-	case http.StatusNotFound:
-		logger.Info("Guacamole connection not found (already deleted?)", "connection_id", connectionID)
-		return nil // Consider this a success since the connection is gone
-	default:
-		// Read response body for error details
-		body := make([]byte, 1024)
-		n, _ := resp.Body.Read(body)
-		errorBody := string(body[:n])
-		logger.Error(fmt.Errorf("connection deletion failed"), "status_code", resp.StatusCode, "response_body", errorBody)
-		return fmt.Errorf("connection deletion failed with status %d: %s", resp.StatusCode, errorBody)
-	}
+	logger.Info("Successfully deleted Guacamole connection", "connection_id", connectionID)
+	r.connectionIndex(authResp.target.Name).remove(connectionID)
+	return nil
 }
 
 // deleteGuacamoleConnectionByName deletes a Guacamole connection by searching for it by name
-func (r *VirtualMachineReconciler) deleteGuacamoleConnectionByName(ctx context.Context, connectionName string) error {
+func (r *VirtualMachineReconciler) deleteGuacamoleConnectionByName(ctx context.Context, target *GuacamoleTarget, connectionName string) error {
 	logger := log.FromContext(ctx)
 
 	// First, authenticate with Guacamole
-	authResp, err := r.authenticateWithGuacamole(ctx)
+	authResp, err := r.authenticateWithGuacamole(ctx, target)
 	if err != nil {
 		return fmt.Errorf("failed to authenticate: %w", err)
 	}
 
-	// Get all connections to find the one with matching name
-	connectionsURL := fmt.Sprintf("%s/api/session/data/%s/connections?token=%s",
-		strings.TrimSuffix(r.GuacamoleBaseURL, "/"),
-		authResp.DataSource,
-		authResp.AuthToken)
-
-	req, err := http.NewRequestWithContext(ctx, "GET", connectionsURL, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create connections request: %w", err)
-	}
-
-	client := r.HTTPClient
-	if client == nil {
-		client = &http.Client{Timeout: 30 * time.Second}
-	}
-
-	resp, err := client.Do(req)
+	// Find the connections with matching name in the shared index instead of listing them all
+	identifiers, err := r.lookupGuacamoleConnections(ctx, authResp, connectionName)
 	if err != nil {
 		return fmt.Errorf("failed to get connections: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to get connections with status %d", resp.StatusCode)
-	}
-
-	// Parse the response to find connections with matching name
-	var connections map[string]GuacamoleConnectionResponse
-	if err := json.NewDecoder(resp.Body).Decode(&connections); err != nil {
-		return fmt.Errorf("failed to decode connections response: %w", err)
-	}
 
 	// Find and delete connections with matching name
 	var deletedAny bool
-	for identifier, connection := range connections {
-		if connection.Name == connectionName {
-			logger.Info("Found matching connection to delete", "connection_id", identifier, "connection_name", connectionName)
-			if err := r.deleteGuacamoleConnection(ctx, identifier); err != nil {
-				logger.Error(err, "Failed to delete connection", "connection_id", identifier)
-			} else {
-				deletedAny = true
-				logger.Info("Successfully deleted connection", "connection_id", identifier)
-			}
+	var errs []error
+	for _, identifier := range identifiers {
+		logger.Info("Found matching connection to delete", "connection_id", identifier, "connection_name", connectionName)
+		if err := r.deleteGuacamoleConnection(ctx, authResp, identifier); err != nil {
+			logger.Error(err, "Failed to delete connection", "connection_id", identifier)
+			errs = append(errs, err)
+		} else {
+			deletedAny = true
+			logger.Info("Successfully deleted connection", "connection_id", identifier)
 		}
 	}
 
-	if !deletedAny {
+	if !deletedAny && len(errs) == 0 {
 		logger.Info("No matching connections found to delete", "connection_name", connectionName)
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// maxConcurrentReconciles returns the number of VMs reconciled in parallel
+func (r *VirtualMachineReconciler) maxConcurrentReconciles() int {
+	if r.MaxConcurrentReconciles > 0 {
+		return r.MaxConcurrentReconciles
+	}
+	return DefaultMaxConcurrentReconciles
+}
+
+// vmChanged reports whether a VM update can change its connection: its status, generation or one of the
+// annotations the operator reads changed, or it is being deleted
+func vmChanged(oldVM, newVM *kubevirtv1.VirtualMachine) bool {
+	if oldVM.Status.PrintableStatus != newVM.Status.PrintableStatus ||
+		oldVM.Generation != newVM.Generation ||
+		(oldVM.DeletionTimestamp == nil && newVM.DeletionTimestamp != nil) {
+		return true
+	}
+	for _, annotation := range append([]string{GuacamoleInstancesAnnotation, SharingProfilesAnnotation, ObserverGroupsAnnotation}, vmSettingAnnotations...) {
+		oldValue, oldExists := oldVM.Annotations[annotation]
+		newValue, newExists := newVM.Annotations[annotation]
+		if oldValue != newValue || oldExists != newExists {
+			return true
+		}
+	}
+	return false
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -646,15 +949,7 @@ func (r *VirtualMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		},
 		UpdateFunc: func(e event.UpdateEvent) bool {
 			// Process update events only if annotations changed or status changed
-			oldVM := e.ObjectOld.(*kubevirtv1.VirtualMachine)
-			newVM := e.ObjectNew.(*kubevirtv1.VirtualMachine)
-
-			// Process if the processed annotation is missing, status changed, or generation changed
-			// Also process if deletion timestamp is set
-			return oldVM.Annotations[ProcessedAnnotation] != newVM.Annotations[ProcessedAnnotation] ||
-				oldVM.Status.PrintableStatus != newVM.Status.PrintableStatus ||
-				oldVM.Generation != newVM.Generation ||
-				(oldVM.DeletionTimestamp == nil && newVM.DeletionTimestamp != nil)
+			return vmChanged(e.ObjectOld.(*kubevirtv1.VirtualMachine), e.ObjectNew.(*kubevirtv1.VirtualMachine))
 		},
 		DeleteFunc: func(e event.DeleteEvent) bool {
 			// Always process delete events - this is critical for cleanup
@@ -664,12 +959,17 @@ func (r *VirtualMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		},
 	}
 
+	// VMs requeued when the operator configuration changes
+	r.resync = make(chan event.GenericEvent)
+	r.elected = mgr.Elected()
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&kubevirtv1.VirtualMachine{}).
 		WithOptions(controller.Options{
-			MaxConcurrentReconciles: 2, // Allow some concurrency but not too much
+			MaxConcurrentReconciles: r.maxConcurrentReconciles(),
 		}).
 		WithEventFilter(vmPredicate).
+		WatchesRawSource(source.Channel(r.resync, &handler.EnqueueRequestForObject{})).
 		Named("kubevirt-vm-watcher").
 		Complete(r)
 }
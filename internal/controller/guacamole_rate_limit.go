@@ -0,0 +1,64 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// Default sustained rate of requests to one Guacamole instance
+	DefaultGuacamoleQPS = 20
+	// Default number of requests to one Guacamole instance that may be sent in a burst above the rate
+	DefaultGuacamoleBurst = 40
+)
+
+// limiter returns the rate limiter of the instance, or nil when rate limiting is disabled
+func (r *VirtualMachineReconciler) limiter(instance string) flowcontrol.RateLimiter {
+	if r.GuacamoleQPS <= 0 {
+		return nil
+	}
+
+	r.limitersMu.Lock()
+	defer r.limitersMu.Unlock()
+	if r.limiters == nil {
+		r.limiters = make(map[string]flowcontrol.RateLimiter)
+	}
+	limiter, exists := r.limiters[instance]
+	if !exists {
+		burst := max(r.GuacamoleBurst, 1)
+		limiter = flowcontrol.NewTokenBucketRateLimiter(float32(r.GuacamoleQPS), burst)
+		r.limiters[instance] = limiter
+	}
+	return limiter
+}
+
+// waitForRateLimit blocks until the instance's rate limiter lets a request through
+func (r *VirtualMachineReconciler) waitForRateLimit(ctx context.Context, instance string) error {
+	limiter := r.limiter(instance)
+	if limiter == nil {
+		return nil
+	}
+
+	start := time.Now()
+	if err := limiter.Wait(ctx); err != nil {
+		return fmt.Errorf("rate limit of Guacamole instance %s: %w", instance, err)
+	}
+	rateLimitWait.WithLabelValues(instance).Observe(time.Since(start).Seconds())
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// Annotation enabling or disabling session recording ("true"/"false"), valid on VMs and namespaces
+	RecordingAnnotation = "vm-watcher.setofangdar.polito.it/recording"
+
+	// Default directory, as mounted inside guacd, where recordings are written
+	DefaultRecordingPath = "/var/lib/guacamole/recordings"
+	// Default recording file name template. {namespace}, {vm} and {user} are replaced by the operator,
+	// ${GUAC_*} tokens are expanded by Guacamole when the session starts.
+	DefaultRecordingNameTemplate = "{namespace}-{vm}-{user}-${GUAC_DATE}-${GUAC_TIME}"
+)
+
+// recordingEnabled resolves the recording policy for the VM. The VM annotation wins over the
+// namespace annotation, which wins over the operator-wide default.
+func (r *VirtualMachineReconciler) recordingEnabled(ctx context.Context, vm *kubevirtv1.VirtualMachine) (bool, error) {
+	if value, exists := vm.Annotations[RecordingAnnotation]; exists {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s annotation %q on VM: %w", RecordingAnnotation, value, err)
+		}
+		return enabled, nil
+	}
+
+	var namespace corev1.Namespace
+	if err := r.Get(ctx, client.ObjectKey{Name: vm.Namespace}, &namespace); err != nil {
+		return false, fmt.Errorf("failed to get namespace %s: %w", vm.Namespace, err)
+	}
+	if value, exists := namespace.Annotations[RecordingAnnotation]; exists {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s annotation %q on namespace: %w", RecordingAnnotation, value, err)
+		}
+		return enabled, nil
+	}
+
+	return r.settings().recordingEnabled, nil
+}
+
+// applyRecordingPolicy sets the session recording parameters on the connection when recording is enabled.
+// Graphical protocols get a Guacamole session recording, SSH gets a typescript of the terminal output.
+func (r *VirtualMachineReconciler) applyRecordingPolicy(ctx context.Context, vm *kubevirtv1.VirtualMachine, protocol string, parameters map[string]string) error {
+	logger := log.FromContext(ctx)
+
+	enabled, err := r.recordingEnabled(ctx, vm)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+
+	basePath := r.RecordingPath
+	if basePath == "" {
+		basePath = DefaultRecordingPath
+	}
+	nameTemplate := r.RecordingNameTemplate
+	if nameTemplate == "" {
+		nameTemplate = DefaultRecordingNameTemplate
+	}
+
+	// Recordings are grouped per namespace so retention can be applied per tenant
+	recordingPath := path.Join(basePath, vm.Namespace)
+	recordingName := strings.NewReplacer(
+		"{namespace}", vm.Namespace,
+		"{vm}", vm.Name,
+		"{user}", "${GUAC_USERNAME}",
+	).Replace(nameTemplate)
+
+	switch protocol {
+	case "ssh":
+		parameters["typescript-path"] = recordingPath
+		parameters["typescript-name"] = recordingName
+		parameters["create-typescript-path"] = "true"
+	default:
+		parameters["recording-path"] = recordingPath
+		parameters["recording-name"] = recordingName
+		parameters["create-recording-path"] = "true"
+	}
+
+	logger.Info("Session recording enabled for connection",
+		"vm", vm.Name,
+		"protocol", protocol,
+		"recording_path", recordingPath,
+		"recording_name", recordingName)
+
+	return nil
+}
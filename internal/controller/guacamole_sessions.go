@@ -0,0 +1,145 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// GuacamoleActiveConnection represents a session currently open in Guacamole
+type GuacamoleActiveConnection struct {
+	Identifier               string `json:"identifier"`
+	ConnectionIdentifier     string `json:"connectionIdentifier"`
+	SharingProfileIdentifier string `json:"sharingProfileIdentifier"`
+	StartDate                int64  `json:"startDate"` // Milliseconds since the epoch
+	RemoteHost               string `json:"remoteHost"`
+	Username                 string `json:"username"`
+}
+
+// GuacamoleHistoryEntry represents a past or ongoing session in the connection history
+type GuacamoleHistoryEntry struct {
+	ConnectionIdentifier     string `json:"connectionIdentifier"`
+	ConnectionName           string `json:"connectionName"`
+	SharingProfileIdentifier string `json:"sharingProfileIdentifier"`
+	StartDate                int64  `json:"startDate"`         // Milliseconds since the epoch
+	EndDate                  *int64 `json:"endDate,omitempty"` // Unset while the session is active
+	RemoteHost               string `json:"remoteHost"`
+	Username                 string `json:"username"`
+	Active                   bool   `json:"active"`
+}
+
+// Start returns the session start time
+func (h *GuacamoleHistoryEntry) Start() time.Time {
+	return time.UnixMilli(h.StartDate)
+}
+
+// End returns the session end time, or the zero time while the session is active
+func (h *GuacamoleHistoryEntry) End() time.Time {
+	if h.EndDate == nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(*h.EndDate)
+}
+
+// listGuacamoleConnections returns every connection visible to the operator, keyed by identifier, and
+// rebuilds the connection index of the instance with them
+func (r *VirtualMachineReconciler) listGuacamoleConnections(ctx context.Context, authResp *GuacamoleAuthResponse) (map[string]GuacamoleConnectionResponse, error) {
+	var connections map[string]GuacamoleConnectionResponse
+	if err := r.doGuacamoleRequest(ctx, authResp, "GET", "connections", nil, &connections); err != nil {
+		return nil, fmt.Errorf("failed to list connections: %w", err)
+	}
+	r.connectionIndex(authResp.target.Name).replace(connections)
+	return connections, nil
+}
+
+// findGuacamoleConnectionID returns the identifier of the connection with the given name, or "" if there is none
+func (r *VirtualMachineReconciler) findGuacamoleConnectionID(ctx context.Context, authResp *GuacamoleAuthResponse, connectionName string) (string, error) {
+	identifiers, err := r.lookupGuacamoleConnections(ctx, authResp, connectionName)
+	if err != nil || len(identifiers) == 0 {
+		return "", err
+	}
+	return identifiers[0], nil
+}
+
+// listActiveConnections returns the sessions currently open in Guacamole, keyed by identifier
+func (r *VirtualMachineReconciler) listActiveConnections(ctx context.Context, authResp *GuacamoleAuthResponse) (map[string]GuacamoleActiveConnection, error) {
+	var active map[string]GuacamoleActiveConnection
+	if err := r.doGuacamoleRequest(ctx, authResp, "GET", "activeConnections", nil, &active); err != nil {
+		return nil, fmt.Errorf("failed to list active connections: %w", err)
+	}
+	return active, nil
+}
+
+// listConnectionHistory returns the most recent sessions, newest first
+func (r *VirtualMachineReconciler) listConnectionHistory(ctx context.Context, authResp *GuacamoleAuthResponse) ([]GuacamoleHistoryEntry, error) {
+	var history []GuacamoleHistoryEntry
+	if err := r.doGuacamoleRequest(ctx, authResp, "GET", "history/connections?order=-startDate", nil, &history); err != nil {
+		return nil, fmt.Errorf("failed to list connection history: %w", err)
+	}
+	return history, nil
+}
+
+// managedConnectionNames maps the Guacamole connection name of every VM to its namespaced name
+func (r *VirtualMachineReconciler) managedConnectionNames(ctx context.Context) (map[string]client.ObjectKey, error) {
+	var vms kubevirtv1.VirtualMachineList
+	if err := r.List(ctx, &vms); err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+
+	names := make(map[string]client.ObjectKey, len(vms.Items))
+	for _, vm := range vms.Items {
+		names[fmt.Sprintf("%s-%s", vm.Namespace, vm.Name)] = client.ObjectKeyFromObject(&vm)
+	}
+	return names, nil
+}
+
+// isOrphanConnection reports whether a connection that belongs to no VM is named like one, i.e. a top-level
+// connection named "<namespace>-<name>" after an existing namespace
+func isOrphanConnection(connection GuacamoleConnectionResponse, managed map[string]client.ObjectKey, namespaces []string) bool {
+	if _, managedVM := managed[connection.Name]; managedVM || connection.ParentIdentifier != "ROOT" {
+		return false
+	}
+	for _, namespace := range namespaces {
+		if name, found := strings.CutPrefix(connection.Name, namespace+"-"); found && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceNames returns the names of every namespace the operator watches
+func (r *VirtualMachineReconciler) namespaceNames(ctx context.Context) ([]string, error) {
+	// Connections named after other namespaces may belong to another operator sharing the instance
+	if len(r.WatchNamespaces) > 0 {
+		return r.WatchNamespaces, nil
+	}
+
+	var namespaces corev1.NamespaceList
+	if err := r.List(ctx, &namespaces); err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	names := make([]string, 0, len(namespaces.Items))
+	for _, namespace := range namespaces.Items {
+		names = append(names, namespace.Name)
+	}
+	return names, nil
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+const (
+	// Annotation listing the sharing profile variants to create (e.g., "read-only,full-control", or "none")
+	SharingProfilesAnnotation = "vm-watcher.setofangdar.polito.it/sharing-profiles"
+	// Annotation listing the Guacamole user groups allowed to use the sharing profiles
+	ObserverGroupsAnnotation = "vm-watcher.setofangdar.polito.it/observer-groups"
+
+	// Sharing profile variant that lets observers watch without sending input
+	SharingProfileReadOnly = "read-only"
+	// Sharing profile variant that gives observers full keyboard and mouse control
+	SharingProfileFullControl = "full-control"
+)
+
+// sharingProfileParameters maps each supported sharing profile variant to its Guacamole parameters
+var sharingProfileParameters = map[string]map[string]string{
+	SharingProfileReadOnly:    {"read-only": "true"},
+	SharingProfileFullControl: {},
+}
+
+// GuacamoleSharingProfile represents a Guacamole sharing profile attached to a connection
+type GuacamoleSharingProfile struct {
+	Identifier                  string            `json:"identifier,omitempty"`
+	PrimaryConnectionIdentifier string            `json:"primaryConnectionIdentifier"`
+	Name                        string            `json:"name"`
+	Parameters                  map[string]string `json:"parameters"`
+	Attributes                  map[string]string `json:"attributes"`
+}
+
+// reconcileSharingProfiles brings the sharing profiles of a connection in line with the VM: missing variants
+// are created, variants whose parameters changed are updated and variants no longer wanted are deleted.
+// Profiles with other names are left alone. The observer groups are granted every profile, and groups in
+// granted that are no longer wanted lose access. It returns the variants and groups now set up, the state
+// recorded in the status object for the instance.
+func (r *VirtualMachineReconciler) reconcileSharingProfiles(ctx context.Context, authResp *GuacamoleAuthResponse, vm *kubevirtv1.VirtualMachine, published kubevirtv1alpha1.GuacamoleInstanceConnection) ([]string, []string, error) {
+	logger := log.FromContext(ctx)
+	connectionID, granted := published.ConnectionIdentifier, published.ObserverGroups
+
+	variants := r.desiredSharingProfiles(ctx, vm)
+	groups := r.observerGroupsFor(vm)
+	if len(variants) == 0 {
+		// Deleting the profiles also drops their permissions
+		groups = nil
+		if len(published.SharingProfiles) == 0 {
+			return nil, nil, nil
+		}
+	}
+
+	// Only the profiles of this connection, rather than every profile of the data source
+	var profiles map[string]GuacamoleSharingProfile
+	profilesPath := fmt.Sprintf("connections/%s/sharingProfiles", url.PathEscape(connectionID))
+	if err := r.doGuacamoleRequest(ctx, authResp, "GET", profilesPath, nil, &profiles); err != nil {
+		return nil, nil, fmt.Errorf("failed to list sharing profiles: %w", err)
+	}
+	existing := make(map[string]string) // Identifier by variant
+	for identifier, profile := range profiles {
+		if _, managed := sharingProfileParameters[profile.Name]; managed {
+			existing[profile.Name] = identifier
+		}
+	}
+
+	for variant, identifier := range existing {
+		if slices.Contains(variants, variant) {
+			continue
+		}
+		if err := r.doGuacamoleRequest(ctx, authResp, "DELETE", "sharingProfiles/"+url.PathEscape(identifier), nil, nil); err != nil {
+			return nil, nil, fmt.Errorf("failed to delete %s sharing profile: %w", variant, err)
+		}
+		logger.Info("Deleted Guacamole sharing profile", "vm", vm.Name, "connection_id", connectionID,
+			"sharing_profile_id", identifier, "variant", variant)
+	}
+
+	for _, variant := range variants {
+		profile := GuacamoleSharingProfile{
+			PrimaryConnectionIdentifier: connectionID,
+			Name:                        variant,
+			Parameters:                  sharingProfileParameters[variant],
+			Attributes:                  map[string]string{},
+		}
+
+		identifier, exists := existing[variant]
+		// Groups that still have to be granted the profile, and groups that lose it
+		grant, revoke := groups, []string(nil)
+		if exists {
+			grant = slices.DeleteFunc(slices.Clone(groups), func(group string) bool { return slices.Contains(granted, group) })
+			revoke = slices.DeleteFunc(slices.Clone(granted), func(group string) bool { return slices.Contains(groups, group) })
+
+			var parameters map[string]string
+			profilePath := "sharingProfiles/" + url.PathEscape(identifier)
+			if err := r.doGuacamoleRequest(ctx, authResp, "GET", profilePath+"/parameters", nil, &parameters); err != nil {
+				return nil, nil, fmt.Errorf("failed to get parameters of %s sharing profile: %w", variant, err)
+			}
+			if !maps.Equal(parameters, profile.Parameters) {
+				profile.Identifier = identifier
+				if err := r.doGuacamoleRequest(ctx, authResp, "PUT", profilePath, profile, nil); err != nil {
+					return nil, nil, fmt.Errorf("failed to update %s sharing profile: %w", variant, err)
+				}
+				logger.Info("Updated Guacamole sharing profile", "vm", vm.Name, "connection_id", connectionID,
+					"sharing_profile_id", identifier, "variant", variant)
+			}
+		} else {
+			var created GuacamoleSharingProfile
+			if err := r.doGuacamoleRequest(ctx, authResp, "POST", "sharingProfiles", profile, &created); err != nil {
+				return nil, nil, fmt.Errorf("failed to create %s sharing profile: %w", variant, err)
+			}
+			identifier = created.Identifier
+			logger.Info("Created Guacamole sharing profile", "vm", vm.Name, "connection_id", connectionID,
+				"sharing_profile_id", identifier, "variant", variant, "observer_groups", groups)
+		}
+
+		for _, group := range grant {
+			if err := r.patchSharingProfilePermission(ctx, authResp, "add", group, identifier); err != nil {
+				return nil, nil, fmt.Errorf("failed to grant %s sharing profile to group %s: %w", variant, group, err)
+			}
+		}
+		for _, group := range revoke {
+			if err := r.patchSharingProfilePermission(ctx, authResp, "remove", group, identifier); err != nil {
+				return nil, nil, fmt.Errorf("failed to revoke %s sharing profile from group %s: %w", variant, group, err)
+			}
+		}
+	}
+
+	return variants, groups, nil
+}
+
+// patchSharingProfilePermission adds or removes the READ permission of a user group on a sharing profile
+func (r *VirtualMachineReconciler) patchSharingProfilePermission(ctx context.Context, authResp *GuacamoleAuthResponse, op, group, identifier string) error {
+	patch := []jsonPatchOperation{{
+		Op:    op,
+		Path:  fmt.Sprintf("/sharingProfilePermissions/%s", identifier),
+		Value: "READ",
+	}}
+	return r.doGuacamoleRequest(ctx, authResp, "PATCH", fmt.Sprintf("userGroups/%s/permissions", url.PathEscape(group)), patch, nil)
+}
+
+// desiredSharingProfiles returns the supported sharing profile variants for the VM, sorted and without duplicates
+func (r *VirtualMachineReconciler) desiredSharingProfiles(ctx context.Context, vm *kubevirtv1.VirtualMachine) []string {
+	var variants []string
+	for _, variant := range r.sharingProfilesFor(vm) {
+		if _, supported := sharingProfileParameters[variant]; !supported {
+			log.FromContext(ctx).Info("Unsupported sharing profile variant, skipping",
+				"vm", vm.Name,
+				"variant", variant,
+				"supportedVariants", "read-only, full-control")
+			continue
+		}
+		variants = append(variants, variant)
+	}
+	slices.Sort(variants)
+	return slices.Compact(variants)
+}
+
+// sharingOutdated reports whether an instance's sharing profiles or observer groups differ from those the
+// VM asks for
+func (r *VirtualMachineReconciler) sharingOutdated(ctx context.Context, vm *kubevirtv1.VirtualMachine, connectionStatus *kubevirtv1alpha1.GuacamoleConnection) bool {
+	variants := r.desiredSharingProfiles(ctx, vm)
+	var groups []string
+	if len(variants) > 0 {
+		groups = r.observerGroupsFor(vm)
+	}
+	for _, published := range connectionStatus.Status.Instances {
+		if !slices.Equal(published.SharingProfiles, variants) || !slices.Equal(published.ObserverGroups, groups) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharingProfilesFor returns the sharing profile variants for the VM, preferring the annotation over the default
+func (r *VirtualMachineReconciler) sharingProfilesFor(vm *kubevirtv1.VirtualMachine) []string {
+	if value, exists := vm.Annotations[SharingProfilesAnnotation]; exists {
+		if strings.EqualFold(strings.TrimSpace(value), "none") {
+			return nil
+		}
+		return SplitList(strings.ToLower(value))
+	}
+	return r.settings().sharingProfiles
+}
+
+// observerGroupsFor returns the observer groups for the VM, preferring the annotation over the default,
+// sorted and without duplicates
+func (r *VirtualMachineReconciler) observerGroupsFor(vm *kubevirtv1.VirtualMachine) []string {
+	groups := r.settings().observerGroups
+	if value, exists := vm.Annotations[ObserverGroupsAnnotation]; exists {
+		groups = SplitList(value)
+	}
+	groups = slices.Clone(groups)
+	slices.Sort(groups)
+	return slices.Compact(groups)
+}
+
+// SplitList splits a comma separated list, dropping empty entries
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
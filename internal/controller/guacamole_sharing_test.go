@@ -0,0 +1,241 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+// sharingServer is a Guacamole data source holding sharing profiles and the permission changes made to them
+type sharingServer struct {
+	t *testing.T
+
+	mu          sync.Mutex
+	profiles    map[string]GuacamoleSharingProfile
+	nextID      int
+	requests    []string // "<method> <path>" of every request
+	permissions []string // "<group> <op> <profile identifier>" of every permission change
+}
+
+func (s *sharingServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/api/session/data/postgresql/")
+	s.requests = append(s.requests, req.Method+" "+path)
+	parts := strings.Split(path, "/")
+
+	switch {
+	case req.Method == http.MethodGet && len(parts) == 3 && parts[0] == "connections" && parts[2] == "sharingProfiles":
+		profiles := map[string]GuacamoleSharingProfile{}
+		for id, profile := range s.profiles {
+			if profile.PrimaryConnectionIdentifier == parts[1] {
+				profiles[id] = GuacamoleSharingProfile{Identifier: id, PrimaryConnectionIdentifier: parts[1], Name: profile.Name}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(profiles)
+	case req.Method == http.MethodGet && len(parts) == 3 && parts[0] == "sharingProfiles" && parts[2] == "parameters":
+		_ = json.NewEncoder(w).Encode(s.profiles[parts[1]].Parameters)
+	case req.Method == http.MethodPost && path == "sharingProfiles":
+		var profile GuacamoleSharingProfile
+		_ = json.NewDecoder(req.Body).Decode(&profile)
+		s.nextID++
+		profile.Identifier = fmt.Sprint(s.nextID)
+		s.profiles[profile.Identifier] = profile
+		_ = json.NewEncoder(w).Encode(profile)
+	case req.Method == http.MethodPut && len(parts) == 2 && parts[0] == "sharingProfiles":
+		var profile GuacamoleSharingProfile
+		_ = json.NewDecoder(req.Body).Decode(&profile)
+		s.profiles[parts[1]] = profile
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "sharingProfiles":
+		delete(s.profiles, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPatch && len(parts) == 3 && parts[0] == "userGroups" && parts[2] == "permissions":
+		var patch []jsonPatchOperation
+		_ = json.NewDecoder(req.Body).Decode(&patch)
+		for _, operation := range patch {
+			s.permissions = append(s.permissions, fmt.Sprintf("%s %s %s", parts[1], operation.Op,
+				strings.TrimPrefix(operation.Path, "/sharingProfilePermissions/")))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.t.Errorf("unexpected request %s %s", req.Method, path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestReconcileSharingProfiles(t *testing.T) {
+	tests := []struct {
+		name            string
+		profiles        map[string]GuacamoleSharingProfile
+		annotations     map[string]string
+		published       kubevirtv1alpha1.GuacamoleInstanceConnection
+		wantVariants    []string
+		wantGroups      []string
+		wantPermissions []string
+		wantProfiles    map[string]string // Variant by identifier of the connection's profiles afterwards
+		wantNoRequests  bool
+	}{
+		{
+			name:            "new profiles granted to observers",
+			annotations:     map[string]string{SharingProfilesAnnotation: "full-control,read-only", ObserverGroupsAnnotation: "instructors"},
+			wantVariants:    []string{SharingProfileFullControl, SharingProfileReadOnly},
+			wantGroups:      []string{"instructors"},
+			wantPermissions: []string{"instructors add 101", "instructors add 102"},
+			wantProfiles:    map[string]string{"101": SharingProfileFullControl, "102": SharingProfileReadOnly},
+		},
+		{
+			name: "changed variants and groups",
+			profiles: map[string]GuacamoleSharingProfile{
+				"1": {PrimaryConnectionIdentifier: "7", Name: SharingProfileReadOnly, Parameters: map[string]string{}},
+				"2": {PrimaryConnectionIdentifier: "7", Name: SharingProfileFullControl, Parameters: map[string]string{}},
+				"3": {PrimaryConnectionIdentifier: "7", Name: "custom", Parameters: map[string]string{}},
+				"4": {PrimaryConnectionIdentifier: "8", Name: SharingProfileReadOnly, Parameters: map[string]string{"read-only": "true"}},
+			},
+			annotations: map[string]string{SharingProfilesAnnotation: "read-only", ObserverGroupsAnnotation: "tas, instructors"},
+			published: kubevirtv1alpha1.GuacamoleInstanceConnection{
+				SharingProfiles: []string{SharingProfileFullControl, SharingProfileReadOnly},
+				ObserverGroups:  []string{"instructors", "students"},
+			},
+			wantVariants: []string{SharingProfileReadOnly},
+			wantGroups:   []string{"instructors", "tas"},
+			// Only the difference: instructors keep their permission without a new grant
+			wantPermissions: []string{"tas add 1", "students remove 1"},
+			wantProfiles:    map[string]string{"1": SharingProfileReadOnly, "3": "custom"},
+		},
+		{
+			name: "sharing turned off",
+			profiles: map[string]GuacamoleSharingProfile{
+				"1": {PrimaryConnectionIdentifier: "7", Name: SharingProfileReadOnly, Parameters: map[string]string{"read-only": "true"}},
+			},
+			annotations:  map[string]string{SharingProfilesAnnotation: "none", ObserverGroupsAnnotation: "instructors"},
+			published:    kubevirtv1alpha1.GuacamoleInstanceConnection{SharingProfiles: []string{SharingProfileReadOnly}, ObserverGroups: []string{"instructors"}},
+			wantProfiles: map[string]string{},
+		},
+		{
+			name:           "never shared",
+			annotations:    map[string]string{ObserverGroupsAnnotation: "instructors"},
+			wantNoRequests: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guacamole := &sharingServer{t: t, profiles: map[string]GuacamoleSharingProfile{}, nextID: 100}
+			for id, profile := range tt.profiles {
+				guacamole.profiles[id] = profile
+			}
+			server := httptest.NewServer(guacamole)
+			defer server.Close()
+
+			r, authResp := batchTestReconciler(server, 0, 0)
+			published := tt.published
+			published.ConnectionIdentifier = "7"
+			variants, groups, err := r.reconcileSharingProfiles(context.Background(), authResp, testVM(tt.annotations), published)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(variants, tt.wantVariants) || !slices.Equal(groups, tt.wantGroups) {
+				t.Errorf("reconciled %v for %v, want %v for %v", variants, groups, tt.wantVariants, tt.wantGroups)
+			}
+			if !reflect.DeepEqual(guacamole.permissions, tt.wantPermissions) {
+				t.Errorf("permission changes = %v, want %v", guacamole.permissions, tt.wantPermissions)
+			}
+			if tt.wantNoRequests {
+				if len(guacamole.requests) > 0 {
+					t.Errorf("requests = %v, want none", guacamole.requests)
+				}
+				return
+			}
+			if slices.Contains(guacamole.requests, "GET sharingProfiles") {
+				t.Errorf("every sharing profile of the data source was listed: %v", guacamole.requests)
+			}
+
+			got := map[string]string{}
+			for id, profile := range guacamole.profiles {
+				if profile.PrimaryConnectionIdentifier == "7" {
+					got[id] = profile.Name
+					if want, managed := sharingProfileParameters[profile.Name]; managed && !reflect.DeepEqual(profile.Parameters, want) {
+						t.Errorf("%s profile parameters = %v, want %v", profile.Name, profile.Parameters, want)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.wantProfiles) {
+				t.Errorf("profiles = %v, want %v", got, tt.wantProfiles)
+			}
+			if profile := guacamole.profiles["4"]; tt.profiles["4"].Name != "" && profile.Name != SharingProfileReadOnly {
+				t.Errorf("profile of another connection changed: %+v", profile)
+			}
+		})
+	}
+}
+
+func TestDesiredSharingProfiles(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaults    []string
+		annotations map[string]string
+		want        []string
+	}{
+		{name: "none by default"},
+		{name: "flag default", defaults: []string{SharingProfileReadOnly}, want: []string{SharingProfileReadOnly}},
+		{name: "annotation wins", defaults: []string{SharingProfileReadOnly}, annotations: map[string]string{SharingProfilesAnnotation: "Full-Control"}, want: []string{SharingProfileFullControl}},
+		{name: "annotation disables", defaults: []string{SharingProfileReadOnly}, annotations: map[string]string{SharingProfilesAnnotation: " None "}},
+		{
+			name:        "sorted without duplicates or unsupported variants",
+			annotations: map[string]string{SharingProfilesAnnotation: "read-only, watch, full-control, read-only"},
+			want:        []string{SharingProfileFullControl, SharingProfileReadOnly},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &VirtualMachineReconciler{SharingProfiles: tt.defaults}
+			if got := r.desiredSharingProfiles(context.Background(), testVM(tt.annotations)); !slices.Equal(got, tt.want) {
+				t.Errorf("desiredSharingProfiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONPatchOperationMarshal(t *testing.T) {
+	tests := []struct {
+		operation jsonPatchOperation
+		want      string
+	}{
+		{operation: jsonPatchOperation{Op: "add", Path: "/sharingProfilePermissions/1", Value: "READ"}, want: `{"op":"add","path":"/sharingProfilePermissions/1","value":"READ"}`},
+		{operation: jsonPatchOperation{Op: "remove", Path: "/42"}, want: `{"op":"remove","path":"/42"}`},
+		{operation: jsonPatchOperation{Op: "test", Path: "/metadata/finalizers", Value: nil}, want: `{"op":"test","path":"/metadata/finalizers","value":null}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.operation.Op, func(t *testing.T) {
+			data, err := json.Marshal(tt.operation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("json = %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+// Default interval between checks of the TLS files and Secrets for changes
+const DefaultTLSReloadInterval = 30 * time.Second
+
+// tlsMaterial holds the PEM data a TLS configuration is built from
+type tlsMaterial struct {
+	ca   []byte
+	cert []byte
+	key  []byte
+}
+
+// equal reports whether both hold the same PEM data
+func (m tlsMaterial) equal(other tlsMaterial) bool {
+	return bytes.Equal(m.ca, other.ca) && bytes.Equal(m.cert, other.cert) && bytes.Equal(m.key, other.key)
+}
+
+// tlsConfig builds a client TLS configuration verifying the server against the CA bundle (or the system
+// roots without one) and presenting the client certificate when there is one
+func (m tlsMaterial) tlsConfig(insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify, //nolint:gosec // Explicitly requested by configuration
+	}
+	if len(m.ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(m.ca) {
+			return nil, fmt.Errorf("no PEM certificates in CA bundle")
+		}
+		config.RootCAs = pool
+	}
+	if len(m.cert) > 0 || len(m.key) > 0 {
+		certificate, err := tls.X509KeyPair(m.cert, m.key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// newTLSTransport returns the transport used for Guacamole API calls with the given TLS configuration
+func newTLSTransport(config *tls.Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig:    config,
+		MaxIdleConns:       10,
+		IdleConnTimeout:    30 * time.Second,
+		DisableCompression: true,
+	}
+}
+
+// ParseSecretReference parses a "namespace/name" Secret reference, a bare name being looked up in the default namespace
+func ParseSecretReference(value, defaultNamespace string) (*kubevirtv1alpha1.SecretReference, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	namespace, name, found := strings.Cut(value, "/")
+	if !found {
+		namespace, name = defaultNamespace, value
+	}
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("invalid Secret reference %q, expected namespace/name", value)
+	}
+	return &kubevirtv1alpha1.SecretReference{Namespace: namespace, Name: name}, nil
+}
+
+// GuacamoleTLSTransport is the transport of the Guacamole instance configured by flags. It reads the CA bundle
+// and client certificate from files or Secrets and, while running, reloads them when they change: new
+// connections use the new certificates and idle connections made with the old ones are closed.
+type GuacamoleTLSTransport struct {
+	// Reader reads the Secrets, normally the manager's API reader so that the first load works before the cache starts
+	Reader client.Reader
+
+	CAFile           string
+	CASecret         *kubevirtv1alpha1.SecretReference // "ca.crt" key
+	ClientCertFile   string
+	ClientKeyFile    string
+	ClientCertSecret *kubevirtv1alpha1.SecretReference // kubernetes.io/tls Secret
+	// InsecureSkipVerify disables certificate verification. Only meant for development.
+	InsecureSkipVerify bool
+	// Interval between checks for changes
+	Interval time.Duration
+
+	material tlsMaterial
+	current  atomic.Pointer[http.Transport]
+}
+
+// RoundTrip sends the request with the current TLS configuration
+func (t *GuacamoleTLSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.current.Load()
+	if transport == nil {
+		return nil, fmt.Errorf("guacamole TLS configuration not loaded")
+	}
+	return transport.RoundTrip(req)
+}
+
+// Load reads the certificates and switches to them if they changed since the last load
+func (t *GuacamoleTLSTransport) Load(ctx context.Context) error {
+	material, err := t.readMaterial(ctx)
+	if err != nil {
+		return err
+	}
+	if t.current.Load() != nil && material.equal(t.material) {
+		return nil
+	}
+
+	config, err := material.tlsConfig(t.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	previous := t.current.Swap(newTLSTransport(config))
+	t.material = material
+	if previous != nil {
+		previous.CloseIdleConnections()
+		log.FromContext(ctx).Info("Reloaded Guacamole TLS certificates")
+	}
+	return nil
+}
+
+// readMaterial reads the configured CA bundle and client certificate
+func (t *GuacamoleTLSTransport) readMaterial(ctx context.Context) (tlsMaterial, error) {
+	var material tlsMaterial
+	var err error
+
+	switch {
+	case t.CAFile != "":
+		if material.ca, err = os.ReadFile(t.CAFile); err != nil {
+			return material, fmt.Errorf("failed to read CA file: %w", err)
+		}
+	case t.CASecret != nil:
+		secret, err := t.getSecret(ctx, t.CASecret)
+		if err != nil {
+			return material, fmt.Errorf("failed to get CA Secret: %w", err)
+		}
+		material.ca = secret.Data[caSecretKey]
+	}
+
+	switch {
+	case t.ClientCertFile != "":
+		if material.cert, err = os.ReadFile(t.ClientCertFile); err != nil {
+			return material, fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		if material.key, err = os.ReadFile(t.ClientKeyFile); err != nil {
+			return material, fmt.Errorf("failed to read client key: %w", err)
+		}
+	case t.ClientCertSecret != nil:
+		secret, err := t.getSecret(ctx, t.ClientCertSecret)
+		if err != nil {
+			return material, fmt.Errorf("failed to get client certificate Secret: %w", err)
+		}
+		material.cert = secret.Data[corev1.TLSCertKey]
+		material.key = secret.Data[corev1.TLSPrivateKeyKey]
+	}
+	return material, nil
+}
+
+// getSecret returns the referenced Secret
+func (t *GuacamoleTLSTransport) getSecret(ctx context.Context, ref *kubevirtv1alpha1.SecretReference) (*corev1.Secret, error) {
+	var secret corev1.Secret
+	if err := t.Reader.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// Start implements manager.Runnable and reloads the certificates until the context is cancelled.
+// A failed reload keeps the previous certificates.
+func (t *GuacamoleTLSTransport) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("guacamole-tls")
+	ctx = log.IntoContext(ctx, logger)
+
+	interval := t.Interval
+	if interval <= 0 {
+		interval = DefaultTLSReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := t.Load(ctx); err != nil {
+				logger.Error(err, "Failed to reload Guacamole TLS certificates, keeping the previous ones")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection lets every replica reload its certificates
+func (t *GuacamoleTLSTransport) NeedLeaderElection() bool {
+	return false
+}
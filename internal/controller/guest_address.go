@@ -0,0 +1,143 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// Annotation selecting the VM network (spec.template.spec.networks[].name) the connection uses
+	NetworkAnnotation = "vm-watcher.setofangdar.polito.it/network"
+	// Annotation selecting the guest interface name (e.g. eth1) the connection uses
+	InterfaceAnnotation = "vm-watcher.setofangdar.polito.it/interface"
+	// Annotation selecting the preferred IP family ("ipv4" or "ipv6")
+	IPFamilyAnnotation = "vm-watcher.setofangdar.polito.it/ip-family"
+	// Annotation with comma separated CIDRs the connection address must belong to
+	AllowedCIDRsAnnotation = "vm-watcher.setofangdar.polito.it/allowed-cidrs"
+
+	IPFamilyIPv4 = "ipv4"
+	IPFamilyIPv6 = "ipv6"
+)
+
+// addressSelection describes which of the VMI addresses a connection may point at
+type addressSelection struct {
+	network      string
+	iface        string
+	ipFamily     string
+	allowedCIDRs []netip.Prefix
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs
+func ParseCIDRs(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range SplitList(value) {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// addressSelectionFor returns the address selection for the VM, preferring its annotations over the defaults
+func (r *VirtualMachineReconciler) addressSelectionFor(vm *kubevirtv1.VirtualMachine) (addressSelection, error) {
+	settings := r.settings()
+	selection := addressSelection{
+		network:      settings.network,
+		ipFamily:     settings.ipFamily,
+		allowedCIDRs: settings.allowedCIDRs,
+	}
+
+	if value, exists := vm.Annotations[NetworkAnnotation]; exists {
+		selection.network = strings.TrimSpace(value)
+	}
+	if value, exists := vm.Annotations[InterfaceAnnotation]; exists {
+		selection.iface = strings.TrimSpace(value)
+	}
+	if value, exists := vm.Annotations[IPFamilyAnnotation]; exists {
+		selection.ipFamily = strings.ToLower(strings.TrimSpace(value))
+	}
+	if selection.ipFamily != "" && selection.ipFamily != IPFamilyIPv4 && selection.ipFamily != IPFamilyIPv6 {
+		return selection, fmt.Errorf("unsupported IP family %q, expected %s or %s", selection.ipFamily, IPFamilyIPv4, IPFamilyIPv6)
+	}
+	if value, exists := vm.Annotations[AllowedCIDRsAnnotation]; exists {
+		cidrs, err := ParseCIDRs(value)
+		if err != nil {
+			return selection, fmt.Errorf("invalid %s annotation: %w", AllowedCIDRsAnnotation, err)
+		}
+		selection.allowedCIDRs = cidrs
+	}
+	return selection, nil
+}
+
+// selectInterfaceIP returns the VMI address the connection should point at, or "" if no address matches.
+// Interfaces are filtered by network and interface name, addresses by the allowed CIDRs, and an address
+// of the preferred family wins over an earlier one of the other family.
+func (r *VirtualMachineReconciler) selectInterfaceIP(vm *kubevirtv1.VirtualMachine, vmi *kubevirtv1.VirtualMachineInstance) (string, error) {
+	selection, err := r.addressSelectionFor(vm)
+	if err != nil {
+		return "", err
+	}
+
+	fallback := ""
+	for _, iface := range vmi.Status.Interfaces {
+		if selection.network != "" && iface.Name != selection.network {
+			continue
+		}
+		if selection.iface != "" && iface.InterfaceName != selection.iface {
+			continue
+		}
+
+		ips := iface.IPs
+		if len(ips) == 0 && iface.IP != "" {
+			ips = []string{iface.IP}
+		}
+		for _, ip := range ips {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil || addr.IsLinkLocalUnicast() {
+				// guacd cannot route to link-local addresses
+				continue
+			}
+			if !addressAllowed(addr, selection.allowedCIDRs) {
+				continue
+			}
+			if selection.ipFamily == "" || (selection.ipFamily == IPFamilyIPv4) == addr.Unmap().Is4() {
+				return addr.String(), nil
+			}
+			if fallback == "" {
+				fallback = addr.String()
+			}
+		}
+	}
+	return fallback, nil
+}
+
+// addressAllowed reports whether the address belongs to one of the CIDRs, any address being allowed without CIDRs
+func addressAllowed(addr netip.Addr, cidrs []netip.Prefix) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
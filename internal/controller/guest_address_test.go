@@ -0,0 +1,96 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"net/netip"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestSelectInterfaceIP(t *testing.T) {
+	interfaces := []kubevirtv1.VirtualMachineInstanceNetworkInterface{
+		{Name: "default", InterfaceName: "eth0", IP: "10.0.0.5", IPs: []string{"fe80::1", "10.0.0.5", "fd00::5"}},
+		{Name: "lab", InterfaceName: "eth1", IP: "192.168.10.7"},
+		{Name: "storage", InterfaceName: "eth2", IPs: []string{"2001:db8::7", "172.16.0.7"}},
+	}
+	tests := []struct {
+		name         string
+		network      string
+		ipFamily     string
+		allowedCIDRs []netip.Prefix
+		annotations  map[string]string
+		interfaces   []kubevirtv1.VirtualMachineInstanceNetworkInterface
+		want         string
+		wantErr      bool
+	}{
+		{name: "first address skipping link-local", want: "10.0.0.5"},
+		{name: "no interfaces", interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{}, want: ""},
+		{name: "network default", network: "lab", want: "192.168.10.7"},
+		{name: "network annotation wins over default", network: "lab", annotations: map[string]string{NetworkAnnotation: "storage"}, want: "2001:db8::7"},
+		{name: "empty network annotation clears default", network: "lab", annotations: map[string]string{NetworkAnnotation: ""}, want: "10.0.0.5"},
+		{name: "unknown network", annotations: map[string]string{NetworkAnnotation: "missing"}, want: ""},
+		{name: "interface name", annotations: map[string]string{InterfaceAnnotation: " eth2 "}, want: "2001:db8::7"},
+		{name: "network and interface disagree", annotations: map[string]string{NetworkAnnotation: "lab", InterfaceAnnotation: "eth0"}, want: ""},
+		{name: "single IP field", annotations: map[string]string{InterfaceAnnotation: "eth1"}, want: "192.168.10.7"},
+		{name: "preferred ipv6", ipFamily: IPFamilyIPv6, want: "fd00::5"},
+		{name: "preferred ipv4 on later address", annotations: map[string]string{NetworkAnnotation: "storage", IPFamilyAnnotation: "IPv4"}, want: "172.16.0.7"},
+		{
+			name:        "fallback to other family",
+			annotations: map[string]string{NetworkAnnotation: "lab", IPFamilyAnnotation: IPFamilyIPv6},
+			want:        "192.168.10.7",
+		},
+		{name: "unsupported family", annotations: map[string]string{IPFamilyAnnotation: "ipx"}, wantErr: true},
+		{name: "allowed CIDRs default", allowedCIDRs: []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")}, want: "172.16.0.7"},
+		{name: "allowed CIDRs annotation", annotations: map[string]string{AllowedCIDRsAnnotation: "192.168.0.0/16, fd00::/8"}, want: "fd00::5"},
+		{name: "no allowed address", annotations: map[string]string{AllowedCIDRsAnnotation: "198.51.100.0/24"}, want: ""},
+		{name: "invalid CIDR annotation", annotations: map[string]string{AllowedCIDRsAnnotation: "10.0.0.0/33"}, wantErr: true},
+		{
+			name:       "IPv4-mapped IPv6 matches IPv4 CIDR and family",
+			ipFamily:   IPFamilyIPv4,
+			interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{{Name: "default", IPs: []string{"2001:db8::1", "::ffff:10.1.2.3"}}},
+			annotations: map[string]string{
+				AllowedCIDRsAnnotation: "10.1.0.0/16,2001:db8::/32",
+			},
+			want: "::ffff:10.1.2.3",
+		},
+		{
+			name:       "unparsable addresses are skipped",
+			interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{{Name: "default", IPs: []string{"", "not-an-ip", "10.2.3.4"}}},
+			want:       "10.2.3.4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &VirtualMachineReconciler{Network: tt.network, IPFamily: tt.ipFamily, AllowedCIDRs: tt.allowedCIDRs}
+			vm := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm1", Namespace: "lab-a", Annotations: tt.annotations}}
+			vmi := &kubevirtv1.VirtualMachineInstance{}
+			vmi.Status.Interfaces = interfaces
+			if tt.interfaces != nil {
+				vmi.Status.Interfaces = tt.interfaces
+			}
+
+			got, err := r.selectInterfaceIP(vm, vmi)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectInterfaceIP error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("selectInterfaceIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
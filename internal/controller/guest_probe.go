@@ -0,0 +1,161 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+const (
+	// Annotation overriding the guest probe mode for a VM ("tcp", "handshake" or "none")
+	GuestProbeAnnotation = "vm-watcher.setofangdar.polito.it/guest-probe"
+
+	// Only check that the guest port accepts TCP connections
+	GuestProbeTCP = "tcp"
+	// Also check that the service behind the port speaks the connection protocol
+	GuestProbeHandshake = "handshake"
+	// Publish the connection without probing the guest
+	GuestProbeNone = "none"
+
+	// Default timeout of a single guest probe
+	DefaultGuestProbeTimeout = 3 * time.Second
+	// Delay before probing a guest that was not listening again
+	GuestProbeRetryDelay = 15 * time.Second
+)
+
+// rdpConnectionRequest is an X.224 Connection Request carrying an RDP Negotiation Request
+// for TLS and CredSSP, the first packet an RDP client sends
+var rdpConnectionRequest = []byte{
+	0x03, 0x00, 0x00, 0x13, // TPKT header, 19 bytes
+	0x0e, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00, // X.224 Connection Request
+	0x01, 0x00, 0x08, 0x00, 0x03, 0x00, 0x00, 0x00, // RDP Negotiation Request
+}
+
+// guestProbeModeFor returns the probe mode for the VM, preferring the annotation over the default.
+// Probes are sent from the operator pod, which may not reach the guest the way guacd does, so they are opt-in.
+func (r *VirtualMachineReconciler) guestProbeModeFor(vm *kubevirtv1.VirtualMachine) string {
+	mode := r.settings().guestProbeMode
+	if value, exists := vm.Annotations[GuestProbeAnnotation]; exists {
+		mode = strings.ToLower(strings.TrimSpace(value))
+	}
+	if mode == "" {
+		mode = GuestProbeNone
+	}
+	return mode
+}
+
+// checkGuestReady probes the guest and reports whether the connection can be published. While the guest
+// is not listening the Ready condition says so, and a warning event is emitted when that starts.
+func (r *VirtualMachineReconciler) checkGuestReady(ctx context.Context, vm *kubevirtv1.VirtualMachine, connectionStatus *kubevirtv1alpha1.GuacamoleConnection, connection *GuacamoleConnection) bool {
+	logger := log.FromContext(ctx)
+
+	probeErr := r.probeGuest(ctx, vm, connection)
+	if probeErr == nil {
+		return true
+	}
+
+	logger.Info("Guest not listening yet, waiting", "vm", vm.Name, "reason", probeErr.Error())
+	changed, err := r.setReadyCondition(ctx, connectionStatus, metav1.ConditionFalse, ReasonGuestNotListening, probeErr.Error())
+	if err != nil {
+		logger.Error(err, "Failed to update connection status")
+	}
+	if changed {
+		r.recordEvent(vm, corev1.EventTypeWarning, EventGuestNotListening, "%v", probeErr)
+	}
+	return false
+}
+
+// probeGuest checks that the guest accepts connections on the connection's hostname and port,
+// and with the handshake mode that it answers like a server of the connection protocol
+func (r *VirtualMachineReconciler) probeGuest(ctx context.Context, vm *kubevirtv1.VirtualMachine, connection *GuacamoleConnection) error {
+	mode := r.guestProbeModeFor(vm)
+	if mode == GuestProbeNone {
+		return nil
+	}
+	if mode != GuestProbeTCP && mode != GuestProbeHandshake {
+		log.FromContext(ctx).Info("Unsupported guest probe mode, using tcp",
+			"vm", vm.Name,
+			"requestedMode", mode,
+			"supportedModes", "tcp, handshake, none")
+		mode = GuestProbeTCP
+	}
+
+	timeout := r.GuestProbeTimeout
+	if timeout <= 0 {
+		timeout = DefaultGuestProbeTimeout
+	}
+
+	address := net.JoinHostPort(connection.Parameters["hostname"], connection.Parameters["port"])
+	conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("guest not listening on %s: %w", address, err)
+	}
+	defer conn.Close()
+
+	if mode != GuestProbeHandshake {
+		return nil
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	switch connection.Protocol {
+	case "vnc":
+		// VNC servers greet with their protocol version, e.g. "RFB 003.008\n"
+		greeting := make([]byte, 12)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return fmt.Errorf("no VNC greeting from %s: %w", address, err)
+		}
+		if !bytes.HasPrefix(greeting, []byte("RFB ")) {
+			return fmt.Errorf("unexpected VNC greeting from %s: %q", address, greeting)
+		}
+	case "ssh":
+		// SSH servers greet with their identification string, e.g. "SSH-2.0-OpenSSH_8.9\r\n"
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("no SSH identification from %s: %w", address, err)
+		}
+		if !strings.HasPrefix(line, "SSH-") {
+			return fmt.Errorf("unexpected SSH identification from %s: %q", address, line)
+		}
+	case "rdp":
+		// RDP servers answer a connection request with an X.224 Connection Confirm in a TPKT packet
+		if _, err := conn.Write(rdpConnectionRequest); err != nil {
+			return fmt.Errorf("failed to send RDP connection request to %s: %w", address, err)
+		}
+		response := make([]byte, 6)
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return fmt.Errorf("no RDP connection confirm from %s: %w", address, err)
+		}
+		if response[0] != 0x03 || response[5] != 0xd0 {
+			return fmt.Errorf("unexpected RDP response from %s: % x", address, response)
+		}
+	}
+
+	return nil
+}
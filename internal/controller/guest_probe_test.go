@@ -0,0 +1,64 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestGuestProbeModeFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		flag        string
+		annotations map[string]string
+		want        string
+	}{
+		{name: "off by default", want: GuestProbeNone},
+		{name: "flag", flag: GuestProbeTCP, want: GuestProbeTCP},
+		{name: "annotation opts in", annotations: map[string]string{GuestProbeAnnotation: " Handshake "}, want: GuestProbeHandshake},
+		{name: "annotation opts out", flag: GuestProbeTCP, annotations: map[string]string{GuestProbeAnnotation: "none"}, want: GuestProbeNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &VirtualMachineReconciler{GuestProbeMode: tt.flag}
+			if got := r.guestProbeModeFor(testVM(tt.annotations)); got != tt.want {
+				t.Errorf("guestProbeModeFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeGuestDefaultSkipsUnreachableGuest(t *testing.T) {
+	// A port nothing listens on, as seen by an operator that cannot reach the guest
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	connection := &GuacamoleConnection{Parameters: map[string]string{"hostname": "127.0.0.1", "port": strconv.Itoa(port)}}
+
+	r := &VirtualMachineReconciler{}
+	if err := r.probeGuest(context.Background(), testVM(nil), connection); err != nil {
+		t.Errorf("probeGuest() without a probe mode = %v, want the connection published", err)
+	}
+
+	r.GuestProbeMode = GuestProbeTCP
+	if err := r.probeGuest(context.Background(), testVM(nil), connection); err == nil {
+		t.Errorf("probeGuest() with tcp succeeded on a closed port")
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+const (
+	// Annotation overriding the idle timeout for a VM (e.g., "2h", "0" disables idle stop)
+	IdleTimeoutAnnotation = "vm-watcher.setofangdar.polito.it/idle-timeout"
+	// Annotation marking a VM that must never be stopped for inactivity
+	AlwaysOnAnnotation = "vm-watcher.setofangdar.polito.it/always-on"
+
+	// Default interval between two idle checks
+	DefaultIdleCheckInterval = 5 * time.Minute
+)
+
+// IdleVMStopper stops running VMs whose Guacamole connection has had no active session for longer
+// than their idle timeout
+type IdleVMStopper struct {
+	Reconciler  *VirtualMachineReconciler // Provides the Guacamole and Kubernetes clients
+	Interval    time.Duration
+	IdleTimeout time.Duration // Default idle timeout, 0 only stops VMs opting in with the annotation
+}
+
+// Start checks for idle VMs until the context is cancelled
+func (s *IdleVMStopper) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("idle-stopper")
+	ctx = log.IntoContext(ctx, logger)
+
+	interval := s.Interval
+	if interval <= 0 {
+		interval = DefaultIdleCheckInterval
+	}
+
+	logger.Info("Starting idle VM stopper", "interval", interval, "default_idle_timeout", s.IdleTimeout)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if err := s.check(ctx); err != nil {
+			logger.Error(err, "Idle VM check failed")
+		}
+	}
+}
+
+// NeedLeaderElection makes sure only one replica stops VMs
+func (s *IdleVMStopper) NeedLeaderElection() bool {
+	return true
+}
+
+// check stops every running VM that has been idle for longer than its timeout
+func (s *IdleVMStopper) check(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	r := s.Reconciler
+
+	var vms kubevirtv1.VirtualMachineList
+	if err := r.List(ctx, &vms); err != nil {
+		return fmt.Errorf("failed to list VMs: %w", err)
+	}
+	var connections kubevirtv1alpha1.GuacamoleConnectionList
+	if err := r.List(ctx, &connections); err != nil {
+		return fmt.Errorf("failed to list GuacamoleConnections: %w", err)
+	}
+	published := make(map[client.ObjectKey]bool, len(connections.Items))
+	for _, connection := range connections.Items {
+		published[client.ObjectKeyFromObject(&connection)] = connection.Status.Published
+	}
+
+	// Collect candidates first so Guacamole is only queried when there is something to stop
+	var candidates []kubevirtv1.VirtualMachine
+	for _, vm := range vms.Items {
+		if vm.DeletionTimestamp != nil || vm.Status.PrintableStatus != kubevirtv1.VirtualMachineStatusRunning {
+			continue
+		}
+		if !published[client.ObjectKeyFromObject(&vm)] {
+			// No connection yet, so there is nothing users could have been doing
+			continue
+		}
+		if alwaysOn, _ := strconv.ParseBool(vm.Annotations[AlwaysOnAnnotation]); alwaysOn {
+			continue
+		}
+		if s.idleTimeoutFor(ctx, &vm) > 0 {
+			candidates = append(candidates, vm)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	targets, err := r.allGuacamoleTargets(ctx)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		// Without any Guacamole instance there is no session activity to judge idleness by
+		return nil
+	}
+
+	// Connection names with an open session, in any instance
+	busy := make(map[string]bool)
+	// Most recent session end per connection name, in any instance
+	lastSession := make(map[string]time.Time)
+	// No VM is stopped unless every instance could be checked for sessions
+	for _, target := range targets {
+		if err := r.collectSessionActivity(ctx, target, busy, lastSession); err != nil {
+			return fmt.Errorf("instance %s: %w", target.Name, err)
+		}
+	}
+
+	for i := range candidates {
+		vm := &candidates[i]
+		connectionName := fmt.Sprintf("%s-%s", vm.Namespace, vm.Name)
+		if busy[connectionName] {
+			continue
+		}
+
+		// Idle time starts at the last session end, or when the VM started if nobody used it since. Without
+		// the start time, sessions of an earlier run could make a VM that was just restarted look idle.
+		lastActivity := lastSession[connectionName]
+		var vmi kubevirtv1.VirtualMachineInstance
+		if err := r.Get(ctx, client.ObjectKeyFromObject(vm), &vmi); err != nil {
+			logger.Error(err, "Failed to get VM instance, skipping idle check", "vm", vm.Name, "namespace", vm.Namespace)
+			continue
+		}
+		if vmi.CreationTimestamp.After(lastActivity) {
+			lastActivity = vmi.CreationTimestamp.Time
+		}
+		if lastActivity.IsZero() {
+			continue
+		}
+
+		timeout := s.idleTimeoutFor(ctx, vm)
+		idleFor := time.Since(lastActivity)
+		if idleFor < timeout {
+			continue
+		}
+
+		if err := s.stopVM(ctx, vm); err != nil {
+			logger.Error(err, "Failed to stop idle VM", "vm", vm.Name, "namespace", vm.Namespace)
+			continue
+		}
+
+		logger.Info("Stopped idle VM",
+			"vm", vm.Name,
+			"namespace", vm.Namespace,
+			"idle_for", idleFor.Round(time.Second),
+			"idle_timeout", timeout)
+		r.recordEvent(vm, corev1.EventTypeNormal, EventIdleStop,
+			"Stopped after %s without an active Guacamole session (idle timeout %s)",
+			idleFor.Round(time.Minute), timeout)
+	}
+
+	return nil
+}
+
+// idleTimeoutFor returns the idle timeout for the VM, preferring the annotation over the default
+func (s *IdleVMStopper) idleTimeoutFor(ctx context.Context, vm *kubevirtv1.VirtualMachine) time.Duration {
+	value, exists := vm.Annotations[IdleTimeoutAnnotation]
+	if !exists {
+		return s.IdleTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Invalid idle timeout annotation, idle stop disabled", "vm", vm.Name, "value", value)
+		return 0
+	}
+	return timeout
+}
+
+// stopVM halts the VM through its run strategy, or the legacy running field when that is in use
+func (s *IdleVMStopper) stopVM(ctx context.Context, vm *kubevirtv1.VirtualMachine) error {
+	patch := client.MergeFrom(vm.DeepCopy())
+	if vm.Spec.Running != nil {
+		running := false
+		vm.Spec.Running = &running
+	} else {
+		halted := kubevirtv1.RunStrategyHalted
+		vm.Spec.RunStrategy = &halted
+	}
+	return s.Reconciler.Patch(ctx, vm, patch)
+}
+
+// collectSessionActivity records the connections of one instance with an open session and the end of
+// their most recent session
+func (r *VirtualMachineReconciler) collectSessionActivity(ctx context.Context, target *GuacamoleTarget, busy map[string]bool, lastSession map[string]time.Time) error {
+	authResp, err := r.authenticateWithGuacamole(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	connections, err := r.listGuacamoleConnections(ctx, authResp)
+	if err != nil {
+		return err
+	}
+	active, err := r.listActiveConnections(ctx, authResp)
+	if err != nil {
+		return err
+	}
+	history, err := r.listConnectionHistory(ctx, authResp)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range active {
+		if connection, exists := connections[session.ConnectionIdentifier]; exists {
+			busy[connection.Name] = true
+		}
+	}
+	for _, entry := range history {
+		if entry.Active {
+			busy[entry.ConnectionName] = true
+			continue
+		}
+		if end := entry.End(); end.After(lastSession[entry.ConnectionName]) {
+			lastSession[entry.ConnectionName] = end
+		}
+	}
+	return nil
+}
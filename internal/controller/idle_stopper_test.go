@@ -0,0 +1,154 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+// idleTestVM describes a VM of the idle check and the Guacamole activity of its connection
+type idleTestVM struct {
+	name        string
+	annotations map[string]string
+	running     *bool // Legacy running field instead of a run strategy
+	unpublished bool
+	startedAgo  time.Duration
+	active      bool          // Has an open session
+	endedAgo    time.Duration // End of the last session, 0 if never used
+	wantStopped bool
+}
+
+func TestIdleVMStopperCheck(t *testing.T) {
+	running := true
+	vms := []idleTestVM{
+		{name: "idle", startedAgo: 5 * time.Hour, endedAgo: 3 * time.Hour, wantStopped: true},
+		{name: "never-used", startedAgo: 2 * time.Hour, wantStopped: true},
+		{name: "legacy", running: &running, startedAgo: 5 * time.Hour, endedAgo: 3 * time.Hour, wantStopped: true},
+		{name: "recent", startedAgo: 5 * time.Hour, endedAgo: 10 * time.Minute},
+		{name: "busy", startedAgo: 5 * time.Hour, endedAgo: 3 * time.Hour, active: true},
+		// Sessions of the run before the restart do not count
+		{name: "restarted", startedAgo: 10 * time.Minute, endedAgo: 3 * time.Hour},
+		{name: "longer-timeout", annotations: map[string]string{IdleTimeoutAnnotation: "4h"}, startedAgo: 5 * time.Hour, endedAgo: 3 * time.Hour},
+		{name: "disabled", annotations: map[string]string{IdleTimeoutAnnotation: "0"}, startedAgo: 5 * time.Hour},
+		{name: "invalid-timeout", annotations: map[string]string{IdleTimeoutAnnotation: "soon"}, startedAgo: 5 * time.Hour},
+		{name: "always-on", annotations: map[string]string{AlwaysOnAnnotation: "true"}, startedAgo: 5 * time.Hour},
+		{name: "unpublished", unpublished: true, startedAgo: 5 * time.Hour},
+	}
+
+	tests := []struct {
+		name string
+		// Status code of the history request, an instance that cannot be checked stops nothing
+		historyStatus int
+	}{
+		{name: "instance checked", historyStatus: http.StatusOK},
+		{name: "instance failing", historyStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			connections := map[string]GuacamoleConnectionResponse{}
+			active := map[string]GuacamoleActiveConnection{}
+			var history []GuacamoleHistoryEntry
+			var objects []client.Object
+			for i, vm := range vms {
+				runStrategy := kubevirtv1.RunStrategyAlways
+				spec := kubevirtv1.VirtualMachineSpec{Running: vm.running}
+				if vm.running == nil {
+					spec.RunStrategy = &runStrategy
+				}
+				objects = append(objects,
+					&kubevirtv1.VirtualMachine{
+						ObjectMeta: metav1.ObjectMeta{Namespace: "lab", Name: vm.name, Annotations: vm.annotations},
+						Spec:       spec,
+						Status:     kubevirtv1.VirtualMachineStatus{PrintableStatus: kubevirtv1.VirtualMachineStatusRunning},
+					},
+					&kubevirtv1.VirtualMachineInstance{ObjectMeta: metav1.ObjectMeta{
+						Namespace: "lab", Name: vm.name, CreationTimestamp: metav1.NewTime(now.Add(-vm.startedAgo)),
+					}},
+					&kubevirtv1alpha1.GuacamoleConnection{
+						ObjectMeta: metav1.ObjectMeta{Namespace: "lab", Name: vm.name},
+						Status:     kubevirtv1alpha1.GuacamoleConnectionStatus{Published: !vm.unpublished},
+					})
+
+				identifier := string(rune('a' + i))
+				connections[identifier] = GuacamoleConnectionResponse{Identifier: identifier, Name: "lab-" + vm.name}
+				if vm.active {
+					active[identifier] = GuacamoleActiveConnection{ConnectionIdentifier: identifier}
+				}
+				if vm.endedAgo > 0 {
+					end := now.Add(-vm.endedAgo).UnixMilli()
+					history = append(history, GuacamoleHistoryEntry{
+						ConnectionName: "lab-" + vm.name, StartDate: end - time.Minute.Milliseconds(), EndDate: &end,
+					})
+				}
+			}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var response interface{}
+				switch strings.TrimPrefix(req.URL.Path, "/api/session/data/postgresql/") {
+				case "connections":
+					response = connections
+				case "activeConnections":
+					response = active
+				case "history/connections":
+					if tt.historyStatus != http.StatusOK {
+						http.Error(w, "unavailable", tt.historyStatus)
+						return
+					}
+					response = history
+				default:
+					t.Errorf("unexpected request %s", req.URL.Path)
+				}
+				_ = json.NewEncoder(w).Encode(response)
+			}))
+			defer server.Close()
+
+			c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(objects...).
+				WithStatusSubresource(&kubevirtv1.VirtualMachine{}, &kubevirtv1alpha1.GuacamoleConnection{}).Build()
+			r := &VirtualMachineReconciler{Client: c, GuacamoleBaseURL: server.URL, HTTPClient: server.Client()}
+			r.storeToken(r.defaultTarget(), &GuacamoleAuthResponse{AuthToken: "token", DataSource: "postgresql"})
+			stopper := &IdleVMStopper{Reconciler: r, IdleTimeout: time.Hour}
+
+			err := stopper.check(context.Background())
+			if (err != nil) != (tt.historyStatus != http.StatusOK) {
+				t.Fatalf("check() error = %v", err)
+			}
+
+			for _, vm := range vms {
+				var got kubevirtv1.VirtualMachine
+				if err := c.Get(context.Background(), client.ObjectKey{Namespace: "lab", Name: vm.name}, &got); err != nil {
+					t.Fatal(err)
+				}
+				stopped := (got.Spec.Running != nil && !*got.Spec.Running) ||
+					(got.Spec.RunStrategy != nil && *got.Spec.RunStrategy == kubevirtv1.RunStrategyHalted)
+				if want := vm.wantStopped && err == nil; stopped != want {
+					t.Errorf("VM %s stopped = %v, want %v", vm.name, stopped, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// bearerToken returns the Kubernetes bearer token of the request, if it has one
+func bearerToken(req *http.Request) (string, bool) {
+	bearer, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return bearer, found && bearer != ""
+}
+
+// reviewToken returns the Kubernetes user the bearer token belongs to, checked with a TokenReview
+func reviewToken(ctx context.Context, c client.Client, bearer string) (*authenticationv1.UserInfo, error) {
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: bearer},
+	}
+	if err := c.Create(ctx, review); err != nil {
+		return nil, fmt.Errorf("failed to review token: %w", err)
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return nil, errors.New(review.Status.Error)
+		}
+		return nil, errors.New("token not authenticated")
+	}
+	return &review.Status.User, nil
+}
+
+// reviewAccess checks with a SubjectAccessReview that the user may act on the resource, returning
+// errNotAllowed when it may not
+func reviewAccess(ctx context.Context, c client.Client, user *authenticationv1.UserInfo, attributes authorizationv1.ResourceAttributes) error {
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for key, values := range user.Extra {
+		extra[key] = authorizationv1.ExtraValue(values)
+	}
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user.Username,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			Extra:              extra,
+			ResourceAttributes: &attributes,
+		},
+	}
+	if err := c.Create(ctx, review); err != nil {
+		return fmt.Errorf("failed to review access: %w", err)
+	}
+	if !review.Status.Allowed {
+		return errNotAllowed
+	}
+	return nil
+}
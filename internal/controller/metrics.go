@@ -0,0 +1,259 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// Reconcile outcomes reported by guacamole_reconcile_total
+	ReconcileWaitingForRunning = "waiting-for-running"
+	ReconcileWaitingForGuest   = "waiting-for-guest"
+	ReconcileCreated           = "created"
+	ReconcileUpdated           = "updated"
+	ReconcileDeleted           = "deleted"
+	ReconcileFailed            = "failed"
+)
+
+var (
+	// Sessions currently open in Guacamole per VM, and per user when the collector exports the user label
+	activeSessions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "guacamole_active_sessions",
+			Help: "Number of active Guacamole sessions per VM and, if enabled, user",
+		},
+		[]string{"namespace", "vm", "user"},
+	)
+
+	// Duration of finished Guacamole sessions
+	sessionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "guacamole_session_duration_seconds",
+			Help:    "Duration of finished Guacamole sessions",
+			Buckets: []float64{10, 60, 300, 900, 1800, 3600, 7200, 14400, 28800},
+		},
+		[]string{"namespace", "vm"},
+	)
+
+	// Sessions that ended right after starting. Failed connection attempts show up this way in the history,
+	// but so do users closing the tab right away.
+	shortSessions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "guacamole_short_sessions_total",
+			Help: "Number of Guacamole sessions that ended within the short session threshold of starting",
+		},
+		[]string{"namespace", "vm"},
+	)
+
+	// Failed attempts to poll session data from Guacamole
+	sessionPollErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "guacamole_session_poll_errors_total",
+			Help: "Number of failed polls of Guacamole session data",
+		},
+	)
+
+	// Requests sent to the Guacamole REST API, "error" standing for the status code when no response came back
+	apiRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "guacamole_api_requests_total",
+			Help: "Number of requests to the Guacamole REST API by instance, operation and status code",
+		},
+		[]string{"instance", "method", "operation", "code"},
+	)
+
+	// Latency of requests to the Guacamole REST API
+	apiRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "guacamole_api_request_duration_seconds",
+			Help:    "Duration of requests to the Guacamole REST API",
+			Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"instance", "method", "operation"},
+	)
+
+	// Logins to Guacamole that failed or were rejected
+	authFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "guacamole_auth_failures_total",
+			Help: "Number of failed logins to Guacamole",
+		},
+		[]string{"instance"},
+	)
+
+	// Reconciles of VMs by outcome
+	reconcileOutcomes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "guacamole_reconcile_total",
+			Help: "Number of VM reconciles by outcome",
+		},
+		[]string{"reason"},
+	)
+
+	// Result of the last health check of each default instance
+	guacamoleUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "guacamole_up",
+			Help: "Whether the last health check could log in to the Guacamole instance and manage connections (1) or not (0)",
+		},
+		[]string{"instance"},
+	)
+
+	// State of the circuit breaker of each instance
+	circuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "guacamole_circuit_breaker_state",
+			Help: "State of the circuit breaker of a Guacamole instance (0 closed, 1 open, 2 recovering)",
+		},
+		[]string{"instance"},
+	)
+
+	// Requests not sent because the circuit of the instance was open or still recovering
+	circuitBreakerRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "guacamole_circuit_breaker_rejected_requests_total",
+			Help: "Number of requests to a Guacamole instance held back by its circuit breaker",
+		},
+		[]string{"instance"},
+	)
+
+	// Time requests waited for the rate limiter of their instance
+	rateLimitWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "guacamole_api_rate_limit_wait_seconds",
+			Help:    "Time requests to a Guacamole instance waited for its client-side rate limiter",
+			Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"instance"},
+	)
+
+	// Connection writes sent together in one JSON Patch request
+	patchBatchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "guacamole_connection_patch_batch_size",
+			Help:    "Number of connection writes sent in one JSON Patch request to a Guacamole instance",
+			Buckets: []float64{1, 2, 5, 10, 20, 50, 100},
+		},
+		[]string{"instance"},
+	)
+
+	// Connections in Guacamole belonging to an existing VM
+	managedConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "guacamole_managed_connections",
+			Help: "Number of Guacamole connections belonging to an existing VM",
+		},
+		[]string{"instance"},
+	)
+
+	// Connections in Guacamole named after a namespace but belonging to no VM, e.g. left by a failed cleanup
+	orphanConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "guacamole_orphan_connections",
+			Help: "Number of Guacamole connections named like a VM connection but belonging to no existing VM",
+		},
+		[]string{"instance"},
+	)
+
+	// Connections of deleted VMs waiting to be deleted from an instance that was unreachable
+	tombstoneCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "guacamole_tombstones",
+			Help: "Number of connections of deleted VMs recorded as tombstones, waiting to be deleted from Guacamole",
+		},
+		[]string{"instance"},
+	)
+)
+
+func init() {
+	// Register with controller-runtime's registry so the metrics are served on --metrics-bind-address
+	metrics.Registry.MustRegister(
+		activeSessions,
+		sessionDuration,
+		shortSessions,
+		sessionPollErrors,
+		apiRequests,
+		apiRequestDuration,
+		authFailures,
+		reconcileOutcomes,
+		guacamoleUp,
+		circuitBreakerState,
+		circuitBreakerRejections,
+		managedConnections,
+		orphanConnections,
+		tombstoneCount,
+		rateLimitWait,
+		patchBatchSize,
+	)
+}
+
+// observeReconcile counts a reconcile with the given outcome
+func observeReconcile(reason string) {
+	reconcileOutcomes.WithLabelValues(reason).Inc()
+}
+
+// sendGuacamoleRequest sends a request to the instance, unless its circuit breaker holds it back, once its
+// rate limiter lets it through, and records its status code and latency
+func (r *VirtualMachineReconciler) sendGuacamoleRequest(target *GuacamoleTarget, req *http.Request) (*http.Response, error) {
+	breaker := r.breaker(target.Name)
+	if breaker != nil && !breaker.allow(req.Context(), target.Name) {
+		circuitBreakerRejections.WithLabelValues(target.Name).Inc()
+		return nil, ErrCircuitOpen
+	}
+	if err := r.waitForRateLimit(req.Context(), target.Name); err != nil {
+		return nil, err
+	}
+
+	operation := guacamoleOperation(req.URL.Path)
+	start := time.Now()
+	resp, err := target.httpClient().Do(req)
+	apiRequestDuration.WithLabelValues(target.Name, req.Method, operation).Observe(time.Since(start).Seconds())
+	if breaker != nil {
+		breaker.record(req.Context(), target.Name, requestFailed(req, resp, err))
+	}
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	apiRequests.WithLabelValues(target.Name, req.Method, operation, code).Inc()
+	return resp, err
+}
+
+// guacamoleOperation returns the REST resource a request path addresses, without identifiers, e.g.
+// "connections" for /api/session/data/postgresql/connections/42 and "tokens" for /api/tokens
+func guacamoleOperation(path string) string {
+	_, rest, found := strings.Cut(path, "/api/")
+	if !found {
+		return "other"
+	}
+	if after, found := strings.CutPrefix(rest, "session/data/"); found {
+		// Skip the data source
+		if _, resource, found := strings.Cut(after, "/"); found {
+			rest = resource
+		}
+	}
+	resource, _, _ := strings.Cut(rest, "/")
+	if resource == "" {
+		return "other"
+	}
+	return resource
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// Annotation overriding whether a NetworkPolicy restricts access to the VM's remote-desktop port ("true" or "false")
+	NetworkPolicyAnnotation = "vm-watcher.setofangdar.polito.it/network-policy"
+
+	// Label every namespace carries with its own name
+	namespaceNameLabel = "kubernetes.io/metadata.name"
+	// Suffix of the name of the NetworkPolicy created for a VM
+	networkPolicySuffix = "-desktop"
+	// Highest TCP port number
+	maxPort = 65535
+)
+
+// Policies are created per VM rather than per namespace: the remote-desktop port comes from each VM's protocol
+// and port annotations, and a policy owned by its VM is garbage collected with it.
+
+// networkPolicyEnabled reports whether the VM's remote-desktop port should be restricted to guacd
+func (r *VirtualMachineReconciler) networkPolicyEnabled(vm *kubevirtv1.VirtualMachine) bool {
+	if value, exists := vm.Annotations[NetworkPolicyAnnotation]; exists {
+		if enabled, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+			return enabled
+		}
+	}
+	return r.settings().networkPolicyEnabled
+}
+
+// vmNetworkPolicyName returns the name of the NetworkPolicy the operator manages for the VM
+func vmNetworkPolicyName(vm *kubevirtv1.VirtualMachine) string {
+	return vm.Name + networkPolicySuffix
+}
+
+// reconcileNetworkPolicy creates or updates the NetworkPolicy that only lets the guacd pods of the VM's instances
+// (and the operator's guest probes) reach the VM's remote-desktop port, or deletes it when the VM no longer wants
+// one. The NetworkPolicy is owned by the VM.
+func (r *VirtualMachineReconciler) reconcileNetworkPolicy(ctx context.Context, vm *kubevirtv1.VirtualMachine, targets []*GuacamoleTarget) error {
+	logger := log.FromContext(ctx)
+
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      vmNetworkPolicyName(vm),
+			Namespace: vm.Namespace,
+		},
+	}
+
+	if !r.networkPolicyEnabled(vm) {
+		return r.deleteNetworkPolicy(ctx, vm)
+	}
+
+	_, port := r.connectionProtocolAndPort(ctx, vm)
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > maxPort {
+		return fmt.Errorf("invalid port %q", port)
+	}
+
+	// Never take over a NetworkPolicy the operator did not create
+	var existing networkingv1.NetworkPolicy
+	if err := r.Get(ctx, client.ObjectKeyFromObject(policy), &existing); err == nil {
+		if !metav1.IsControlledBy(&existing, vm) {
+			return fmt.Errorf("network policy %s/%s exists and is not managed for this VM", existing.Namespace, existing.Name)
+		}
+	} else if client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to get NetworkPolicy: %w", err)
+	}
+
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, policy, func() error {
+		if policy.Labels == nil {
+			policy.Labels = make(map[string]string)
+		}
+		policy.Labels["app.kubernetes.io/managed-by"] = "vm-watcher"
+		policy.Spec = r.networkPolicySpec(vm, int32(portNumber), targets)
+		return controllerutil.SetControllerReference(vm, policy, r.Scheme)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create or update NetworkPolicy: %w", err)
+	}
+	if result != controllerutil.OperationResultNone {
+		logger.Info("Reconciled VM NetworkPolicy", "network_policy", policy.Name, "operation", result)
+	}
+	return nil
+}
+
+// networkPolicySpec builds the policy for the VM's virt-launcher pod, allowing only the guacd pods of every target
+// instance and the operator pods to reach the remote-desktop port. A policy selecting a pod denies every ingress no
+// policy allows, so other ports of the VM need policies of their own; allowing them here would also override a
+// namespace default-deny.
+func (r *VirtualMachineReconciler) networkPolicySpec(vm *kubevirtv1.VirtualMachine, port int32, targets []*GuacamoleTarget) networkingv1.NetworkPolicySpec {
+	tcp := corev1.ProtocolTCP
+
+	var peers []networkingv1.NetworkPolicyPeer
+	seen := make(map[string]bool)
+	addGuacd := func(namespace string, podLabels map[string]string) {
+		key := namespace + "/" + labels.SelectorFromSet(podLabels).String()
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: namespace}},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: podLabels},
+		})
+	}
+	for _, target := range targets {
+		namespace, podLabels := target.GuacdNamespace, target.GuacdPodLabels
+		if namespace == "" {
+			namespace, podLabels = r.GuacdNamespace, r.GuacdPodLabels
+		} else if podLabels == nil {
+			podLabels = r.GuacdPodLabels
+		}
+		addGuacd(namespace, podLabels)
+	}
+	// Without an instance the connection is not published anywhere, keep the flag-configured guacd
+	if len(peers) == 0 {
+		addGuacd(r.GuacdNamespace, r.GuacdPodLabels)
+	}
+	if r.OperatorNamespace != "" {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: r.OperatorNamespace}},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: r.OperatorPodLabels},
+		})
+	}
+
+	desktopPort := intstr.FromInt32(port)
+	return networkingv1.NetworkPolicySpec{
+		PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{domainLabel: vm.Name}},
+		PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		Ingress: []networkingv1.NetworkPolicyIngressRule{{
+			From:  peers,
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &desktopPort}},
+		}},
+	}
+}
+
+// deleteNetworkPolicy deletes the VM's NetworkPolicy if the operator created it
+func (r *VirtualMachineReconciler) deleteNetworkPolicy(ctx context.Context, vm *kubevirtv1.VirtualMachine) error {
+	var policy networkingv1.NetworkPolicy
+	key := client.ObjectKey{Namespace: vm.Namespace, Name: vmNetworkPolicyName(vm)}
+	if err := r.Get(ctx, key, &policy); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(&policy, vm) {
+		return nil
+	}
+	if err := r.Delete(ctx, &policy); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	log.FromContext(ctx).Info("Deleted VM NetworkPolicy", "network_policy", policy.Name)
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestNetworkPolicySpec(t *testing.T) {
+	guacdPeer := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: "guacamole"}},
+		PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "guacd"}},
+	}
+	studentsPeer := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: "guacamole-students"}},
+		PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "guacd"}},
+	}
+	staffPeer := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: "guacamole-staff"}},
+		PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "guacd", "tier": "staff"}},
+	}
+	defaultTarget := &GuacamoleTarget{Name: DefaultGuacamoleInstance}
+	studentsTarget := &GuacamoleTarget{Name: "students", GuacdNamespace: "guacamole-students"}
+	staffTarget := &GuacamoleTarget{
+		Name:           "staff",
+		GuacdNamespace: "guacamole-staff",
+		GuacdPodLabels: map[string]string{"tier": "staff", "app": "guacd"},
+	}
+	operatorPeer := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: "vm-watcher-system"}},
+		PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"control-plane": "controller-manager"}},
+	}
+	tests := []struct {
+		name              string
+		operatorNamespace string
+		port              int32
+		targets           []*GuacamoleTarget
+		wantPeers         []networkingv1.NetworkPolicyPeer
+	}{
+		{name: "rdp with operator probes", operatorNamespace: "vm-watcher-system", port: 3389, wantPeers: []networkingv1.NetworkPolicyPeer{guacdPeer, operatorPeer}},
+		{name: "guacd only", port: 5900, wantPeers: []networkingv1.NetworkPolicyPeer{guacdPeer}},
+		{name: "lowest port", port: 1, wantPeers: []networkingv1.NetworkPolicyPeer{guacdPeer}},
+		{name: "highest port", operatorNamespace: "vm-watcher-system", port: maxPort, wantPeers: []networkingv1.NetworkPolicyPeer{guacdPeer, operatorPeer}},
+		{name: "default instance", port: 3389, targets: []*GuacamoleTarget{defaultTarget}, wantPeers: []networkingv1.NetworkPolicyPeer{guacdPeer}},
+		{
+			name:      "guacd of every instance",
+			port:      3389,
+			targets:   []*GuacamoleTarget{defaultTarget, studentsTarget, staffTarget},
+			wantPeers: []networkingv1.NetworkPolicyPeer{guacdPeer, studentsPeer, staffPeer},
+		},
+		{
+			name:              "instance without the default",
+			operatorNamespace: "vm-watcher-system",
+			port:              3389,
+			targets:           []*GuacamoleTarget{staffTarget},
+			wantPeers:         []networkingv1.NetworkPolicyPeer{staffPeer, operatorPeer},
+		},
+		{
+			name:      "shared guacd listed once",
+			port:      3389,
+			targets:   []*GuacamoleTarget{studentsTarget, defaultTarget, {Name: "exams", GuacdNamespace: "guacamole-students"}},
+			wantPeers: []networkingv1.NetworkPolicyPeer{studentsPeer, guacdPeer},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &VirtualMachineReconciler{
+				GuacdNamespace:    "guacamole",
+				GuacdPodLabels:    map[string]string{"app": "guacd"},
+				OperatorNamespace: tt.operatorNamespace,
+				OperatorPodLabels: map[string]string{"control-plane": "controller-manager"},
+			}
+			vm := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm1", Namespace: "lab-a"}}
+
+			spec := r.networkPolicySpec(vm, tt.port, tt.targets)
+
+			if want := map[string]string{domainLabel: "vm1"}; !reflect.DeepEqual(spec.PodSelector.MatchLabels, want) {
+				t.Errorf("pod selector = %v, want %v", spec.PodSelector.MatchLabels, want)
+			}
+			if want := []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}; !reflect.DeepEqual(spec.PolicyTypes, want) {
+				t.Errorf("policy types = %v, want %v", spec.PolicyTypes, want)
+			}
+			// A single rule: any other rule would open more than the desktop port
+			if len(spec.Ingress) != 1 {
+				t.Fatalf("got %d ingress rules, want 1", len(spec.Ingress))
+			}
+			rule := spec.Ingress[0]
+			if !reflect.DeepEqual(rule.From, tt.wantPeers) {
+				t.Errorf("peers = %+v, want %+v", rule.From, tt.wantPeers)
+			}
+			if len(rule.Ports) != 1 {
+				t.Fatalf("got %d ports, want 1", len(rule.Ports))
+			}
+			port := rule.Ports[0]
+			if port.Protocol == nil || *port.Protocol != corev1.ProtocolTCP {
+				t.Errorf("protocol = %v, want TCP", port.Protocol)
+			}
+			if port.Port == nil || *port.Port != intstr.FromInt32(tt.port) {
+				t.Errorf("port = %v, want %d", port.Port, tt.port)
+			}
+			if port.EndPort != nil {
+				t.Errorf("end port = %d, want a single port", *port.EndPort)
+			}
+		})
+	}
+}
+
+func TestNetworkPolicyEnabled(t *testing.T) {
+	tests := []struct {
+		name        string
+		enabled     bool
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "default off", want: false},
+		{name: "default on", enabled: true, want: true},
+		{name: "annotation enables", annotations: map[string]string{NetworkPolicyAnnotation: " true "}, want: true},
+		{name: "annotation disables", enabled: true, annotations: map[string]string{NetworkPolicyAnnotation: "false"}, want: false},
+		{name: "invalid annotation keeps default", enabled: true, annotations: map[string]string{NetworkPolicyAnnotation: "maybe"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &VirtualMachineReconciler{NetworkPolicyEnabled: tt.enabled}
+			vm := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm1", Annotations: tt.annotations}}
+			if got := r.networkPolicyEnabled(vm); got != tt.want {
+				t.Errorf("networkPolicyEnabled = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
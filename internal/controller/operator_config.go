@@ -0,0 +1,455 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/yaml"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+const (
+	// Name of the ConfigMap holding the operator configuration, in the operator namespace
+	DefaultConfigMapName = "vm-watcher-config"
+	// Key of the configuration file in the ConfigMap
+	ConfigFileKey = "config.yaml"
+
+	// Delay before checking again on a VM that is not running yet
+	DefaultWaitingForRunningDelay = 30 * time.Second
+)
+
+// OperatorConfig is the configuration file read from the ConfigMap. Settings left out keep the value set by flags.
+type OperatorConfig struct {
+	// Default Guacamole instance; its credentials are still taken from the flags or environment
+	Guacamole *GuacamoleEndpointConfig `json:"guacamole,omitempty"`
+	// Connection defaults per protocol (rdp, vnc or ssh)
+	Protocols map[string]ProtocolConfig `json:"protocols,omitempty"`
+	// VMs the operator manages
+	Selector *SelectorConfig `json:"selector,omitempty"`
+	// VMI addresses connections may point at
+	Address *AddressConfig `json:"address,omitempty"`
+	// Requeue delays
+	Retry *RetryConfig `json:"retry,omitempty"`
+	// Feature toggles
+	Features *FeaturesConfig `json:"features,omitempty"`
+}
+
+// GuacamoleEndpointConfig configures the default Guacamole instance
+type GuacamoleEndpointConfig struct {
+	URL        string `json:"url,omitempty"`
+	DataSource string `json:"dataSource,omitempty"`
+}
+
+// ProtocolConfig holds the connection defaults of a protocol
+type ProtocolConfig struct {
+	// Guest port used when the VM has no port annotation
+	Port int `json:"port,omitempty"`
+	// Guacamole connection parameters overriding the built-in defaults
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// SelectorConfig restricts the VMs the operator manages
+type SelectorConfig struct {
+	// Namespaces whose VMs are managed; empty manages every namespace
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Labels the managed VMs must match
+	VMLabelSelector *metav1.LabelSelector `json:"vmLabelSelector,omitempty"`
+}
+
+// AddressConfig selects the VMI address connections point at, overridable per VM with annotations
+type AddressConfig struct {
+	// VM network (spec.template.spec.networks[].name) whose address is used
+	Network *string `json:"network,omitempty"`
+	// Preferred IP family, ipv4 or ipv6
+	IPFamily *string `json:"ipFamily,omitempty"`
+	// CIDRs the address must belong to
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+}
+
+// RetryConfig holds the requeue delays of the VM controller
+type RetryConfig struct {
+	// Delay before retrying after a Guacamole error, doubled after every consecutive failure
+	RetryDelay *metav1.Duration `json:"retryDelay,omitempty"`
+	// Upper bound of the delay between retries
+	MaxRetryDelay *metav1.Duration `json:"maxRetryDelay,omitempty"`
+	// Delay before checking again on a VM that is not running yet
+	WaitingForRunningDelay *metav1.Duration `json:"waitingForRunningDelay,omitempty"`
+	// Delay before probing a guest that was not listening again
+	GuestProbeRetryDelay *metav1.Duration `json:"guestProbeRetryDelay,omitempty"`
+}
+
+// FeaturesConfig toggles optional behaviour, each field overriding the matching flag
+type FeaturesConfig struct {
+	GuestProbe      *string  `json:"guestProbe,omitempty"`
+	ServiceMode     *string  `json:"serviceMode,omitempty"`
+	NetworkPolicy   *bool    `json:"networkPolicy,omitempty"`
+	Recording       *bool    `json:"recording,omitempty"`
+	SharingProfiles []string `json:"sharingProfiles,omitempty"`
+	ObserverGroups  []string `json:"observerGroups,omitempty"`
+	DeletionPolicy  *string  `json:"deletionPolicy,omitempty"`
+}
+
+// operatorSettings are the settings in effect: the flags with the configuration file applied on top
+type operatorSettings struct {
+	revision string // Hash of the configuration file, empty without one
+
+	guacamoleURL        string
+	guacamoleDataSource string
+
+	protocols  map[string]ProtocolConfig
+	namespaces []string
+	vmSelector labels.Selector
+
+	network      string
+	ipFamily     string
+	allowedCIDRs []netip.Prefix
+
+	retryDelay             time.Duration
+	maxRetryDelay          time.Duration
+	waitingForRunningDelay time.Duration
+	guestProbeRetryDelay   time.Duration
+
+	guestProbeMode       string
+	serviceMode          string
+	networkPolicyEnabled bool
+	recordingEnabled     bool
+	sharingProfiles      []string
+	observerGroups       []string
+	deletionPolicy       string
+}
+
+// settings returns the settings in effect
+func (r *VirtualMachineReconciler) settings() *operatorSettings {
+	if settings := r.currentSettings.Load(); settings != nil {
+		return settings
+	}
+	return r.flagSettings()
+}
+
+// flagSettings returns the settings configured by flags
+func (r *VirtualMachineReconciler) flagSettings() *operatorSettings {
+	return &operatorSettings{
+		guacamoleURL:           r.GuacamoleBaseURL,
+		guacamoleDataSource:    r.GuacamoleDataSource,
+		vmSelector:             labels.Everything(),
+		network:                r.Network,
+		ipFamily:               r.IPFamily,
+		allowedCIDRs:           r.AllowedCIDRs,
+		retryDelay:             DefaultRetryDelay,
+		maxRetryDelay:          DefaultMaxRetryDelay,
+		waitingForRunningDelay: DefaultWaitingForRunningDelay,
+		guestProbeRetryDelay:   GuestProbeRetryDelay,
+		guestProbeMode:         r.GuestProbeMode,
+		serviceMode:            r.ServiceMode,
+		networkPolicyEnabled:   r.NetworkPolicyEnabled,
+		recordingEnabled:       r.RecordingEnabled,
+		sharingProfiles:        r.SharingProfiles,
+		observerGroups:         r.ObserverGroups,
+		deletionPolicy:         r.DeletionPolicy,
+	}
+}
+
+// parseOperatorConfig parses a configuration file, rejecting unknown fields
+func parseOperatorConfig(data string) (*OperatorConfig, error) {
+	var config OperatorConfig
+	if err := yaml.UnmarshalStrict([]byte(data), &config); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %w", err)
+	}
+	return &config, nil
+}
+
+// resolveSettings applies the configuration file on top of the flags
+func (r *VirtualMachineReconciler) resolveSettings(revision string, config *OperatorConfig) (*operatorSettings, error) {
+	settings := r.flagSettings()
+	settings.revision = revision
+	if config == nil {
+		return settings, nil
+	}
+
+	if guacamole := config.Guacamole; guacamole != nil {
+		if guacamole.URL != "" {
+			if parsed, err := url.Parse(guacamole.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				return nil, fmt.Errorf("invalid guacamole.url %q", guacamole.URL)
+			}
+			settings.guacamoleURL = guacamole.URL
+		}
+		if guacamole.DataSource != "" {
+			settings.guacamoleDataSource = guacamole.DataSource
+		}
+	}
+
+	for protocol, defaults := range config.Protocols {
+		if protocol != "rdp" && protocol != "vnc" && protocol != "ssh" {
+			return nil, fmt.Errorf("unsupported protocol %q in protocols, only rdp, vnc and ssh are supported", protocol)
+		}
+		if defaults.Port < 0 || defaults.Port > maxPort {
+			return nil, fmt.Errorf("invalid port %d for protocol %s", defaults.Port, protocol)
+		}
+	}
+	settings.protocols = config.Protocols
+
+	if selector := config.Selector; selector != nil {
+		settings.namespaces = selector.Namespaces
+		if selector.VMLabelSelector != nil {
+			vmSelector, err := metav1.LabelSelectorAsSelector(selector.VMLabelSelector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector.vmLabelSelector: %w", err)
+			}
+			settings.vmSelector = vmSelector
+		}
+	}
+
+	if address := config.Address; address != nil {
+		if address.Network != nil {
+			settings.network = *address.Network
+		}
+		if address.IPFamily != nil {
+			if !slices.Contains([]string{"", IPFamilyIPv4, IPFamilyIPv6}, *address.IPFamily) {
+				return nil, fmt.Errorf("unsupported address.ipFamily %q", *address.IPFamily)
+			}
+			settings.ipFamily = *address.IPFamily
+		}
+		if address.AllowedCIDRs != nil {
+			cidrs, err := ParseCIDRs(strings.Join(address.AllowedCIDRs, ","))
+			if err != nil {
+				return nil, fmt.Errorf("invalid address.allowedCIDRs: %w", err)
+			}
+			settings.allowedCIDRs = cidrs
+		}
+	}
+
+	if retry := config.Retry; retry != nil {
+		for _, delay := range []struct {
+			name  string
+			value *metav1.Duration
+			into  *time.Duration
+		}{
+			{"retry.retryDelay", retry.RetryDelay, &settings.retryDelay},
+			{"retry.maxRetryDelay", retry.MaxRetryDelay, &settings.maxRetryDelay},
+			{"retry.waitingForRunningDelay", retry.WaitingForRunningDelay, &settings.waitingForRunningDelay},
+			{"retry.guestProbeRetryDelay", retry.GuestProbeRetryDelay, &settings.guestProbeRetryDelay},
+		} {
+			if delay.value == nil {
+				continue
+			}
+			if delay.value.Duration <= 0 {
+				return nil, fmt.Errorf("%s must be positive", delay.name)
+			}
+			*delay.into = delay.value.Duration
+		}
+	}
+
+	if features := config.Features; features != nil {
+		if features.GuestProbe != nil {
+			if !slices.Contains([]string{GuestProbeTCP, GuestProbeHandshake, GuestProbeNone}, *features.GuestProbe) {
+				return nil, fmt.Errorf("unsupported features.guestProbe %q", *features.GuestProbe)
+			}
+			settings.guestProbeMode = *features.GuestProbe
+		}
+		if features.ServiceMode != nil {
+			if !slices.Contains([]string{ServiceModeNone, ServiceModeClusterIP, ServiceModeHeadless}, *features.ServiceMode) {
+				return nil, fmt.Errorf("unsupported features.serviceMode %q", *features.ServiceMode)
+			}
+			settings.serviceMode = *features.ServiceMode
+		}
+		if features.NetworkPolicy != nil {
+			settings.networkPolicyEnabled = *features.NetworkPolicy
+		}
+		if features.Recording != nil {
+			settings.recordingEnabled = *features.Recording
+		}
+		if features.SharingProfiles != nil {
+			for _, variant := range features.SharingProfiles {
+				if _, supported := sharingProfileParameters[variant]; !supported {
+					return nil, fmt.Errorf("unsupported features.sharingProfiles variant %q, expected %s or %s",
+						variant, SharingProfileReadOnly, SharingProfileFullControl)
+				}
+			}
+			settings.sharingProfiles = features.SharingProfiles
+		}
+		if features.ObserverGroups != nil {
+			settings.observerGroups = features.ObserverGroups
+		}
+		if features.DeletionPolicy != nil {
+			if !isDeletionPolicy(*features.DeletionPolicy) {
+				return nil, fmt.Errorf("unsupported features.deletionPolicy %q", *features.DeletionPolicy)
+			}
+			settings.deletionPolicy = *features.DeletionPolicy
+		}
+	}
+	return settings, nil
+}
+
+// applyConfig switches to the configuration file, or back to the flags when config is nil
+func (r *VirtualMachineReconciler) applyConfig(revision string, config *OperatorConfig) error {
+	settings, err := r.resolveSettings(revision, config)
+	if err != nil {
+		return err
+	}
+	r.currentSettings.Store(settings)
+	return nil
+}
+
+// selects reports whether the operator manages the VM
+func (s *operatorSettings) selects(vm *kubevirtv1.VirtualMachine) bool {
+	if len(s.namespaces) > 0 && !slices.Contains(s.namespaces, vm.Namespace) {
+		return false
+	}
+	return s.vmSelector.Matches(labels.Set(vm.Labels))
+}
+
+// defaultPort returns the configured guest port of the protocol, or "" when it has none
+func (s *operatorSettings) defaultPort(protocol string) string {
+	if port := s.protocols[protocol].Port; port > 0 {
+		return strconv.Itoa(port)
+	}
+	return ""
+}
+
+// configOutdated reports whether the connection was last published with another configuration. The revision
+// is kept in the status object, so that a restart or a new leader does not resync every VM.
+func (r *VirtualMachineReconciler) configOutdated(connection *kubevirtv1alpha1.GuacamoleConnection) bool {
+	return connection.Status.ConfigRevision != r.settings().revision
+}
+
+// resyncAll queues every VM so that a new configuration is applied to it. Only the leader reconciles VMs,
+// on other replicas this is a no-op.
+func (r *VirtualMachineReconciler) resyncAll(ctx context.Context) error {
+	if r.resync == nil {
+		return nil
+	}
+	select {
+	case <-r.elected:
+	default:
+		return nil
+	}
+
+	var vms kubevirtv1.VirtualMachineList
+	if err := r.List(ctx, &vms); err != nil {
+		return fmt.Errorf("failed to list VMs: %w", err)
+	}
+	for i := range vms.Items {
+		select {
+		case r.resync <- event.GenericEvent{Object: &vms.Items[i]}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// OperatorConfigReconciler watches the operator ConfigMap and applies its configuration file to the VM
+// controller without a restart. An invalid file is reported and the previous configuration stays in effect.
+type OperatorConfigReconciler struct {
+	client.Client
+	Reconciler *VirtualMachineReconciler
+	Namespace  string
+	Name       string
+}
+
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+
+// Reconcile loads the configuration file and requeues every VM when it changed
+func (c *OperatorConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	changed, err := c.load(ctx, c.Client)
+	if err != nil || !changed {
+		return ctrl.Result{}, err
+	}
+	if err := c.Reconciler.resyncAll(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// Load applies the configuration file once, before the manager starts, so that the first reconciles already use it.
+// The reader is normally the manager's API reader as the cache is not running yet.
+func (c *OperatorConfigReconciler) Load(ctx context.Context, reader client.Reader) error {
+	_, err := c.load(ctx, reader)
+	return err
+}
+
+// load reads the configuration file and applies it if it changed. An invalid file is logged and not returned
+// as an error: retrying does not help, the next change of the ConfigMap triggers a new attempt.
+func (c *OperatorConfigReconciler) load(ctx context.Context, reader client.Reader) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	var configMap corev1.ConfigMap
+	var config *OperatorConfig
+	revision := ""
+	if err := reader.Get(ctx, client.ObjectKey{Namespace: c.Namespace, Name: c.Name}, &configMap); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return false, fmt.Errorf("failed to get operator ConfigMap: %w", err)
+		}
+		logger.Info("Operator ConfigMap not found, using flag settings", "config_map", c.Name)
+	} else {
+		data := configMap.Data[ConfigFileKey]
+		sum := sha256.Sum256([]byte(data))
+		revision = hex.EncodeToString(sum[:8])
+		if revision == c.Reconciler.settings().revision {
+			return false, nil
+		}
+		if config, err = parseOperatorConfig(data); err != nil {
+			logger.Error(err, "Invalid operator configuration, keeping the previous one", "key", ConfigFileKey)
+			return false, nil
+		}
+	}
+
+	if revision == c.Reconciler.settings().revision {
+		return false, nil
+	}
+	if err := c.Reconciler.applyConfig(revision, config); err != nil {
+		logger.Error(err, "Invalid operator configuration, keeping the previous one", "key", ConfigFileKey)
+		return false, nil
+	}
+	logger.Info("Applied operator configuration", "revision", revision)
+	return true, nil
+}
+
+// SetupWithManager watches the operator ConfigMap. Every replica applies the configuration, not only the leader.
+func (c *OperatorConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	isConfigMap := predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.GetNamespace() == c.Namespace && object.GetName() == c.Name
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.ConfigMap{}, builder.WithPredicates(isConfigMap)).
+		WithOptions(controller.Options{
+			NeedLeaderElection: ptr.To(false),
+		}).
+		Named("operator-config").
+		Complete(c)
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+func TestResolveSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+		check   func(t *testing.T, settings *operatorSettings)
+	}{
+		{
+			name:   "empty file keeps the flags",
+			config: "",
+			check: func(t *testing.T, settings *operatorSettings) {
+				if settings.guestProbeMode != GuestProbeNone || settings.network != "pod" || settings.retryDelay != DefaultRetryDelay {
+					t.Errorf("settings = %+v, want the flag settings", settings)
+				}
+			},
+		},
+		{
+			name: "every section",
+			config: `
+guacamole:
+  url: https://guacamole.example.com/guacamole
+  dataSource: postgresql
+protocols:
+  rdp:
+    port: 3390
+selector:
+  namespaces: [lab-a]
+  vmLabelSelector:
+    matchLabels:
+      remote-desktop: enabled
+address:
+  network: lab-net
+  ipFamily: ipv6
+  allowedCIDRs: [10.10.0.0/16, "fd00::/64"]
+retry:
+  retryDelay: 2m
+  guestProbeRetryDelay: 5s
+features:
+  guestProbe: handshake
+  serviceMode: headless
+  networkPolicy: true
+  sharingProfiles: [read-only, full-control]
+  deletionPolicy: tombstone
+`,
+			check: func(t *testing.T, settings *operatorSettings) {
+				if settings.guacamoleURL != "https://guacamole.example.com/guacamole" || settings.guacamoleDataSource != "postgresql" {
+					t.Errorf("guacamole = %q %q", settings.guacamoleURL, settings.guacamoleDataSource)
+				}
+				if settings.defaultPort("rdp") != "3390" || settings.defaultPort("vnc") != "" {
+					t.Errorf("ports = %q %q, want 3390 and none", settings.defaultPort("rdp"), settings.defaultPort("vnc"))
+				}
+				if !reflect.DeepEqual(settings.namespaces, []string{"lab-a"}) ||
+					!settings.vmSelector.Matches(labels.Set{"remote-desktop": "enabled"}) || settings.vmSelector.Matches(labels.Set{}) {
+					t.Errorf("selector = %v %v", settings.namespaces, settings.vmSelector)
+				}
+				wantCIDRs := []netip.Prefix{netip.MustParsePrefix("10.10.0.0/16"), netip.MustParsePrefix("fd00::/64")}
+				if settings.network != "lab-net" || settings.ipFamily != IPFamilyIPv6 || !reflect.DeepEqual(settings.allowedCIDRs, wantCIDRs) {
+					t.Errorf("address = %q %q %v", settings.network, settings.ipFamily, settings.allowedCIDRs)
+				}
+				if settings.retryDelay != 2*time.Minute || settings.guestProbeRetryDelay != 5*time.Second || settings.maxRetryDelay != DefaultMaxRetryDelay {
+					t.Errorf("retry = %v %v %v", settings.retryDelay, settings.guestProbeRetryDelay, settings.maxRetryDelay)
+				}
+				if settings.guestProbeMode != GuestProbeHandshake || settings.serviceMode != ServiceModeHeadless || !settings.networkPolicyEnabled ||
+					len(settings.sharingProfiles) != 2 || settings.deletionPolicy != DeletionPolicyTombstone {
+					t.Errorf("features = %+v", settings)
+				}
+			},
+		},
+		{
+			name:   "empty allowed CIDRs clear the flag",
+			config: "address:\n  allowedCIDRs: []\n",
+			check: func(t *testing.T, settings *operatorSettings) {
+				if len(settings.allowedCIDRs) != 0 {
+					t.Errorf("allowed CIDRs = %v, want none", settings.allowedCIDRs)
+				}
+			},
+		},
+		{name: "unknown field", config: "features:\n  guestProbes: tcp\n", wantErr: "unknown field"},
+		{name: "invalid url", config: "guacamole:\n  url: ftp://guacamole\n", wantErr: "guacamole.url"},
+		{name: "unsupported protocol", config: "protocols:\n  telnet:\n    port: 23\n", wantErr: "telnet"},
+		{name: "invalid port", config: "protocols:\n  rdp:\n    port: 70000\n", wantErr: "invalid port"},
+		{name: "invalid selector", config: "selector:\n  vmLabelSelector:\n    matchLabels:\n      \"-\": x\n", wantErr: "vmLabelSelector"},
+		{name: "unsupported IP family", config: "address:\n  ipFamily: ipx\n", wantErr: "address.ipFamily"},
+		{name: "invalid CIDR", config: "address:\n  allowedCIDRs: [10.0.0.0/33]\n", wantErr: "address.allowedCIDRs"},
+		{name: "zero delay", config: "retry:\n  retryDelay: 0s\n", wantErr: "retry.retryDelay"},
+		{name: "unsupported guest probe", config: "features:\n  guestProbe: ping\n", wantErr: "features.guestProbe"},
+		{name: "unsupported service mode", config: "features:\n  serviceMode: nodeport\n", wantErr: "features.serviceMode"},
+		{name: "unsupported sharing profile", config: "features:\n  sharingProfiles: [watch]\n", wantErr: "watch"},
+		{name: "unsupported deletion policy", config: "features:\n  deletionPolicy: keep\n", wantErr: "features.deletionPolicy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &VirtualMachineReconciler{GuestProbeMode: GuestProbeNone, Network: "pod"}
+			config, err := parseOperatorConfig(tt.config)
+			var settings *operatorSettings
+			if err == nil {
+				settings, err = r.resolveSettings("rev", config)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if settings.revision != "rev" {
+				t.Errorf("revision = %q, want rev", settings.revision)
+			}
+			tt.check(t, settings)
+		})
+	}
+}
+
+func TestExampleConfigIsValid(t *testing.T) {
+	data, err := os.ReadFile("../../config/manager/service_config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var configMap corev1.ConfigMap
+	if err := yaml.Unmarshal(data, &configMap); err != nil {
+		t.Fatal(err)
+	}
+
+	// The commented out settings are examples too
+	var uncommented []string
+	for _, line := range strings.Split(configMap.Data[ConfigFileKey], "\n") {
+		uncommented = append(uncommented, strings.Replace(line, "# ", "", 1))
+	}
+	for name, file := range map[string]string{"example": configMap.Data[ConfigFileKey], "commented out": strings.Join(uncommented, "\n")} {
+		config, err := parseOperatorConfig(file)
+		if err == nil {
+			_, err = (&VirtualMachineReconciler{}).resolveSettings("", config)
+		}
+		if err != nil {
+			t.Errorf("%s configuration is invalid: %v", name, err)
+		}
+	}
+}
+
+func TestAddressSelectionFollowsConfig(t *testing.T) {
+	r := &VirtualMachineReconciler{Network: "default"}
+	vmi := &kubevirtv1.VirtualMachineInstance{Status: kubevirtv1.VirtualMachineInstanceStatus{
+		Interfaces: []kubevirtv1.VirtualMachineInstanceNetworkInterface{
+			{Name: "default", IP: "10.0.0.5"},
+			{Name: "lab", IP: "192.168.10.7"},
+		},
+	}}
+	address := func() string {
+		t.Helper()
+		ip, err := r.selectInterfaceIP(testVM(nil), vmi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ip
+	}
+
+	if got := address(); got != "10.0.0.5" {
+		t.Errorf("address with flags = %q, want 10.0.0.5", got)
+	}
+	lab := "lab"
+	if err := r.applyConfig("1", &OperatorConfig{Address: &AddressConfig{Network: &lab}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := address(); got != "192.168.10.7" {
+		t.Errorf("address with configured network = %q, want 192.168.10.7", got)
+	}
+	if err := r.applyConfig("", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := address(); got != "10.0.0.5" {
+		t.Errorf("address after removing the configuration = %q, want 10.0.0.5", got)
+	}
+}
+
+func TestOperatorConfigLoad(t *testing.T) {
+	scheme := newTestScheme(t)
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "vm-watcher-system", Name: DefaultConfigMapName},
+		Data:       map[string]string{ConfigFileKey: "features:\n  guestProbe: tcp\n"},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(configMap).Build()
+	r := &VirtualMachineReconciler{GuestProbeMode: GuestProbeNone}
+	loader := &OperatorConfigReconciler{Client: c, Reconciler: r, Namespace: "vm-watcher-system", Name: DefaultConfigMapName}
+	ctx := context.Background()
+
+	load := func(wantChanged bool) {
+		t.Helper()
+		changed, err := loader.load(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != wantChanged {
+			t.Errorf("changed = %v, want %v", changed, wantChanged)
+		}
+	}
+	update := func(data string) {
+		t.Helper()
+		configMap.Data[ConfigFileKey] = data
+		if err := c.Update(ctx, configMap); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load(true)
+	revision := r.settings().revision
+	if revision == "" || r.settings().guestProbeMode != GuestProbeTCP {
+		t.Fatalf("settings = %+v, want the configured guest probe", r.settings())
+	}
+	connection := &kubevirtv1alpha1.GuacamoleConnection{Status: kubevirtv1alpha1.GuacamoleConnectionStatus{ConfigRevision: revision}}
+	if r.configOutdated(connection) {
+		t.Errorf("connection published with the current revision is outdated")
+	}
+
+	// The same file is not applied again
+	load(false)
+
+	// An invalid file keeps the previous configuration
+	update("features:\n  guestProbe: ping\n")
+	load(false)
+	if r.settings().revision != revision || r.settings().guestProbeMode != GuestProbeTCP {
+		t.Errorf("invalid file replaced the configuration: %+v", r.settings())
+	}
+	update("features: [")
+	load(false)
+	if r.settings().revision != revision {
+		t.Errorf("unparsable file replaced the configuration: %+v", r.settings())
+	}
+
+	update("features:\n  guestProbe: handshake\n")
+	load(true)
+	if r.settings().revision == revision || r.settings().guestProbeMode != GuestProbeHandshake {
+		t.Errorf("settings = %+v, want the new revision", r.settings())
+	}
+	if !r.configOutdated(connection) {
+		t.Errorf("connection published with the previous revision is not outdated")
+	}
+
+	// Without the ConfigMap the flags apply again
+	if err := c.Delete(ctx, configMap); err != nil {
+		t.Fatal(err)
+	}
+	load(true)
+	if r.settings().revision != "" || r.settings().guestProbeMode != GuestProbeNone {
+		t.Errorf("settings = %+v, want the flag settings", r.settings())
+	}
+	load(false)
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// Namespace annotation overriding the maximum recording age (e.g., "720h")
+	RecordingMaxAgeAnnotation = "vm-watcher.setofangdar.polito.it/recording-max-age"
+	// Namespace annotation overriding the maximum number of recordings kept
+	RecordingMaxCountAnnotation = "vm-watcher.setofangdar.polito.it/recording-max-count"
+	// Namespace annotation overriding the maximum total recording size (e.g., "20Gi")
+	RecordingMaxSizeAnnotation = "vm-watcher.setofangdar.polito.it/recording-max-size"
+
+	// Recordings modified more recently than this are considered in progress and never touched
+	RecordingSettleTime = time.Minute
+	// Default interval between two retention sweeps
+	DefaultRecordingSweepInterval = 10 * time.Minute
+	// Subresource of VMs a Kubernetes user must be allowed to list to read the recording index of a namespace
+	RecordingsSubresource = "guacamole-recordings"
+)
+
+// RecordingRetention limits how many recordings are kept per namespace. Zero values disable a limit.
+type RecordingRetention struct {
+	MaxAge   time.Duration `json:"maxAge,omitempty"`
+	MaxCount int           `json:"maxCount,omitempty"`
+	MaxBytes int64         `json:"maxBytes,omitempty"`
+}
+
+// RecordingEntry describes a single recording file on the shared volume
+type RecordingEntry struct {
+	Path       string    `json:"path"` // Relative to the recordings root
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	InProgress bool      `json:"inProgress"`
+	Exported   bool      `json:"exported"`
+	ObjectKey  string    `json:"objectKey,omitempty"`
+}
+
+// RecordingNamespaceIndex lists the recordings kept for one namespace
+type RecordingNamespaceIndex struct {
+	Namespace  string             `json:"namespace"`
+	Count      int                `json:"count"`
+	TotalBytes int64              `json:"totalBytes"`
+	Retention  RecordingRetention `json:"retention"`
+	Recordings []RecordingEntry   `json:"recordings"`
+}
+
+// RecordingJanitor periodically indexes the session recordings written by guacd, exports them to an
+// S3-compatible object store and deletes the ones falling outside the retention policy.
+// The index is served as JSON by ServeHTTP to Kubernetes users allowed to list the guacamole-recordings
+// subresource of VMs in the requested namespace, or in every namespace for the full index.
+//
+// Every replica indexes the recordings, so that any of them can serve the index, but only the leader
+// exports and deletes them.
+type RecordingJanitor struct {
+	client.Client
+	RootDir     string // Recordings volume as mounted in the operator, laid out as <root>/<namespace>/<file>
+	Interval    time.Duration
+	Retention   RecordingRetention // Default retention, overridable per namespace with annotations
+	Exporter    *S3Exporter        // Optional; when set, recordings are exported before they can be deleted
+	Elected     <-chan struct{}    // Closed once this replica leads, e.g. the manager's Elected(). Nil always leads.
+	BindAddress string             // Address the index is served on; empty disables it
+	TLS         ServingTLS
+
+	mu        sync.RWMutex
+	index     []RecordingNamespaceIndex
+	exported  map[string]bool // Relative paths already present in the object store
+	lastSweep time.Time
+}
+
+// Start runs the retention loop until the context is cancelled
+func (j *RecordingJanitor) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("recording-janitor")
+	ctx = log.IntoContext(ctx, logger)
+
+	interval := j.Interval
+	if interval <= 0 {
+		interval = DefaultRecordingSweepInterval
+	}
+
+	logger.Info("Starting recording janitor", "root", j.RootDir, "interval", interval, "export", j.Exporter != nil)
+
+	serveErr := make(chan error, 1)
+	if j.BindAddress != "" {
+		indexLogger := logger.WithName("recording-index")
+		mux := http.NewServeMux()
+		mux.HandleFunc("/recordings", func(w http.ResponseWriter, req *http.Request) {
+			j.ServeHTTP(w, req.WithContext(log.IntoContext(req.Context(), indexLogger)))
+		})
+		server := &http.Server{
+			Addr:              j.BindAddress,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		logger.Info("Serving recording index", "address", j.BindAddress, "tls", j.TLS.CertFile != "")
+		go func() { serveErr <- serveHTTP(log.IntoContext(ctx, indexLogger), server, j.TLS) }()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := j.sweep(ctx); err != nil {
+			logger.Error(err, "Recording sweep failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			if j.BindAddress != "" {
+				return <-serveErr
+			}
+			return nil
+		case err := <-serveErr:
+			if err != nil {
+				return fmt.Errorf("failed to serve recording index: %w", err)
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection lets every replica index the recordings. Exports and deletions wait for leadership.
+func (j *RecordingJanitor) NeedLeaderElection() bool {
+	return false
+}
+
+// leading reports whether this replica may export and delete recordings
+func (j *RecordingJanitor) leading() bool {
+	if j.Elected == nil {
+		return true
+	}
+	select {
+	case <-j.Elected:
+		return true
+	default:
+		return false
+	}
+}
+
+// sweep indexes every namespace directory and, on the leader, applies exports and retention
+func (j *RecordingJanitor) sweep(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	leading := j.leading()
+
+	namespaceDirs, err := os.ReadDir(j.RootDir)
+	if err != nil {
+		return err
+	}
+
+	j.mu.RLock()
+	exported := j.exported
+	j.mu.RUnlock()
+	if exported == nil {
+		exported = make(map[string]bool)
+	}
+	seen := make(map[string]bool)
+
+	var index []RecordingNamespaceIndex
+	for _, dir := range namespaceDirs {
+		if !dir.IsDir() {
+			continue
+		}
+		namespace := dir.Name()
+		retention := j.retentionFor(ctx, namespace)
+
+		entries, err := j.listRecordings(namespace)
+		if err != nil {
+			logger.Error(err, "Failed to list recordings", "namespace", namespace)
+			continue
+		}
+
+		// Newest first, so count and size limits drop the oldest recordings
+		sort.Slice(entries, func(a, b int) bool { return entries[a].ModTime.After(entries[b].ModTime) })
+
+		nsIndex := RecordingNamespaceIndex{Namespace: namespace, Retention: retention}
+		for _, entry := range entries {
+			seen[entry.Path] = true
+			age := time.Since(entry.ModTime)
+			entry.InProgress = age < RecordingSettleTime
+
+			if j.Exporter != nil {
+				entry.ObjectKey = j.Exporter.ObjectKey(entry.Path)
+				if !entry.InProgress && !exported[entry.Path] {
+					if done, err := j.export(ctx, entry, leading); err != nil {
+						logger.Error(err, "Failed to export recording", "path", entry.Path)
+					} else {
+						exported[entry.Path] = done
+					}
+				}
+				entry.Exported = exported[entry.Path]
+			}
+
+			expired := !entry.InProgress &&
+				((retention.MaxAge > 0 && age > retention.MaxAge) ||
+					(retention.MaxCount > 0 && nsIndex.Count >= retention.MaxCount) ||
+					(retention.MaxBytes > 0 && nsIndex.TotalBytes+entry.Size > retention.MaxBytes))
+
+			// Only the leader deletes, other replicas keep listing the recording until it does
+			if expired && leading && (j.Exporter == nil || entry.Exported) {
+				if err := os.Remove(filepath.Join(j.RootDir, entry.Path)); err != nil {
+					logger.Error(err, "Failed to delete expired recording", "path", entry.Path)
+				} else {
+					logger.Info("Deleted expired recording", "namespace", namespace, "path", entry.Path, "size", entry.Size)
+					delete(exported, entry.Path)
+					continue
+				}
+			} else if expired && leading {
+				logger.Info("Keeping expired recording until it is exported", "namespace", namespace, "path", entry.Path)
+			}
+
+			nsIndex.Count++
+			nsIndex.TotalBytes += entry.Size
+			nsIndex.Recordings = append(nsIndex.Recordings, entry)
+		}
+		index = append(index, nsIndex)
+	}
+
+	// Forget export state of files that no longer exist
+	for path := range exported {
+		if !seen[path] {
+			delete(exported, path)
+		}
+	}
+
+	j.mu.Lock()
+	j.index = index
+	j.exported = exported
+	j.lastSweep = time.Now()
+	j.mu.Unlock()
+
+	return nil
+}
+
+// listRecordings returns every regular file below the namespace directory
+func (j *RecordingJanitor) listRecordings(namespace string) ([]RecordingEntry, error) {
+	var entries []RecordingEntry
+	err := filepath.WalkDir(filepath.Join(j.RootDir, namespace), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(j.RootDir, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, RecordingEntry{
+			Path:    filepath.ToSlash(relative),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// export uploads a recording unless the object store already has it, and reports whether the store has it.
+// Without upload, the recording is only looked up.
+func (j *RecordingJanitor) export(ctx context.Context, entry RecordingEntry, upload bool) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	exists, err := j.Exporter.Exists(ctx, entry.ObjectKey)
+	if err != nil || exists || !upload {
+		return exists, err
+	}
+
+	if err := j.Exporter.Upload(ctx, entry.ObjectKey, filepath.Join(j.RootDir, entry.Path)); err != nil {
+		return false, err
+	}
+
+	logger.Info("Exported recording", "path", entry.Path, "object_key", entry.ObjectKey, "size", entry.Size)
+	return true, nil
+}
+
+// retentionFor returns the retention policy for a namespace, applying its annotation overrides
+func (j *RecordingJanitor) retentionFor(ctx context.Context, namespace string) RecordingRetention {
+	logger := log.FromContext(ctx)
+	retention := j.Retention
+
+	var ns corev1.Namespace
+	if err := j.Get(ctx, client.ObjectKey{Name: namespace}, &ns); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			logger.Error(err, "Failed to get namespace, using default retention", "namespace", namespace)
+		}
+		return retention
+	}
+
+	if value, exists := ns.Annotations[RecordingMaxAgeAnnotation]; exists {
+		if maxAge, err := time.ParseDuration(value); err == nil {
+			retention.MaxAge = maxAge
+		} else {
+			logger.Error(err, "Invalid recording max age annotation", "namespace", namespace, "value", value)
+		}
+	}
+	if value, exists := ns.Annotations[RecordingMaxCountAnnotation]; exists {
+		if maxCount, err := strconv.Atoi(value); err == nil {
+			retention.MaxCount = maxCount
+		} else {
+			logger.Error(err, "Invalid recording max count annotation", "namespace", namespace, "value", value)
+		}
+	}
+	if value, exists := ns.Annotations[RecordingMaxSizeAnnotation]; exists {
+		if maxSize, err := resource.ParseQuantity(value); err == nil {
+			retention.MaxBytes = maxSize.Value()
+		} else {
+			logger.Error(err, "Invalid recording max size annotation", "namespace", namespace, "value", value)
+		}
+	}
+
+	return retention
+}
+
+// ServeHTTP serves the recording index as JSON, optionally filtered with ?namespace=. The caller authenticates
+// with a Kubernetes bearer token, like for connection links.
+func (j *RecordingJanitor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	logger := log.FromContext(ctx)
+
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	namespace := req.URL.Query().Get("namespace")
+	bearer, found := bearerToken(req)
+	if !found {
+		http.Error(w, "missing Kubernetes bearer token", http.StatusUnauthorized)
+		return
+	}
+	user, err := reviewToken(ctx, j.Client, bearer)
+	if err != nil {
+		logger.Info("Rejected recording index request", "reason", err.Error())
+		http.Error(w, "invalid Kubernetes bearer token", http.StatusUnauthorized)
+		return
+	}
+	// An empty namespace asks for access in every namespace
+	if err := reviewAccess(ctx, j.Client, user, authorizationv1.ResourceAttributes{
+		Namespace:   namespace,
+		Verb:        "list",
+		Group:       kubevirtv1.GroupVersion.Group,
+		Resource:    "virtualmachines",
+		Subresource: RecordingsSubresource,
+	}); err != nil {
+		if errors.Is(err, errNotAllowed) {
+			http.Error(w, fmt.Sprintf("%s may not list %s of VMs", user.Username, RecordingsSubresource), http.StatusForbidden)
+			return
+		}
+		logger.Error(err, "Failed to authorize recording index request", "user", user.Username)
+		http.Error(w, "failed to authorize request", http.StatusInternalServerError)
+		return
+	}
+
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	response := struct {
+		LastSweep  time.Time                 `json:"lastSweep"`
+		Namespaces []RecordingNamespaceIndex `json:"namespaces"`
+	}{LastSweep: j.lastSweep, Namespaces: []RecordingNamespaceIndex{}}
+	for _, nsIndex := range j.index {
+		if namespace == "" || nsIndex.Namespace == namespace {
+			response.Namespaces = append(response.Namespaces, nsIndex)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error(err, "Failed to encode recording index")
+	}
+}
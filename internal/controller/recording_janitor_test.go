@@ -0,0 +1,188 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// writeRecording writes a recording of the namespace last modified age ago
+func writeRecording(t *testing.T, root, namespace, name string, age time.Duration) string {
+	t.Helper()
+	dir := filepath.Join(root, namespace)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("guac"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// indexedPaths returns the recordings in the janitor's index
+func indexedPaths(j *RecordingJanitor) []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	var paths []string
+	for _, nsIndex := range j.index {
+		for _, entry := range nsIndex.Recordings {
+			paths = append(paths, entry.Path)
+		}
+	}
+	return paths
+}
+
+func TestRecordingJanitorOnlyLeaderDeletes(t *testing.T) {
+	root := t.TempDir()
+	expired := writeRecording(t, root, "lab-a", "old", 2*time.Hour)
+	writeRecording(t, root, "lab-a", "new", 2*RecordingSettleTime)
+
+	elected := make(chan struct{})
+	j := &RecordingJanitor{
+		Client:    fake.NewClientBuilder().WithScheme(newTestScheme(t)).Build(),
+		RootDir:   root,
+		Retention: RecordingRetention{MaxAge: time.Hour},
+		Elected:   elected,
+	}
+
+	if err := j.sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(expired); err != nil {
+		t.Errorf("follower deleted an expired recording: %v", err)
+	}
+	if got := indexedPaths(j); len(got) != 2 {
+		t.Errorf("follower index = %v, want both recordings", got)
+	}
+
+	close(elected)
+	if err := j.sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("leader kept an expired recording: %v", err)
+	}
+	if got := indexedPaths(j); len(got) != 1 || got[0] != "lab-a/new" {
+		t.Errorf("leader index = %v, want [lab-a/new]", got)
+	}
+}
+
+func TestRecordingJanitorOnlyLeaderExports(t *testing.T) {
+	root := t.TempDir()
+	writeRecording(t, root, "lab-a", "rec", 2*RecordingSettleTime)
+
+	var mu sync.Mutex
+	stored := map[string]bool{}
+	uploads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "HEAD":
+			if !stored[r.URL.Path] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "PUT":
+			stored[r.URL.Path] = true
+			uploads++
+		}
+	}))
+	defer server.Close()
+
+	elected := make(chan struct{})
+	j := &RecordingJanitor{
+		Client:   fake.NewClientBuilder().WithScheme(newTestScheme(t)).Build(),
+		RootDir:  root,
+		Exporter: &S3Exporter{Endpoint: server.URL, Bucket: "recordings"},
+		Elected:  elected,
+	}
+
+	if err := j.sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if uploads != 0 {
+		t.Errorf("follower uploaded %d recordings", uploads)
+	}
+	if j.exported["lab-a/rec"] {
+		t.Errorf("follower reports a missing recording as exported")
+	}
+
+	close(elected)
+	if err := j.sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if uploads != 1 || !j.exported["lab-a/rec"] {
+		t.Errorf("leader uploads = %d, exported = %v, want one exported recording", uploads, j.exported["lab-a/rec"])
+	}
+
+	// A follower learns about recordings the leader exported
+	follower := &RecordingJanitor{
+		Client:   j.Client,
+		RootDir:  root,
+		Exporter: j.Exporter,
+		Elected:  make(chan struct{}),
+	}
+	if err := follower.sweep(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if uploads != 1 || !follower.exported["lab-a/rec"] {
+		t.Errorf("follower uploads = %d, exported = %v, want the leader's export", uploads, follower.exported["lab-a/rec"])
+	}
+}
+
+func TestRecordingJanitorServesIndexOverTLS(t *testing.T) {
+	certFile, keyFile, pool := writeTestCertificate(t)
+	address := freeAddress(t)
+	j := &RecordingJanitor{
+		Client:      fake.NewClientBuilder().WithScheme(newTestScheme(t)).Build(),
+		RootDir:     t.TempDir(),
+		Elected:     make(chan struct{}), // Followers serve the index too
+		BindAddress: address,
+		TLS:         ServingTLS{CertFile: certFile, KeyFile: keyFile},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- j.Start(ctx) }()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := getWhenReady(t, client, "https://"+address+"/recordings")
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status without a bearer token = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Start() error = %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+const (
+	// Default upper bound of the delay between two retries of a failing VM
+	DefaultMaxRetryDelay = 30 * time.Minute
+	// Fraction by which a retry delay is randomly shortened or lengthened
+	retryJitter = 0.2
+)
+
+// retryLater records a failed attempt to sync the VM's connection and returns when to retry. The delay
+// starts at the retry delay and doubles with every consecutive failure up to the maximum, with jitter so that
+// VMs failing together do not retry in lockstep. After MaxRetryAttempts failures the connection is Degraded.
+func (r *VirtualMachineReconciler) retryLater(ctx context.Context, vm *kubevirtv1.VirtualMachine, connectionStatus *kubevirtv1alpha1.GuacamoleConnection, cause error) ctrl.Result {
+	logger := log.FromContext(ctx)
+	settings := r.settings()
+
+	r.retriesMu.Lock()
+	if r.retries == nil {
+		r.retries = make(map[client.ObjectKey]int)
+	}
+	key := client.ObjectKeyFromObject(vm)
+	r.retries[key]++
+	failures := r.retries[key]
+	r.retriesMu.Unlock()
+
+	delay := backoffDelay(settings.retryDelay, settings.maxRetryDelay, failures)
+	logger.Info("Retrying later", "vm", vm.Name, "failures", failures, "retry_in", delay.Round(time.Second))
+
+	if failures >= MaxRetryAttempts && connectionStatus != nil {
+		changed, err := r.setCondition(ctx, connectionStatus, kubevirtv1alpha1.ConditionDegraded, metav1.ConditionTrue,
+			ReasonRetriesExhausted, fmt.Sprintf("Failed %d times in a row, still retrying: %v", failures, cause))
+		if err != nil {
+			logger.Error(err, "Failed to update connection status")
+		}
+		if changed && failures == MaxRetryAttempts {
+			r.recordEvent(vm, corev1.EventTypeWarning, EventDegraded,
+				"Guacamole connection failed %d times in a row, retrying with backoff: %v", failures, cause)
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: delay}
+}
+
+// resetRetries forgets the failures of the VM after a successful sync and clears its Degraded condition
+func (r *VirtualMachineReconciler) resetRetries(ctx context.Context, vm *kubevirtv1.VirtualMachine, connectionStatus *kubevirtv1alpha1.GuacamoleConnection) {
+	r.forgetRetries(vm)
+
+	if !meta.IsStatusConditionTrue(connectionStatus.Status.Conditions, kubevirtv1alpha1.ConditionDegraded) {
+		return
+	}
+	if _, err := r.setCondition(ctx, connectionStatus, kubevirtv1alpha1.ConditionDegraded, metav1.ConditionFalse,
+		ReasonRecovered, "Guacamole connection synced"); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update connection status")
+	}
+}
+
+// forgetRetries drops the failure count of the VM
+func (r *VirtualMachineReconciler) forgetRetries(vm *kubevirtv1.VirtualMachine) {
+	r.retriesMu.Lock()
+	defer r.retriesMu.Unlock()
+	delete(r.retries, client.ObjectKeyFromObject(vm))
+}
+
+// backoffDelay returns the delay before the next retry after the given number of consecutive failures
+func backoffDelay(base, maxDelay time.Duration, failures int) time.Duration {
+	delay := base
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		if delay > maxDelay/2 {
+			// Doubling would pass the maximum, or overflow with a very large one
+			delay = maxDelay
+			break
+		}
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	jittered := float64(delay) * (1 + retryJitter*(2*rand.Float64()-1))
+	if jittered >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(jittered)
+}
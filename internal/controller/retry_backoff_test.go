@@ -0,0 +1,54 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     time.Duration
+		maxDelay time.Duration
+		failures int
+		want     time.Duration // Before jitter
+	}{
+		{name: "first failure", base: 5 * time.Second, maxDelay: time.Minute, failures: 1, want: 5 * time.Second},
+		{name: "doubles", base: 5 * time.Second, maxDelay: time.Minute, failures: 3, want: 20 * time.Second},
+		{name: "capped", base: 5 * time.Second, maxDelay: time.Minute, failures: 5, want: time.Minute},
+		{name: "many failures", base: 5 * time.Second, maxDelay: time.Minute, failures: 1000, want: time.Minute},
+		{name: "base above maximum", base: 2 * time.Minute, maxDelay: time.Minute, failures: 1, want: time.Minute},
+		{name: "huge maximum", base: time.Second, maxDelay: math.MaxInt64, failures: 100, want: math.MaxInt64},
+		{name: "no failures", base: 5 * time.Second, maxDelay: time.Minute, failures: 0, want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 100 {
+				got := backoffDelay(tt.base, tt.maxDelay, tt.failures)
+				low := time.Duration(float64(tt.want) * (1 - retryJitter))
+				high := time.Duration(math.MaxInt64)
+				if jittered := float64(tt.want) * (1 + retryJitter); jittered < math.MaxInt64 {
+					high = time.Duration(jittered)
+				}
+				if got <= 0 || got < low || got > high {
+					t.Fatalf("backoffDelay(%v, %v, %d) = %v, want within [%v, %v]",
+						tt.base, tt.maxDelay, tt.failures, got, low, high)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// S3Exporter uploads files to an S3-compatible object store (AWS S3, MinIO, ...) using
+// path-style requests signed with AWS Signature Version 4
+type S3Exporter struct {
+	Endpoint        string // Object store endpoint (e.g., http://minio.minio.svc:9000)
+	Region          string
+	Bucket          string
+	Prefix          string // Optional key prefix for every uploaded object
+	AccessKeyID     string
+	SecretAccessKey string
+	HTTPClient      *http.Client
+}
+
+// ObjectKey returns the object key used for a file relative to the recordings root
+func (e *S3Exporter) ObjectKey(relativePath string) string {
+	key := strings.TrimPrefix(relativePath, "/")
+	if e.Prefix != "" {
+		key = strings.TrimSuffix(e.Prefix, "/") + "/" + key
+	}
+	return key
+}
+
+// Exists reports whether an object with the given key is already stored
+func (e *S3Exporter) Exists(ctx context.Context, key string) (bool, error) {
+	req, err := e.newRequest(ctx, "HEAD", key, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := e.client().Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to check object %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("object check for %s failed with status %d", key, resp.StatusCode)
+	}
+}
+
+// Upload stores the file at filePath under the given key
+func (e *S3Exporter) Upload(ctx context.Context, key, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	// SigV4 signs the payload hash, so hash the file first and rewind for the upload
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", filePath, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind %s: %w", filePath, err)
+	}
+
+	req, err := e.newRequest(ctx, "PUT", key, file, size, hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := e.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body := make([]byte, 1024)
+		n, _ := resp.Body.Read(body)
+		return fmt.Errorf("upload of %s failed with status %d: %s", key, resp.StatusCode, string(body[:n]))
+	}
+
+	return nil
+}
+
+func (e *S3Exporter) client() *http.Client {
+	if e.HTTPClient != nil {
+		return e.HTTPClient
+	}
+	return &http.Client{Timeout: 5 * time.Minute}
+}
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// newRequest builds a path-style object request signed with AWS Signature Version 4
+func (e *S3Exporter) newRequest(ctx context.Context, method, key string, body io.Reader, size int64, payloadHash string) (*http.Request, error) {
+	endpoint, err := url.Parse(e.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object store endpoint %q: %w", e.Endpoint, err)
+	}
+
+	objectPath := "/" + e.Bucket + "/" + key
+	endpoint.Path = objectPath
+	endpoint.RawPath = escapeS3Path(objectPath)
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create object store request: %w", err)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	region := e.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		endpoint.RawPath,
+		"",
+		"host:" + endpoint.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", shortDate, region)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+e.SecretAccessKey), shortDate)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		e.AccessKeyID, scope, signedHeaders, signature))
+
+	return req, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// escapeS3Path URI-encodes the object path as required by SigV4: everything except
+// unreserved characters and the path separators is percent-encoded
+func escapeS3Path(objectPath string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(objectPath); i++ {
+		c := objectPath[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ServingTLS is the certificate of a server the operator exposes to users. Their requests carry Kubernetes or
+// Guacamole tokens, so the server refuses to start without a certificate unless plain HTTP is allowed.
+type ServingTLS struct {
+	CertFile       string // PEM certificate, e.g. from a cert-manager Secret mounted in the operator
+	KeyFile        string
+	AllowPlaintext bool // Serve plain HTTP when no certificate is set. Only meant for development.
+}
+
+// Validate reports whether a server can start with these settings
+func (t ServingTLS) Validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("the certificate and key files must be set together")
+	}
+	if t.CertFile == "" && !t.AllowPlaintext {
+		return errors.New("a TLS certificate is required, since tokens would otherwise travel in plain text")
+	}
+	return nil
+}
+
+// serveHTTP runs the server until the context is cancelled. With a certificate it serves TLS and reloads the
+// certificate when its files change, so that a renewed certificate is used without a restart.
+func serveHTTP(ctx context.Context, server *http.Server, servingTLS ServingTLS) error {
+	logger := log.FromContext(ctx)
+
+	if err := servingTLS.Validate(); err != nil {
+		return err
+	}
+	if servingTLS.CertFile != "" {
+		watcher, err := certwatcher.New(servingTLS.CertFile, servingTLS.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		go func() {
+			if err := watcher.Start(ctx); err != nil {
+				logger.Error(err, "Failed to watch TLS certificate")
+			}
+		}()
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: watcher.GetCertificate,
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error(err, "Failed to shut down server")
+		}
+	}()
+
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logger.Info("Serving plain HTTP, tokens are sent unencrypted")
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
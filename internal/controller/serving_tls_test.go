@@ -0,0 +1,190 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServingTLSValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tls     ServingTLS
+		wantErr bool
+	}{
+		{name: "certificate", tls: ServingTLS{CertFile: "tls.crt", KeyFile: "tls.key"}},
+		{name: "plaintext allowed", tls: ServingTLS{AllowPlaintext: true}},
+		{name: "plaintext refused", tls: ServingTLS{}, wantErr: true},
+		{name: "certificate without key", tls: ServingTLS{CertFile: "tls.crt", AllowPlaintext: true}, wantErr: true},
+		{name: "key without certificate", tls: ServingTLS{KeyFile: "tls.key"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.tls.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and returns its files and pool
+func writeTestCertificate(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vm-watcher"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return certFile, keyFile, pool
+}
+
+// freeAddress returns a local address nothing listens on
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close() //nolint:errcheck
+	return listener.Addr().String()
+}
+
+// startTestServer serves a fixed body with serveHTTP until the test ends and returns its address
+func startTestServer(t *testing.T, servingTLS ServingTLS) string {
+	t.Helper()
+	address := freeAddress(t)
+	server := &http.Server{
+		Addr: address,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = io.WriteString(w, "ok")
+		}),
+		ReadHeaderTimeout: time.Second,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serveHTTP(ctx, server, servingTLS) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("serveHTTP() error = %v", err)
+		}
+	})
+	return address
+}
+
+// getWhenReady retries until the server accepts connections
+func getWhenReady(t *testing.T, client *http.Client, url string) (*http.Response, error) {
+	t.Helper()
+	var resp *http.Response
+	var err error
+	for range 50 {
+		if resp, err = client.Get(url); err == nil {
+			return resp, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, err
+}
+
+func TestServeHTTPWithCertificate(t *testing.T) {
+	certFile, keyFile, pool := writeTestCertificate(t)
+	address := startTestServer(t, ServingTLS{CertFile: certFile, KeyFile: keyFile})
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := getWhenReady(t, client, "https://"+address+"/")
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("body = %q, want ok", body)
+	}
+	if resp.TLS == nil || resp.TLS.Version < tls.VersionTLS12 {
+		t.Errorf("connection is not TLS 1.2 or later: %+v", resp.TLS)
+	}
+
+	// Tokens must not be accepted over plain HTTP on the same port
+	if resp, err := http.Get("http://" + address + "/"); err == nil {
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("plain HTTP request was served")
+		}
+	}
+}
+
+func TestServeHTTPPlaintext(t *testing.T) {
+	address := startTestServer(t, ServingTLS{AllowPlaintext: true})
+
+	resp, err := getWhenReady(t, http.DefaultClient, "http://"+address+"/")
+	if err != nil {
+		t.Fatalf("HTTP request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestServeHTTPRefusesPlaintext(t *testing.T) {
+	server := &http.Server{Addr: freeAddress(t), ReadHeaderTimeout: time.Second}
+	if err := serveHTTP(context.Background(), server, ServingTLS{}); err == nil {
+		t.Errorf("serveHTTP() without certificate succeeded")
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Default interval between two polls of Guacamole session data
+	DefaultSessionPollInterval = 30 * time.Second
+	// Default duration under which a finished session is counted as a short session
+	DefaultShortSessionThreshold = 10 * time.Second
+)
+
+// SessionMetricsCollector periodically polls Guacamole's active connections and connection history
+// and exports them as Prometheus metrics for the VMs managed by the operator
+type SessionMetricsCollector struct {
+	Reconciler            *VirtualMachineReconciler // Provides the Guacamole and Kubernetes clients
+	Interval              time.Duration
+	ShortSessionThreshold time.Duration
+	// Export the active sessions per user, one series per user and VM. Without it the user label is empty.
+	UserLabel bool
+
+	// Sessions of an instance that ended at or before its watermark have already been observed
+	started    time.Time
+	watermarks map[string]time.Time
+	// Active sessions per instance as of its last successful poll, and the label sets exported from them
+	instanceSessions map[string]map[sessionKey]int
+	exportedSessions map[sessionKey]int
+}
+
+// sessionKey identifies the active sessions of one user on one VM, or of all users if the user label is off
+type sessionKey struct {
+	namespace, vm, user string
+}
+
+// Start polls Guacamole until the context is cancelled
+func (c *SessionMetricsCollector) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("session-metrics")
+	ctx = log.IntoContext(ctx, logger)
+
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultSessionPollInterval
+	}
+
+	// Only sessions finishing after startup are observed, older history was counted by a previous run
+	c.started = time.Now()
+	c.watermarks = make(map[string]time.Time)
+	c.instanceSessions = make(map[string]map[sessionKey]int)
+
+	logger.Info("Starting Guacamole session metrics collector", "interval", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if err := c.poll(ctx); err != nil {
+			sessionPollErrors.Inc()
+			logger.Error(err, "Failed to poll Guacamole sessions")
+		}
+	}
+}
+
+// NeedLeaderElection avoids polling Guacamole from every replica
+func (c *SessionMetricsCollector) NeedLeaderElection() bool {
+	return true
+}
+
+// poll refreshes the active session gauge and observes sessions finished since the last poll
+func (c *SessionMetricsCollector) poll(ctx context.Context) error {
+	r := c.Reconciler
+
+	managed, err := r.managedConnectionNames(ctx)
+	if err != nil {
+		return err
+	}
+	namespaces, err := r.namespaceNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	targets, err := r.allGuacamoleTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	// An instance that fails to answer keeps the values of its last successful poll, so that an outage or a
+	// scrape during the poll does not report every session as closed
+	polled := make(map[string]bool, len(targets))
+	var errs []error
+	for _, target := range targets {
+		polled[target.Name] = true
+		sessions, err := c.pollInstance(ctx, target, managed, namespaces)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("instance %s: %w", target.Name, err))
+			continue
+		}
+		c.instanceSessions[target.Name] = sessions
+	}
+	// Removed instances disappear
+	for instance := range c.instanceSessions {
+		if !polled[instance] {
+			delete(c.instanceSessions, instance)
+			managedConnections.DeleteLabelValues(instance)
+			orphanConnections.DeleteLabelValues(instance)
+		}
+	}
+	c.exportSessions()
+	return errors.Join(errs...)
+}
+
+// exportSessions sets the active session gauge to the sum over the instances, deleting the label sets of
+// sessions that were closed
+func (c *SessionMetricsCollector) exportSessions() {
+	totals := make(map[sessionKey]int)
+	for _, sessions := range c.instanceSessions {
+		for key, count := range sessions {
+			totals[key] += count
+		}
+	}
+	for key := range c.exportedSessions {
+		if _, open := totals[key]; !open {
+			activeSessions.DeleteLabelValues(key.namespace, key.vm, key.user)
+		}
+	}
+	for key, count := range totals {
+		activeSessions.WithLabelValues(key.namespace, key.vm, key.user).Set(float64(count))
+	}
+	c.exportedSessions = totals
+}
+
+// pollInstance returns the active sessions of one instance, sets its managed and orphan connection counts
+// and observes its sessions finished since the last poll
+func (c *SessionMetricsCollector) pollInstance(ctx context.Context, target *GuacamoleTarget, managed map[string]client.ObjectKey, namespaces []string) (map[sessionKey]int, error) {
+	r := c.Reconciler
+
+	authResp, err := r.authenticateWithGuacamole(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	connections, err := r.listGuacamoleConnections(ctx, authResp)
+	if err != nil {
+		return nil, err
+	}
+	active, err := r.listActiveConnections(ctx, authResp)
+	if err != nil {
+		return nil, err
+	}
+	history, err := r.listConnectionHistory(ctx, authResp)
+	if err != nil {
+		return nil, err
+	}
+
+	managedCount, orphanCount := 0, 0
+	for _, connection := range connections {
+		if _, managedVM := managed[connection.Name]; managedVM {
+			managedCount++
+		} else if isOrphanConnection(connection, managed, namespaces) {
+			orphanCount++
+		}
+	}
+	managedConnections.WithLabelValues(target.Name).Set(float64(managedCount))
+	orphanConnections.WithLabelValues(target.Name).Set(float64(orphanCount))
+
+	sessions := make(map[sessionKey]int)
+	for _, session := range active {
+		connection, exists := connections[session.ConnectionIdentifier]
+		if !exists {
+			continue
+		}
+		vmKey, managedVM := managed[connection.Name]
+		if !managedVM {
+			continue
+		}
+		key := sessionKey{namespace: vmKey.Namespace, vm: vmKey.Name}
+		if c.UserLabel {
+			key.user = session.Username
+		}
+		sessions[key]++
+	}
+
+	shortSessionThreshold := c.ShortSessionThreshold
+	if shortSessionThreshold <= 0 {
+		shortSessionThreshold = DefaultShortSessionThreshold
+	}
+
+	// Instances seen for the first time only report sessions finishing after startup
+	watermark, seen := c.watermarks[target.Name]
+	if !seen {
+		watermark = c.started
+	}
+
+	newWatermark := watermark
+	for _, entry := range history {
+		end := entry.End()
+		if entry.Active || end.IsZero() || !end.After(watermark) {
+			continue
+		}
+		if end.After(newWatermark) {
+			newWatermark = end
+		}
+
+		vmKey, managedVM := managed[entry.ConnectionName]
+		if !managedVM {
+			continue
+		}
+
+		duration := end.Sub(entry.Start())
+		sessionDuration.WithLabelValues(vmKey.Namespace, vmKey.Name).Observe(duration.Seconds())
+		if duration < shortSessionThreshold {
+			shortSessions.WithLabelValues(vmKey.Namespace, vmKey.Name).Inc()
+		}
+	}
+	c.watermarks[target.Name] = newWatermark
+
+	return sessions, nil
+}
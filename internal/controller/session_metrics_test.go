@@ -0,0 +1,135 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// sessionServer serves the connections, active sessions and history of a Guacamole data source
+func sessionServer(t *testing.T, started time.Time) *httptest.Server {
+	at := func(offset time.Duration) int64 { return started.Add(offset).UnixMilli() }
+	ended := func(offset time.Duration) *int64 {
+		end := at(offset)
+		return &end
+	}
+	responses := map[string]interface{}{
+		"connections": map[string]GuacamoleConnectionResponse{
+			"1": {Identifier: "1", ParentIdentifier: "ROOT", Name: "lab-vm"},
+			"2": {Identifier: "2", ParentIdentifier: "ROOT", Name: "manual"},
+		},
+		"activeConnections": map[string]GuacamoleActiveConnection{
+			"a": {ConnectionIdentifier: "1", Username: "alice"},
+			"b": {ConnectionIdentifier: "1", Username: "bob"},
+			"c": {ConnectionIdentifier: "2", Username: "carol"},
+		},
+		"history/connections": []GuacamoleHistoryEntry{
+			{ConnectionName: "lab-vm", Active: true, StartDate: at(time.Minute)},
+			{ConnectionName: "lab-vm", StartDate: at(time.Second), EndDate: ended(3 * time.Second)},
+			{ConnectionName: "lab-vm", StartDate: at(time.Second), EndDate: ended(time.Hour)},
+			{ConnectionName: "manual", StartDate: at(time.Second), EndDate: ended(2 * time.Second)},
+			// Finished before startup, counted by a previous run
+			{ConnectionName: "lab-vm", StartDate: at(-time.Hour), EndDate: ended(-time.Hour + time.Second)},
+		},
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		response, exists := responses[req.URL.Path[len("/api/session/data/postgresql/"):]]
+		if !exists {
+			t.Errorf("unexpected request %s", req.URL.Path)
+			http.NotFound(w, req)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func TestSessionMetricsPollInstance(t *testing.T) {
+	tests := []struct {
+		name      string
+		userLabel bool
+		want      map[sessionKey]int
+	}{
+		{
+			name: "sessions per VM",
+			want: map[sessionKey]int{{namespace: "lab", vm: "vm"}: 2},
+		},
+		{
+			name:      "sessions per user",
+			userLabel: true,
+			want:      map[sessionKey]int{{namespace: "lab", vm: "vm", user: "alice"}: 1, {namespace: "lab", vm: "vm", user: "bob"}: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := time.Now().Add(-2 * time.Hour)
+			server := sessionServer(t, started)
+			defer server.Close()
+			shortSessions.Reset()
+			activeSessions.Reset()
+			t.Cleanup(func() {
+				shortSessions.Reset()
+				activeSessions.Reset()
+			})
+
+			r, authResp := batchTestReconciler(server, 0, 0)
+			r.storeToken(authResp.target, authResp)
+			c := &SessionMetricsCollector{
+				Reconciler:       r,
+				UserLabel:        tt.userLabel,
+				started:          started,
+				watermarks:       map[string]time.Time{},
+				instanceSessions: map[string]map[sessionKey]int{},
+			}
+			managed := map[string]client.ObjectKey{"lab-vm": {Namespace: "lab", Name: "vm"}}
+
+			sessions, err := c.pollInstance(context.Background(), authResp.target, managed, []string{"lab"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != len(tt.want) {
+				t.Fatalf("sessions = %v, want %v", sessions, tt.want)
+			}
+			for key, count := range tt.want {
+				if sessions[key] != count {
+					t.Errorf("sessions = %v, want %v", sessions, tt.want)
+				}
+			}
+
+			c.instanceSessions[authResp.target.Name] = sessions
+			c.exportSessions()
+			if got := testutil.CollectAndCount(activeSessions); got != len(tt.want) {
+				t.Errorf("exported %d active session series, want %d", got, len(tt.want))
+			}
+
+			// Only the managed VM's session that ended 2s after starting and after startup is short
+			if got := testutil.ToFloat64(shortSessions.WithLabelValues("lab", "vm")); got != 1 {
+				t.Errorf("short sessions = %v, want 1", got)
+			}
+			if got := testutil.CollectAndCount(shortSessions); got != 1 {
+				t.Errorf("exported %d short session series, want 1", got)
+			}
+			if got, want := c.watermarks[authResp.target.Name], started.Add(time.Hour); !got.Equal(want.Truncate(time.Millisecond)) {
+				t.Errorf("watermark = %v, want %v", got, want)
+			}
+		})
+	}
+}
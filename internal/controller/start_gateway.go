@@ -0,0 +1,322 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// +kubebuilder:rbac:groups=subresources.kubevirt.io,resources=virtualmachines/start,verbs=update
+
+const (
+	// Default time the gateway waits for a stopped VM to boot and open its remote-desktop port
+	DefaultGatewayStartTimeout = 3 * time.Minute
+	// Interval between two checks while waiting for a VM to come up
+	gatewayPollInterval = 2 * time.Second
+)
+
+// errNotAllowed is returned when the Guacamole user has no access to the requested connection
+var errNotAllowed = errors.New("not allowed to use this connection")
+
+// gatewayConnection is the VM's connection in one Guacamole instance
+type gatewayConnection struct {
+	authResp     *GuacamoleAuthResponse
+	connectionID string
+}
+
+// GuacamoleEffectivePermissions represents the permissions a Guacamole user has, including group permissions
+type GuacamoleEffectivePermissions struct {
+	ConnectionPermissions map[string][]string `json:"connectionPermissions"`
+	SystemPermissions     []string            `json:"systemPermissions"`
+}
+
+// StartGateway serves /connect/<namespace>/<vm>. When a Guacamole user who may use the VM's connection
+// opens that URL, the gateway starts the VM if it is stopped, waits for the guest remote-desktop port,
+// points the connection at the VM's current address and redirects the browser to the Guacamole client.
+//
+// The caller authenticates with their own Guacamole auth token, passed as the "token" query parameter
+// or the Guacamole-Token header, so the gateway is served over TLS.
+type StartGateway struct {
+	Reconciler     *VirtualMachineReconciler // Provides the Guacamole and Kubernetes clients
+	VMSubresources rest.Interface            // Client of the KubeVirt subresource API, see NewVMSubresourceClient
+	BindAddress    string
+	TLS            ServingTLS
+	StartTimeout   time.Duration
+}
+
+// NewVMSubresourceClient returns a client of the subresources.kubevirt.io API, which starts and stops VMs
+func NewVMSubresourceClient(config *rest.Config, httpClient *http.Client) (rest.Interface, error) {
+	config = rest.CopyConfig(config)
+	config.APIPath = "/apis"
+	config.GroupVersion = &schema.GroupVersion{Group: "subresources.kubevirt.io", Version: "v1"}
+	config.NegotiatedSerializer = serializer.NewCodecFactory(nil).WithoutConversion()
+	if httpClient == nil {
+		return rest.RESTClientFor(config)
+	}
+	return rest.RESTClientForConfigAndClient(config, httpClient)
+}
+
+// Start serves the gateway until the context is cancelled
+func (g *StartGateway) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("start-gateway")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect/", func(w http.ResponseWriter, req *http.Request) {
+		g.handleConnect(log.IntoContext(req.Context(), logger), w, req)
+	})
+
+	server := &http.Server{
+		Addr:              g.BindAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	logger.Info("Starting start-on-connect gateway", "address", g.BindAddress, "tls", g.TLS.CertFile != "")
+	return serveHTTP(log.IntoContext(ctx, logger), server, g.TLS)
+}
+
+// NeedLeaderElection lets every replica serve the gateway
+func (g *StartGateway) NeedLeaderElection() bool {
+	return false
+}
+
+// handleConnect starts the requested VM if needed and redirects to its Guacamole connection
+func (g *StartGateway) handleConnect(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(ctx)
+	r := g.Reconciler
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/connect/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "expected /connect/<namespace>/<vm>", http.StatusNotFound)
+		return
+	}
+	vmKey := client.ObjectKey{Namespace: parts[0], Name: parts[1]}
+
+	userToken := req.URL.Query().Get("token")
+	if userToken == "" {
+		userToken = req.Header.Get("Guacamole-Token")
+	}
+	if userToken == "" {
+		http.Error(w, "missing Guacamole auth token", http.StatusUnauthorized)
+		return
+	}
+
+	var vm kubevirtv1.VirtualMachine
+	if err := r.Get(ctx, vmKey, &vm); err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			http.Error(w, "VM not found", http.StatusNotFound)
+			return
+		}
+		logger.Error(err, "Failed to get VM", "vm", vmKey)
+		http.Error(w, "failed to get VM", http.StatusInternalServerError)
+		return
+	}
+
+	targets, err := r.guacamoleTargetsFor(ctx, &vm)
+	if err != nil {
+		logger.Error(err, "Failed to resolve Guacamole instances", "vm", vmKey)
+		http.Error(w, "Guacamole unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Find the VM's connection in its instances; the user must be allowed to use it in one of them
+	connectionName := fmt.Sprintf("%s-%s", vm.Namespace, vm.Name)
+	var published []gatewayConnection
+	chosen := -1
+	unavailable, forbidden := false, false
+	for _, target := range targets {
+		authResp, err := r.authenticateWithGuacamole(ctx, target)
+		if err != nil {
+			logger.Error(err, "Failed to authenticate with Guacamole", "instance", target.Name)
+			unavailable = true
+			continue
+		}
+		connectionID, err := r.findGuacamoleConnectionID(ctx, authResp, connectionName)
+		if err != nil {
+			logger.Error(err, "Failed to look up Guacamole connection", "connection_name", connectionName, "instance", target.Name)
+			unavailable = true
+			continue
+		}
+		if connectionID == "" {
+			continue
+		}
+		published = append(published, gatewayConnection{authResp: authResp, connectionID: connectionID})
+		if chosen >= 0 {
+			continue
+		}
+
+		// Only users who may use the connection in Guacamole may start the VM
+		if err := g.authorize(ctx, authResp, userToken, connectionID); err == nil {
+			chosen = len(published) - 1
+		} else if errors.Is(err, errNotAllowed) {
+			forbidden = true
+		} else {
+			logger.Info("Rejected start-on-connect request", "vm", vmKey, "instance", target.Name, "reason", err.Error())
+		}
+	}
+
+	switch {
+	case chosen >= 0:
+	case forbidden:
+		http.Error(w, errNotAllowed.Error(), http.StatusForbidden)
+		return
+	case len(published) > 0:
+		http.Error(w, "invalid Guacamole auth token", http.StatusUnauthorized)
+		return
+	case unavailable:
+		http.Error(w, "Guacamole unavailable", http.StatusBadGateway)
+		return
+	default:
+		http.Error(w, "no Guacamole connection for this VM", http.StatusNotFound)
+		return
+	}
+
+	startCtx, cancel := context.WithTimeout(ctx, g.startTimeout())
+	defer cancel()
+
+	if vm.Status.PrintableStatus != kubevirtv1.VirtualMachineStatusRunning {
+		logger.Info("Starting VM on connect", "vm", vm.Name, "namespace", vm.Namespace, "status", vm.Status.PrintableStatus)
+		if err := g.startVM(startCtx, &vm); err != nil {
+			logger.Error(err, "Failed to start VM", "vm", vmKey)
+			http.Error(w, fmt.Sprintf("failed to start VM: %v", err), http.StatusConflict)
+			return
+		}
+	}
+
+	if err := g.waitForGuest(startCtx, &vm); err != nil {
+		logger.Error(err, "VM did not become reachable", "vm", vmKey)
+		http.Error(w, "VM did not become reachable in time, try again later", http.StatusGatewayTimeout)
+		return
+	}
+
+	// The VM may have come back with a different address
+	for i, connection := range published {
+		if err := r.updateGuacamoleConnection(ctx, connection.authResp, &vm, connection.connectionID); err != nil {
+			logger.Error(err, "Failed to update Guacamole connection", "vm", vmKey, "instance", connection.authResp.target.Name)
+			if i == chosen {
+				http.Error(w, "failed to update Guacamole connection", http.StatusBadGateway)
+				return
+			}
+		}
+	}
+
+	connection := published[chosen]
+	http.Redirect(w, req, r.guacamoleClientURL(connection.authResp, connection.connectionID), http.StatusFound)
+}
+
+// authorize checks with the user's own token that they can read the connection
+func (g *StartGateway) authorize(ctx context.Context, authResp *GuacamoleAuthResponse, userToken, connectionID string) error {
+	r := g.Reconciler
+	userAuth := &GuacamoleAuthResponse{AuthToken: userToken, DataSource: authResp.DataSource, target: authResp.target}
+
+	var permissions GuacamoleEffectivePermissions
+	if err := r.doGuacamoleRequest(ctx, userAuth, "GET", "self/effectivePermissions", nil, &permissions); err != nil {
+		return fmt.Errorf("failed to get user permissions: %w", err)
+	}
+
+	if slices.Contains(permissions.SystemPermissions, "ADMINISTER") ||
+		slices.Contains(permissions.ConnectionPermissions[connectionID], "READ") {
+		return nil
+	}
+	return errNotAllowed
+}
+
+// startVM asks KubeVirt to start the VM with the start subresource, as virtctl start does. KubeVirt applies
+// the request to the VM's own run strategy, so a RerunOnFailure or Manual VM keeps its strategy.
+func (g *StartGateway) startVM(ctx context.Context, vm *kubevirtv1.VirtualMachine) error {
+	err := g.VMSubresources.Put().
+		Namespace(vm.Namespace).
+		Resource("virtualmachines").
+		Name(vm.Name).
+		SubResource("start").
+		SetHeader("Content-Type", "application/json").
+		Body([]byte("{}")).
+		Do(ctx).
+		Error()
+	// KubeVirt refuses to start a VM that is already starting, e.g. an Always VM that is still scheduling
+	if apierrors.IsConflict(err) {
+		log.FromContext(ctx).Info("VM is already starting", "vm", vm.Name, "namespace", vm.Namespace, "reason", err.Error())
+		return nil
+	}
+	return err
+}
+
+// waitForGuest waits until the VMI reports an IP and the remote-desktop port accepts connections
+func (g *StartGateway) waitForGuest(ctx context.Context, vm *kubevirtv1.VirtualMachine) error {
+	r := g.Reconciler
+	ticker := time.NewTicker(gatewayPollInterval)
+	defer ticker.Stop()
+
+	for {
+		var vmi kubevirtv1.VirtualMachineInstance
+		if err := r.Get(ctx, client.ObjectKeyFromObject(vm), &vmi); err == nil {
+			ip, err := r.selectInterfaceIP(vm, &vmi)
+			if err != nil {
+				return err
+			}
+			if ip != "" {
+				connection, err := r.buildGuacamoleConnection(ctx, vm)
+				if err != nil {
+					return err
+				}
+				address := net.JoinHostPort(connection.Parameters["hostname"], connection.Parameters["port"])
+				conn, err := (&net.Dialer{Timeout: gatewayPollInterval}).DialContext(ctx, "tcp", address)
+				if err == nil {
+					conn.Close()
+					return nil
+				}
+			}
+		} else if client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to get VMI: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// guacamoleClientURL returns the web client URL opening the given connection of the instance
+func (r *VirtualMachineReconciler) guacamoleClientURL(authResp *GuacamoleAuthResponse, connectionID string) string {
+	// The client identifier is base64("<id>\x00c\x00<data source>"), "c" denoting a connection
+	clientID := base64.StdEncoding.EncodeToString([]byte(connectionID + "\x00c\x00" + authResp.DataSource))
+	return fmt.Sprintf("%s/#/client/%s", strings.TrimSuffix(authResp.target.BaseURL, "/"), url.PathEscape(clientID))
+}
+
+func (g *StartGateway) startTimeout() time.Duration {
+	if g.StartTimeout > 0 {
+		return g.StartTimeout
+	}
+	return DefaultGatewayStartTimeout
+}
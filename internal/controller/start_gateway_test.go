@@ -0,0 +1,162 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestStartGatewayStartVM(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "started", status: http.StatusAccepted},
+		{name: "already starting", status: http.StatusConflict},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				method, path = req.Method, req.URL.Path
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				_ = json.NewEncoder(w).Encode(metav1.Status{Status: metav1.StatusFailure, Code: int32(tt.status)})
+			}))
+			defer server.Close()
+
+			subresources, err := NewVMSubresourceClient(&rest.Config{Host: server.URL}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g := &StartGateway{VMSubresources: subresources}
+
+			// The run strategy is left to KubeVirt, the gateway never writes the VM spec
+			rerun := kubevirtv1.RunStrategyRerunOnFailure
+			vm := &kubevirtv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "lab", Name: "vm1"},
+				Spec:       kubevirtv1.VirtualMachineSpec{RunStrategy: &rerun},
+			}
+			err = g.startVM(context.Background(), vm)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("startVM() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if method != http.MethodPut || path != "/apis/subresources.kubevirt.io/v1/namespaces/lab/virtualmachines/vm1/start" {
+				t.Errorf("request = %s %s, want PUT on the start subresource", method, path)
+			}
+			if *vm.Spec.RunStrategy != kubevirtv1.RunStrategyRerunOnFailure {
+				t.Errorf("run strategy = %s, want %s", *vm.Spec.RunStrategy, kubevirtv1.RunStrategyRerunOnFailure)
+			}
+		})
+	}
+}
+
+func TestStartGatewayAuthorize(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		permissions GuacamoleEffectivePermissions
+		want        error // errNotAllowed when the user may not use the connection
+		wantOther   bool  // The token is rejected by Guacamole
+	}{
+		{
+			name:        "connection READ",
+			permissions: GuacamoleEffectivePermissions{ConnectionPermissions: map[string][]string{"7": {"READ"}}},
+		},
+		{
+			name:        "administrator",
+			permissions: GuacamoleEffectivePermissions{SystemPermissions: []string{"ADMINISTER"}},
+		},
+		{
+			name:        "other connection",
+			permissions: GuacamoleEffectivePermissions{ConnectionPermissions: map[string][]string{"8": {"READ"}}},
+			want:        errNotAllowed,
+		},
+		{
+			name:        "update without READ",
+			permissions: GuacamoleEffectivePermissions{ConnectionPermissions: map[string][]string{"7": {"UPDATE"}}},
+			want:        errNotAllowed,
+		},
+		{name: "invalid token", status: http.StatusForbidden, wantOther: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var token string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/api/session/data/postgresql/self/effectivePermissions" {
+					http.NotFound(w, req)
+					return
+				}
+				token = req.URL.Query().Get("token")
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(tt.permissions)
+			}))
+			defer server.Close()
+
+			r, authResp := batchTestReconciler(server, 0, 0)
+			g := &StartGateway{Reconciler: r}
+			err := g.authorize(context.Background(), authResp, "user-token", "7")
+			switch {
+			case tt.wantOther:
+				if err == nil || errors.Is(err, errNotAllowed) {
+					t.Errorf("authorize() error = %v, want a token error", err)
+				}
+			case !errors.Is(err, tt.want) || (tt.want == nil && err != nil):
+				t.Errorf("authorize() error = %v, want %v", err, tt.want)
+			}
+			// Permissions are those of the user, never of the operator
+			if token != "user-token" {
+				t.Errorf("permissions requested with token %q, want the user's token", token)
+			}
+		})
+	}
+}
+
+func TestStartGatewayRejectsRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{name: "missing VM", path: "/connect/lab", wantStatus: http.StatusNotFound},
+		{name: "extra segment", path: "/connect/lab/vm1/more?token=t", wantStatus: http.StatusNotFound},
+		{name: "missing token", path: "/connect/lab/vm1", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &StartGateway{Reconciler: &VirtualMachineReconciler{}}
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+			g.handleConnect(context.Background(), w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
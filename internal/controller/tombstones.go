@@ -0,0 +1,375 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// Annotation overriding the deletion policy for a VM ("best-effort", "block" or "tombstone")
+	DeletionPolicyAnnotation = "vm-watcher.setofangdar.polito.it/deletion-policy"
+
+	// Remove the finalizer even if the connection could not be deleted everywhere
+	DeletionPolicyBestEffort = "best-effort"
+	// Keep the finalizer until the connection is deleted everywhere, or the deletion timeout passes
+	DeletionPolicyBlock = "block"
+	// Record the connections that could not be deleted as tombstones and remove the finalizer, the
+	// tombstone collector deletes them once the instance is reachable again
+	DeletionPolicyTombstone = "tombstone"
+
+	// Default time the finalizer is kept while a connection cannot be deleted or recorded
+	DefaultDeletionTimeout = 10 * time.Minute
+	// Name of the ConfigMap holding the tombstones, in the operator namespace
+	DefaultTombstoneConfigMapName = "vm-watcher-tombstones"
+	// Default interval between two attempts to delete the connections recorded as tombstones
+	DefaultTombstoneCollectInterval = time.Minute
+)
+
+// Tombstone records a connection that could not be deleted when its VM was deleted
+type Tombstone struct {
+	Instance   string      `json:"instance"`
+	Connection string      `json:"connection"`
+	Namespace  string      `json:"namespace"`
+	VM         string      `json:"vm"`
+	VMUID      types.UID   `json:"vmUID,omitempty"`
+	DeletedAt  metav1.Time `json:"deletedAt"`
+}
+
+// key returns the ConfigMap key of the tombstone. Kubernetes names cannot contain underscores, so the key
+// is unique per instance and connection.
+func (t *Tombstone) key() string {
+	return t.Instance + "_" + t.Connection
+}
+
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=create;get;list;patch;update;watch
+
+// TombstoneStore keeps the tombstones in a ConfigMap, one key per instance and connection
+type TombstoneStore struct {
+	Client client.Client
+	// Reader reads the ConfigMap, normally the manager's API reader since only the configuration ConfigMap is cached
+	Reader    client.Reader
+	Namespace string
+	Name      string
+}
+
+// Add records the tombstones, replacing those of the same instance and connection
+func (s *TombstoneStore) Add(ctx context.Context, tombstones ...Tombstone) error {
+	if len(tombstones) == 0 {
+		return nil
+	}
+	return s.update(ctx, func(data map[string]string) error {
+		for i := range tombstones {
+			value, err := json.Marshal(&tombstones[i])
+			if err != nil {
+				return fmt.Errorf("failed to encode tombstone: %w", err)
+			}
+			data[tombstones[i].key()] = string(value)
+		}
+		return nil
+	})
+}
+
+// Remove drops the tombstones
+func (s *TombstoneStore) Remove(ctx context.Context, tombstones ...Tombstone) error {
+	if len(tombstones) == 0 {
+		return nil
+	}
+	return s.update(ctx, func(data map[string]string) error {
+		for i := range tombstones {
+			delete(data, tombstones[i].key())
+		}
+		return nil
+	})
+}
+
+// List returns the recorded tombstones. Entries that cannot be decoded are logged and skipped.
+func (s *TombstoneStore) List(ctx context.Context) ([]Tombstone, error) {
+	var configMap corev1.ConfigMap
+	if err := s.Reader.Get(ctx, s.key(), &configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get tombstone ConfigMap: %w", err)
+	}
+
+	tombstones := make([]Tombstone, 0, len(configMap.Data))
+	for key, value := range configMap.Data {
+		var tombstone Tombstone
+		if err := json.Unmarshal([]byte(value), &tombstone); err != nil {
+			log.FromContext(ctx).Error(err, "Skipping invalid tombstone", "key", key)
+			continue
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+	observeTombstones(tombstones)
+	return tombstones, nil
+}
+
+// update applies the change to the ConfigMap data, creating the ConfigMap if needed and retrying on conflicts
+func (s *TombstoneStore) update(ctx context.Context, change func(data map[string]string) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var configMap corev1.ConfigMap
+		err := s.Reader.Get(ctx, s.key(), &configMap)
+		notFound := apierrors.IsNotFound(err)
+		if err != nil && !notFound {
+			return fmt.Errorf("failed to get tombstone ConfigMap: %w", err)
+		}
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		if err := change(configMap.Data); err != nil {
+			return err
+		}
+
+		if notFound {
+			configMap.Namespace, configMap.Name = s.Namespace, s.Name
+			err = s.Client.Create(ctx, &configMap)
+			if apierrors.IsAlreadyExists(err) {
+				// Created concurrently, apply the change to that one
+				return apierrors.NewConflict(corev1.Resource("configmaps"), s.Name, err)
+			}
+		} else {
+			err = s.Client.Update(ctx, &configMap)
+		}
+		if err != nil {
+			return err
+		}
+		observeTombstoneData(configMap.Data)
+		return nil
+	})
+}
+
+func (s *TombstoneStore) key() client.ObjectKey {
+	return client.ObjectKey{Namespace: s.Namespace, Name: s.Name}
+}
+
+// observeTombstoneData counts the tombstones of the ConfigMap data per instance
+func observeTombstoneData(data map[string]string) {
+	tombstoneCount.Reset()
+	for key := range data {
+		instance, _, _ := strings.Cut(key, "_")
+		tombstoneCount.WithLabelValues(instance).Inc()
+	}
+}
+
+// observeTombstones counts the tombstones per instance
+func observeTombstones(tombstones []Tombstone) {
+	tombstoneCount.Reset()
+	for _, tombstone := range tombstones {
+		tombstoneCount.WithLabelValues(tombstone.Instance).Inc()
+	}
+}
+
+// deletionPolicyFor returns the deletion policy for the VM, preferring the annotation over the default
+func (r *VirtualMachineReconciler) deletionPolicyFor(ctx context.Context, vm *kubevirtv1.VirtualMachine) string {
+	policy := r.settings().deletionPolicy
+	if value, exists := vm.Annotations[DeletionPolicyAnnotation]; exists {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if isDeletionPolicy(value) {
+			policy = value
+		} else {
+			log.FromContext(ctx).Info("Ignoring unsupported deletion policy annotation", "vm", vm.Name, "policy", value)
+		}
+	}
+	if policy == "" {
+		policy = DeletionPolicyBestEffort
+	}
+	if policy == DeletionPolicyTombstone && r.Tombstones == nil {
+		policy = DeletionPolicyBestEffort
+	}
+	return policy
+}
+
+// isDeletionPolicy reports whether the value names a supported deletion policy
+func isDeletionPolicy(value string) bool {
+	return value == DeletionPolicyBestEffort || value == DeletionPolicyBlock || value == DeletionPolicyTombstone
+}
+
+// deletionTimeLeft returns the time left before the deletion timeout of the VM passes, zero once it passed
+func (r *VirtualMachineReconciler) deletionTimeLeft(vm *kubevirtv1.VirtualMachine) time.Duration {
+	timeout := r.DeletionTimeout
+	if timeout <= 0 {
+		timeout = DefaultDeletionTimeout
+	}
+	if vm.DeletionTimestamp == nil {
+		return timeout
+	}
+	return max(time.Until(vm.DeletionTimestamp.Add(timeout)), 0)
+}
+
+// deletionTimedOut reports whether the VM was deleted longer than the deletion timeout ago
+func (r *VirtualMachineReconciler) deletionTimedOut(vm *kubevirtv1.VirtualMachine) bool {
+	return vm.DeletionTimestamp != nil && r.deletionTimeLeft(vm) == 0
+}
+
+// handleFailedCleanup applies the deletion policy to the instances the connection could not be deleted
+// from. It reports whether the finalizer must be kept for now.
+func (r *VirtualMachineReconciler) handleFailedCleanup(ctx context.Context, vm *kubevirtv1.VirtualMachine, connectionName string, failed []*GuacamoleTarget, resolveErr error) bool {
+	policy := r.deletionPolicyFor(ctx, vm)
+	timedOut := r.deletionTimedOut(vm)
+
+	if policy != DeletionPolicyBestEffort && !timedOut {
+		// Instances that could not be resolved cannot be recorded either, only waiting helps
+		if resolveErr != nil || (policy == DeletionPolicyBlock && len(failed) > 0) {
+			return true
+		}
+	}
+
+	// Tombstones, also for a blocking deletion that timed out
+	if policy != DeletionPolicyBestEffort && len(failed) > 0 && r.Tombstones != nil {
+		tombstones := make([]Tombstone, 0, len(failed))
+		for _, target := range failed {
+			tombstones = append(tombstones, Tombstone{
+				Instance:   target.Name,
+				Connection: connectionName,
+				Namespace:  vm.Namespace,
+				VM:         vm.Name,
+				VMUID:      vm.UID,
+				DeletedAt:  metav1.Now(),
+			})
+		}
+		if err := r.Tombstones.Add(ctx, tombstones...); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to record tombstones", "connection_name", connectionName)
+			if !timedOut {
+				return true
+			}
+		} else {
+			for _, target := range failed {
+				r.recordEvent(vm, corev1.EventTypeWarning, EventCleanupDeferred,
+					"Guacamole connection %s could not be deleted from instance %s, it will be deleted once the instance is reachable",
+					connectionName, target.Name)
+			}
+			failed = nil
+		}
+	}
+
+	for _, target := range failed {
+		r.recordEvent(vm, corev1.EventTypeWarning, EventCleanupSkipped,
+			"Removing finalizer without deleting Guacamole connection %s from instance %s", connectionName, target.Name)
+	}
+	if resolveErr != nil {
+		r.recordEvent(vm, corev1.EventTypeWarning, EventCleanupSkipped,
+			"Removing finalizer without deleting Guacamole connection %s from unresolved instances: %v", connectionName, resolveErr)
+	}
+	return false
+}
+
+// TombstoneCollector deletes the connections recorded as tombstones, once their instance is reachable again
+type TombstoneCollector struct {
+	Reconciler *VirtualMachineReconciler // Provides the Guacamole and Kubernetes clients
+	Interval   time.Duration
+}
+
+// Start collects the tombstones until the context is cancelled
+func (c *TombstoneCollector) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("tombstone-collector")
+	ctx = log.IntoContext(ctx, logger)
+
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultTombstoneCollectInterval
+	}
+
+	logger.Info("Starting tombstone collector", "interval", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.collect(ctx); err != nil {
+			logger.Error(err, "Tombstone collection failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection makes sure only one replica deletes connections
+func (c *TombstoneCollector) NeedLeaderElection() bool {
+	return true
+}
+
+// collect tries to delete the connection of every tombstone, dropping the tombstones that are done with
+func (c *TombstoneCollector) collect(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	r := c.Reconciler
+
+	tombstones, err := r.Tombstones.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var done []Tombstone
+	var errs []error
+	for _, tombstone := range tombstones {
+		// A VM created again with the same name owns the connection now
+		var vm kubevirtv1.VirtualMachine
+		err := r.Get(ctx, client.ObjectKey{Namespace: tombstone.Namespace, Name: tombstone.VM}, &vm)
+		switch {
+		case err == nil && vm.UID != tombstone.VMUID:
+			logger.Info("Dropping tombstone of a re-created VM", "instance", tombstone.Instance, "connection_name", tombstone.Connection)
+			done = append(done, tombstone)
+			continue
+		case err == nil:
+			// The deleted VM is still finalizing
+			continue
+		case !apierrors.IsNotFound(err):
+			errs = append(errs, fmt.Errorf("failed to get VM %s/%s: %w", tombstone.Namespace, tombstone.VM, err))
+			continue
+		}
+
+		target, err := r.guacamoleTarget(ctx, tombstone.Instance)
+		if err != nil {
+			if apierrors.IsNotFound(err) || errors.Is(err, ErrDefaultInstanceNotConfigured) {
+				logger.Info("Dropping tombstone of a removed Guacamole instance", "instance", tombstone.Instance, "connection_name", tombstone.Connection)
+				done = append(done, tombstone)
+				continue
+			}
+			errs = append(errs, err)
+			continue
+		}
+		if err := r.deleteGuacamoleConnectionByName(ctx, target, tombstone.Connection); err != nil {
+			errs = append(errs, fmt.Errorf("instance %s: failed to delete connection %s: %w", tombstone.Instance, tombstone.Connection, err))
+			continue
+		}
+		logger.Info("Deleted Guacamole connection recorded as tombstone", "instance", tombstone.Instance,
+			"connection_name", tombstone.Connection, "deleted_at", tombstone.DeletedAt)
+		done = append(done, tombstone)
+	}
+
+	if err := r.Tombstones.Remove(ctx, done...); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
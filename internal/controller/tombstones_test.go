@@ -0,0 +1,152 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// concurrentTombstone is written by another replica while the store is applying its change
+const concurrentTombstone = `{"instance":"other","connection":"lab-old","namespace":"lab","vm":"old","deletedAt":null}`
+
+func TestTombstoneStoreConflicts(t *testing.T) {
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "system", Name: "tombstones"},
+		Data:       map[string]string{"default_lab-gone": `{"instance":"default","connection":"lab-gone","namespace":"lab","vm":"gone","deletedAt":null}`},
+	}
+	tests := []struct {
+		name     string
+		existing *corev1.ConfigMap
+		// Writes of another replica racing the first write of the store
+		concurrentCreate, concurrentUpdate bool
+		want                               []string
+	}{
+		{name: "created", want: []string{"default_lab-vm"}},
+		{name: "updated", existing: existing, want: []string{"default_lab-gone", "default_lab-vm"}},
+		{name: "created concurrently", concurrentCreate: true, want: []string{"default_lab-vm", "other_lab-old"}},
+		{
+			name: "updated concurrently", existing: existing, concurrentUpdate: true,
+			want: []string{"default_lab-gone", "default_lab-vm", "other_lab-old"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := fake.NewClientBuilder().WithScheme(newTestScheme(t))
+			if tt.existing != nil {
+				builder = builder.WithObjects(tt.existing.DeepCopy())
+			}
+			raced := false
+			builder = builder.WithInterceptorFuncs(interceptor.Funcs{
+				Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+					if tt.concurrentCreate && !raced {
+						raced = true
+						other := &corev1.ConfigMap{
+							ObjectMeta: metav1.ObjectMeta{Namespace: obj.GetNamespace(), Name: obj.GetName()},
+							Data:       map[string]string{"other_lab-old": concurrentTombstone},
+						}
+						if err := c.Create(ctx, other); err != nil {
+							return err
+						}
+					}
+					return c.Create(ctx, obj, opts...)
+				},
+				Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+					if tt.concurrentUpdate && !raced {
+						raced = true
+						var other corev1.ConfigMap
+						if err := c.Get(ctx, client.ObjectKeyFromObject(obj), &other); err != nil {
+							return err
+						}
+						other.Data["other_lab-old"] = concurrentTombstone
+						if err := c.Update(ctx, &other); err != nil {
+							return err
+						}
+					}
+					return c.Update(ctx, obj, opts...)
+				},
+			})
+			c := builder.Build()
+			store := &TombstoneStore{Client: c, Reader: c, Namespace: "system", Name: "tombstones"}
+
+			added := Tombstone{Instance: "default", Connection: "lab-vm", Namespace: "lab", VM: "vm", DeletedAt: metav1.Now()}
+			if err := store.Add(context.Background(), added); err != nil {
+				t.Fatal(err)
+			}
+			if (tt.concurrentCreate || tt.concurrentUpdate) && !raced {
+				t.Fatal("the concurrent write did not happen")
+			}
+
+			var configMap corev1.ConfigMap
+			if err := c.Get(context.Background(), store.key(), &configMap); err != nil {
+				t.Fatal(err)
+			}
+			if got := slices.Sorted(maps.Keys(configMap.Data)); !slices.Equal(got, tt.want) {
+				t.Errorf("tombstones = %v, want %v", got, tt.want)
+			}
+
+			// Removing the tombstone keeps the others
+			if err := store.Remove(context.Background(), added); err != nil {
+				t.Fatal(err)
+			}
+			tombstones, err := store.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tombstones) != len(tt.want)-1 || slices.ContainsFunc(tombstones, func(tombstone Tombstone) bool {
+				return tombstone.key() == added.key()
+			}) {
+				t.Errorf("tombstones after removal = %v", tombstones)
+			}
+		})
+	}
+}
+
+func TestTombstoneStoreList(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "system", Name: "tombstones"},
+		Data:       map[string]string{"other_lab-old": concurrentTombstone, "default_broken": "{"},
+	}).Build()
+	store := &TombstoneStore{Client: c, Reader: c, Namespace: "system", Name: "tombstones"}
+
+	tombstones, err := store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombstones) != 1 || tombstones[0].Instance != "other" || tombstones[0].Connection != "lab-old" {
+		t.Errorf("List() = %v, want only the valid tombstone", tombstones)
+	}
+
+	missing := &TombstoneStore{Client: c, Reader: c, Namespace: "system", Name: "missing"}
+	if tombstones, err := missing.List(context.Background()); err != nil || len(tombstones) != 0 {
+		t.Errorf("List() of a missing ConfigMap = %v, %v, want none", tombstones, err)
+	}
+	// Nothing to remove does not create the ConfigMap
+	if err := missing.Remove(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var configMap corev1.ConfigMap
+	if err := c.Get(context.Background(), missing.key(), &configMap); err == nil {
+		t.Error("Remove() without tombstones created the ConfigMap")
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	kubevirtv1alpha1 "setofangdar.polito.it/vm-watcher/api/v1alpha1"
+)
+
+// Field manager of everything the operator writes
+const FieldManager = "vm-watcher"
+
+// addFinalizer adds the operator's finalizer to the VM. The JSON patch only appends it, so that finalizers
+// added by KubeVirt or other tools at the same time are kept and no conflict is raised.
+func (r *VirtualMachineReconciler) addFinalizer(ctx context.Context, vm *kubevirtv1.VirtualMachine) error {
+	operations := []jsonPatchOperation{{Op: "add", Path: "/metadata/finalizers/-", Value: VMWatcherFinalizer}}
+	if len(vm.Finalizers) == 0 {
+		// Only create the list if it is still missing, a null test passes on a missing field
+		operations = []jsonPatchOperation{
+			{Op: "test", Path: "/metadata/finalizers", Value: nil},
+			{Op: "add", Path: "/metadata/finalizers", Value: []string{VMWatcherFinalizer}},
+		}
+	}
+	if err := r.jsonPatch(ctx, vm, operations); err != nil {
+		return fmt.Errorf("failed to add finalizer: %w", err)
+	}
+	return nil
+}
+
+// removeFinalizer removes the operator's finalizer from the VM, testing that it is still at the same index
+// so that a concurrent change to the finalizers fails the patch instead of removing another one
+func (r *VirtualMachineReconciler) removeFinalizer(ctx context.Context, vm *kubevirtv1.VirtualMachine) error {
+	index := slices.Index(vm.Finalizers, VMWatcherFinalizer)
+	if index < 0 {
+		return nil
+	}
+	path := fmt.Sprintf("/metadata/finalizers/%d", index)
+	if err := r.jsonPatch(ctx, vm, []jsonPatchOperation{
+		{Op: "test", Path: path, Value: VMWatcherFinalizer},
+		{Op: "remove", Path: path},
+	}); err != nil {
+		return fmt.Errorf("failed to remove finalizer: %w", err)
+	}
+	return nil
+}
+
+func (r *VirtualMachineReconciler) jsonPatch(ctx context.Context, vm *kubevirtv1.VirtualMachine, operations []jsonPatchOperation) error {
+	data, err := json.Marshal(operations)
+	if err != nil {
+		return err
+	}
+	return r.Patch(ctx, vm, client.RawPatch(types.JSONPatchType, data))
+}
+
+// adoptLegacyState moves the state earlier versions kept in the processed and last-status annotations of the
+// VM into the status object, then drops the annotations with a merge patch that touches nothing else
+func (r *VirtualMachineReconciler) adoptLegacyState(ctx context.Context, vm *kubevirtv1.VirtualMachine, connectionStatus *kubevirtv1alpha1.GuacamoleConnection) error {
+	_, processed := vm.Annotations[ProcessedAnnotation]
+	lastStatus, hasLastStatus := vm.Annotations[LastStatusAnnotation]
+	if !processed && !hasLastStatus {
+		return nil
+	}
+
+	if !connectionStatus.Status.Published && vm.Annotations[ProcessedAnnotation] == "true" {
+		if err := r.recordSyncedStatus(ctx, connectionStatus, lastStatus); err != nil {
+			return err
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				ProcessedAnnotation:  nil,
+				LastStatusAnnotation: nil,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.Patch(ctx, vm, client.RawPatch(types.MergePatchType, patch)); err != nil {
+		return fmt.Errorf("failed to remove legacy annotations: %w", err)
+	}
+	log.FromContext(ctx).Info("Moved connection state from VM annotations to GuacamoleConnection status", "vm", vm.Name)
+	return nil
+}
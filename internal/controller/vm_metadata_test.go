@@ -0,0 +1,125 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+func TestFinalizerPatches(t *testing.T) {
+	const other = "kubevirt.io/virtualMachineControllerFinalize"
+	tests := []struct {
+		name string
+		// Finalizers of the VM the reconciler saw, and of the VM stored in the API server
+		seen, stored []string
+		remove       bool
+		wantPatch    string
+		wantErr      bool
+		want         []string
+	}{
+		{
+			name:      "add first finalizer",
+			wantPatch: `[{"op":"test","path":"/metadata/finalizers","value":null},{"op":"add","path":"/metadata/finalizers","value":["` + VMWatcherFinalizer + `"]}]`,
+			want:      []string{VMWatcherFinalizer},
+		},
+		{
+			name:      "add next to others",
+			seen:      []string{other},
+			stored:    []string{other},
+			wantPatch: `[{"op":"add","path":"/metadata/finalizers/-","value":"` + VMWatcherFinalizer + `"}]`,
+			want:      []string{other, VMWatcherFinalizer},
+		},
+		{
+			name:    "add first finalizer raced",
+			stored:  []string{other},
+			wantErr: true,
+			want:    []string{other},
+		},
+		{
+			name:      "remove",
+			seen:      []string{other, VMWatcherFinalizer},
+			stored:    []string{other, VMWatcherFinalizer},
+			remove:    true,
+			wantPatch: `[{"op":"test","path":"/metadata/finalizers/1","value":"` + VMWatcherFinalizer + `"},{"op":"remove","path":"/metadata/finalizers/1"}]`,
+			want:      []string{other},
+		},
+		{
+			name:    "remove after finalizers changed",
+			seen:    []string{VMWatcherFinalizer},
+			stored:  []string{other, VMWatcherFinalizer},
+			remove:  true,
+			wantErr: true,
+			want:    []string{other, VMWatcherFinalizer},
+		},
+		{
+			name:   "remove missing finalizer",
+			seen:   []string{other},
+			stored: []string{other},
+			remove: true,
+			want:   []string{other},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "lab", Name: "vm", Finalizers: tt.stored}}
+			var patches []string
+			c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(stored).
+				WithInterceptorFuncs(interceptor.Funcs{
+					Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+						data, err := patch.Data(obj)
+						if err != nil {
+							return err
+						}
+						patches = append(patches, string(data))
+						return c.Patch(ctx, obj, patch, opts...)
+					},
+				}).Build()
+			r := &VirtualMachineReconciler{Client: c}
+
+			vm := &kubevirtv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "lab", Name: "vm", Finalizers: tt.seen}}
+			var err error
+			if tt.remove {
+				err = r.removeFinalizer(context.Background(), vm)
+			} else {
+				err = r.addFinalizer(context.Background(), vm)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantPatch != "" && (len(patches) != 1 || patches[0] != tt.wantPatch) {
+				t.Errorf("patches = %v, want %s", patches, tt.wantPatch)
+			}
+			if tt.remove && tt.wantPatch == "" && !tt.wantErr && len(patches) > 0 {
+				t.Errorf("patches = %v, want none", patches)
+			}
+
+			var got kubevirtv1.VirtualMachine
+			if err := c.Get(context.Background(), client.ObjectKeyFromObject(stored), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got.Finalizers, tt.want) {
+				t.Errorf("finalizers = %v, want %v", got.Finalizers, tt.want)
+			}
+		})
+	}
+}
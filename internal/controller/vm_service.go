@@ -0,0 +1,158 @@
+/*
+Copyright 2025.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// Annotation overriding the Service mode for a VM ("none", "clusterip" or "headless")
+	ServiceModeAnnotation = "vm-watcher.setofangdar.polito.it/service"
+
+	// Do not create a Service, connections point at the VMI address
+	ServiceModeNone = "none"
+	// Create a ClusterIP Service, connections point at its virtual IP
+	ServiceModeClusterIP = "clusterip"
+	// Create a headless Service, connections point at the virt-launcher pod through DNS
+	ServiceModeHeadless = "headless"
+
+	// Label KubeVirt sets on the virt-launcher pod of a VMI
+	domainLabel = "kubevirt.io/domain"
+	// Suffix of the name of the Service created for a VM
+	vmServiceSuffix = "-desktop"
+)
+
+// serviceModeFor returns the Service mode for the VM, preferring the annotation over the default
+func (r *VirtualMachineReconciler) serviceModeFor(vm *kubevirtv1.VirtualMachine) string {
+	mode := r.settings().serviceMode
+	if value, exists := vm.Annotations[ServiceModeAnnotation]; exists {
+		mode = strings.ToLower(strings.TrimSpace(value))
+	}
+	switch mode {
+	case ServiceModeClusterIP, ServiceModeHeadless:
+		return mode
+	default:
+		return ServiceModeNone
+	}
+}
+
+// vmServiceName returns the name of the Service the operator manages for the VM
+func vmServiceName(vm *kubevirtv1.VirtualMachine) string {
+	return vm.Name + vmServiceSuffix
+}
+
+// vmServiceHostname returns the DNS name of the VM's managed Service, or "" when it has none
+func (r *VirtualMachineReconciler) vmServiceHostname(vm *kubevirtv1.VirtualMachine) string {
+	if r.serviceModeFor(vm) == ServiceModeNone {
+		return ""
+	}
+	return fmt.Sprintf("%s.%s.svc.cluster.local", vmServiceName(vm), vm.Namespace)
+}
+
+// reconcileVMService creates or updates the Service exposing the VM's remote-desktop port,
+// or deletes it when the VM no longer wants one. The Service is owned by the VM.
+func (r *VirtualMachineReconciler) reconcileVMService(ctx context.Context, vm *kubevirtv1.VirtualMachine) error {
+	logger := log.FromContext(ctx)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      vmServiceName(vm),
+			Namespace: vm.Namespace,
+		},
+	}
+
+	mode := r.serviceModeFor(vm)
+	if mode == ServiceModeNone {
+		return r.deleteVMService(ctx, vm, service)
+	}
+
+	protocol, port := r.connectionProtocolAndPort(ctx, vm)
+	portNumber, err := strconv.ParseInt(port, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: %w", port, err)
+	}
+
+	// Never take over a Service the operator did not create
+	var existing corev1.Service
+	if err := r.Get(ctx, client.ObjectKeyFromObject(service), &existing); err == nil {
+		if !metav1.IsControlledBy(&existing, vm) {
+			return fmt.Errorf("service %s/%s exists and is not managed for this VM", existing.Namespace, existing.Name)
+		}
+		// The cluster IP is immutable, so switching between ClusterIP and headless recreates the Service
+		if (existing.Spec.ClusterIP == corev1.ClusterIPNone) != (mode == ServiceModeHeadless) {
+			logger.Info("Recreating VM Service for new mode", "service", existing.Name, "mode", mode)
+			if err := r.Delete(ctx, &existing); client.IgnoreNotFound(err) != nil {
+				return fmt.Errorf("failed to delete Service: %w", err)
+			}
+		}
+	} else if client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("failed to get Service: %w", err)
+	}
+
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, service, func() error {
+		if service.Labels == nil {
+			service.Labels = make(map[string]string)
+		}
+		service.Labels["app.kubernetes.io/managed-by"] = "vm-watcher"
+		service.Spec.Selector = map[string]string{domainLabel: vm.Name}
+		service.Spec.Ports = []corev1.ServicePort{{
+			Name:       protocol,
+			Protocol:   corev1.ProtocolTCP,
+			Port:       int32(portNumber),
+			TargetPort: intstr.FromInt32(int32(portNumber)),
+		}}
+		if service.CreationTimestamp.IsZero() {
+			service.Spec.Type = corev1.ServiceTypeClusterIP
+			if mode == ServiceModeHeadless {
+				service.Spec.ClusterIP = corev1.ClusterIPNone
+			}
+		}
+		return controllerutil.SetControllerReference(vm, service, r.Scheme)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create or update Service: %w", err)
+	}
+	if result != controllerutil.OperationResultNone {
+		logger.Info("Reconciled VM Service", "service", service.Name, "operation", result, "mode", mode)
+	}
+	return nil
+}
+
+// deleteVMService deletes the VM's Service if the operator created it
+func (r *VirtualMachineReconciler) deleteVMService(ctx context.Context, vm *kubevirtv1.VirtualMachine, service *corev1.Service) error {
+	if err := r.Get(ctx, client.ObjectKeyFromObject(service), service); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(service, vm) {
+		return nil
+	}
+	if err := r.Delete(ctx, service); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	log.FromContext(ctx).Info("Deleted VM Service", "service", service.Name)
+	return nil
+}
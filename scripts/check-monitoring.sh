@@ -0,0 +1,83 @@
+#!/bin/bash
+
+# End-to-end check that the vm-watcher dashboard gets data: Prometheus scrapes the operator's HTTPS
+# metrics endpoint with its service account token, and every panel of the dashboard is queried
+# through Grafana's Prometheus data source, as the dashboard does.
+#
+# Usage: PROMETHEUS_URL=http://<node-ip>:30090 GRAFANA_URL=http://<node-ip>:30300 scripts/check-monitoring.sh
+
+set -euo pipefail
+
+PROMETHEUS_URL="${PROMETHEUS_URL:-http://127.0.0.1:30090}"
+GRAFANA_URL="${GRAFANA_URL:-http://127.0.0.1:30300}"
+GRAFANA_AUTH="${GRAFANA_AUTH:-admin:admin}"
+DASHBOARD="${DASHBOARD:-$(dirname "$0")/../monitoring/dashboard/vmwatcherdashboard.json}"
+JOB="vm-watcher-operator"
+
+# Series the operator exports as soon as it runs, whatever the VMs and Guacamole traffic
+REQUIRED_QUERIES=(
+    "up{job=\"$JOB\"} == 1"
+    "guacamole_up"
+)
+
+failed=0
+
+# grafana_query runs a PromQL query through the data source of the dashboard and prints the number of series
+grafana_query() {
+    local uid
+    uid=$(jq -r '[.. | objects | select(.type? == "prometheus") | .uid? // empty][0]' "$DASHBOARD")
+    curl -fsS -u "$GRAFANA_AUTH" -G "$GRAFANA_URL/api/datasources/proxy/uid/$uid/api/v1/query" \
+        --data-urlencode "query=$1" | jq '.data.result | length'
+}
+
+echo "Checking the $JOB scrape targets..."
+targets=$(curl -fsS "$PROMETHEUS_URL/api/v1/targets?state=active" |
+    jq -r --arg job "$JOB" '.data.activeTargets[] | select(.scrapePool == $job) | "\(.health)\t\(.scrapeUrl)\t\(.lastError)"')
+if [[ -z "$targets" ]]; then
+    echo "  FAIL: no target, is the operator's metrics Service deployed in kubebuilderproject-system?"
+    exit 1
+fi
+while IFS=$'\t' read -r health url error; do
+    if [[ "$health" == "up" ]]; then
+        echo "  ok    $url"
+    else
+        # A TLS or 401/403 error means the metrics server and the scrape job disagree on HTTPS or the token
+        echo "  FAIL  $url: $health $error"
+        failed=1
+    fi
+done <<< "$targets"
+
+echo "Checking required series..."
+for query in "${REQUIRED_QUERIES[@]}"; do
+    if [[ "$(grafana_query "$query")" -gt 0 ]]; then
+        echo "  ok    $query"
+    else
+        echo "  FAIL  $query returned no data"
+        failed=1
+    fi
+done
+
+# The operator's instance label names the Guacamole instance. Without honor_labels Prometheus renames it
+# to exported_instance and the dashboard's instance variable lists pod addresses instead.
+if [[ "$(grafana_query 'guacamole_up{exported_instance!=""}')" -gt 0 ]]; then
+    echo "  FAIL  the instance label was renamed to exported_instance, set honor_labels on the $JOB job"
+    failed=1
+fi
+
+echo "Checking dashboard panels..."
+while IFS=$'\t' read -r title expr; do
+    query=${expr//\$instance/.*}
+    query=${query//\$__rate_interval/5m}
+    if [[ "$(grafana_query "$query")" -gt 0 ]]; then
+        echo "  ok    $title"
+    else
+        # Counters such as auth failures only appear once they were incremented
+        echo "  empty $title"
+    fi
+done < <(jq -r '.panels[] | select(.targets != null) | .title as $title | .targets[] | "\($title)\t\(.expr)"' "$DASHBOARD")
+
+if [[ "$failed" -ne 0 ]]; then
+    echo "The dashboard does not get the operator metrics"
+    exit 1
+fi
+echo "The dashboard gets the operator metrics"
@@ -49,6 +49,7 @@ show_help() {
     echo "  deploy                  Deploy operator (installs CRDs and deploys operator)"
     echo "  deploy-stack            Deploy Guacamole stack (Guacamole, Postgres, Keycloak)"
     echo "  monitoring              Deploy monitoring stack (Prometheus & Grafana)"
+    echo "  check-monitoring        Check that the operator dashboard gets data"
     echo "  push-custom-vm          Build and load custom Ubuntu image into K3s"
     echo "  create-vm               Create VMs and configure them with Ansible"
     echo "  configure-vms           Configure deployed VMs using Ansible"
@@ -951,6 +952,9 @@ case "${1:-help}" in
     monitoring)
         deploy_monitoring
         ;;
+    check-monitoring)
+        PROMETHEUS_URL="http://$NODE_IP:30090" GRAFANA_URL="http://$NODE_IP:30300" ./scripts/check-monitoring.sh
+        ;;
     cleanup-monitoring)
         cleanup_monitoring
         ;;